@@ -0,0 +1,127 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"time"
+)
+
+// トークンの秘密による接続の認証
+// 接続要求には host が使い捨てのチャレンジと自分の公開鍵を返し、client は秘密で HMAC を付けて要求し直す
+// HMAC は双方の公開鍵も含むので、秘密を知らない中間者は鍵をすり替えられない
+// host も承認時に同じく HMAC を返し、client は相手がトークンを発行した本人か確かめる
+const (
+	tokenSecretSize       = 16
+	authNonceSize         = 16
+	authChallengeTTL      = 30 * time.Second
+	authChallengeInterval = time.Second // 同じ IP にチャレンジを発行する間隔
+	maxPendingAuth        = 256         // 応答待ちのチャレンジの上限 (満杯の間は新しい要求を断る)
+	authProofClientTag    = "QuickPort client proof"
+	authProofHostTag      = "QuickPort host proof"
+)
+
+// newTokenSecret はトークンに載せる秘密を作る
+func newTokenSecret() ([]byte, error) {
+	secret := make([]byte, tokenSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// authProof は秘密を知っていることを示す HMAC (tag で client と host の向きを分ける)
+func authProof(secret []byte, tag string, nonce, clientPublic, hostPublic []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(tag))
+	mac.Write(nonce)
+	mac.Write(clientPublic)
+	mac.Write(hostPublic)
+	return mac.Sum(nil)
+}
+
+// pendingAuth は host がチャレンジを送って応答を待っている接続要求
+type pendingAuth struct {
+	key     *sessionKey
+	nonce   []byte
+	created time.Time
+}
+
+// authChallenges は接続元のアドレスごとの応答待ちのチャレンジ
+// 送信元を偽った要求の連続で正しい相手のチャレンジが追い出されないよう、満杯の間は古いものを捨てずに新しい要求を断り、
+// 同じ IP には authChallengeInterval に1つしか発行しない
+type authChallenges struct {
+	pending map[string]*pendingAuth // 接続元のアドレス (IP とポート) ごと
+	issued  map[string]time.Time    // IP ごとの最後に発行した時刻
+}
+
+func newAuthChallenges() *authChallenges {
+	return &authChallenges{pending: map[string]*pendingAuth{}, issued: map[string]time.Time{}}
+}
+
+// Issue は addr に送るチャレンジを作る (同じ相手の前のチャレンジは無効になる)
+// 発行を断ったときは nil を返す
+func (c *authChallenges) Issue(addr *net.UDPAddr) (*pendingAuth, error) {
+	c.expire()
+	ip := addr.IP.String()
+	if last, ok := c.issued[ip]; ok && time.Since(last) < authChallengeInterval {
+		return nil, nil
+	}
+	if _, ok := c.pending[addr.String()]; !ok && len(c.pending) >= maxPendingAuth {
+		return nil, nil
+	}
+
+	key, err := newSessionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, authNonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pendingAuth{key: key, nonce: nonce, created: time.Now()}
+	c.pending[addr.String()] = p
+	c.issued[ip] = p.created
+	return p, nil
+}
+
+// Verify は addr からの応答を確かめる。チャレンジは一度しか使えない
+// 証明の合わない応答ではチャレンジを消さない (送信元を偽った応答で正しい相手の認証を邪魔させない)
+func (c *authChallenges) Verify(addr *net.UDPAddr, secret []byte, auth *AuthData) (*pendingAuth, bool) {
+	c.expire()
+	p, ok := c.pending[addr.String()]
+	if !ok {
+		return nil, false
+	}
+
+	if !hmac.Equal(auth.Nonce, p.nonce) {
+		return nil, false
+	}
+
+	expected := authProof(secret, authProofClientTag, p.nonce, auth.PublicKey, p.key.Public())
+	if !hmac.Equal(auth.Proof, expected) {
+		return nil, false
+	}
+
+	delete(c.pending, addr.String())
+	return p, true
+}
+
+func (c *authChallenges) expire() {
+	for k, p := range c.pending {
+		if time.Since(p.created) > authChallengeTTL {
+			delete(c.pending, k)
+		}
+	}
+	for ip, last := range c.issued {
+		if time.Since(last) >= authChallengeInterval {
+			delete(c.issued, ip)
+		}
+	}
+}
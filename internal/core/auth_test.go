@@ -0,0 +1,53 @@
+package core
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAuthChallengesSpoofedBurst(t *testing.T) {
+	c := newAuthChallenges()
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	real, err := c.Issue(client)
+	if err != nil || real == nil {
+		t.Fatalf("Issue() = %v, %v", real, err)
+	}
+
+	// 送信元を偽った要求で表を埋めても、先に発行したチャレンジは残る
+	for i := 0; i < 2*maxPendingAuth; i++ {
+		spoofed := &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 1000 + i}
+		if _, err := c.Issue(spoofed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.pending) > maxPendingAuth {
+		t.Errorf("%d pending challenges, want at most %d", len(c.pending), maxPendingAuth)
+	}
+
+	// 同じ IP からの続けての要求には発行しない
+	again := &net.UDPAddr{IP: client.IP, Port: client.Port + 1}
+	if p, _ := c.Issue(again); p != nil {
+		t.Error("Issue() did not rate-limit a second request from the same IP")
+	}
+
+	secret := []byte("0123456789abcdef")
+	key, err := newSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &AuthData{PublicKey: key.Public(), Nonce: real.nonce}
+
+	// 証明の合わない応答ではチャレンジは消えない
+	auth.Proof = authProof([]byte("wrong secret...."), authProofClientTag, real.nonce, key.Public(), real.key.Public())
+	if _, ok := c.Verify(client, secret, auth); ok {
+		t.Fatal("Verify() accepted a proof with the wrong secret")
+	}
+
+	auth.Proof = authProof(secret, authProofClientTag, real.nonce, key.Public(), real.key.Public())
+	if p, ok := c.Verify(client, secret, auth); !ok || p != real {
+		t.Fatal("Verify() rejected the real client after a spoofed burst")
+	}
+	if _, ok := c.Verify(client, secret, auth); ok {
+		t.Error("Verify() accepted the same challenge twice")
+	}
+}
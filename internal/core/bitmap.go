@@ -0,0 +1,138 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// chunkBitmap は受信済みチャンクを1チャンク1ビットで記録する
+type chunkBitmap struct {
+	bits  []uint64
+	size  uint32
+	count uint32
+}
+
+func newChunkBitmap(size uint32) *chunkBitmap {
+	return &chunkBitmap{
+		bits: make([]uint64, (size+63)/64),
+		size: size,
+	}
+}
+
+// Set は index を受信済みにする。新しく立てた場合は true
+func (b *chunkBitmap) Set(index uint32) bool {
+	if index >= b.size || b.Has(index) {
+		return false
+	}
+
+	b.bits[index/64] |= 1 << (index % 64)
+	b.count++
+	return true
+}
+
+// Clear は index を未受信に戻す
+func (b *chunkBitmap) Clear(index uint32) {
+	if !b.Has(index) {
+		return
+	}
+
+	b.bits[index/64] &^= 1 << (index % 64)
+	b.count--
+}
+
+func (b *chunkBitmap) Has(index uint32) bool {
+	if index >= b.size {
+		return false
+	}
+
+	return b.bits[index/64]&(1<<(index%64)) != 0
+}
+
+// Count は受信済みチャンク数
+func (b *chunkBitmap) Count() uint32 {
+	return b.count
+}
+
+func (b *chunkBitmap) Size() uint32 {
+	return b.size
+}
+
+func (b *chunkBitmap) Complete() bool {
+	return b.count == b.size
+}
+
+// FirstMissing は from 以降で最初の未受信チャンクを返す。無ければ Size()
+func (b *chunkBitmap) FirstMissing(from uint32) uint32 {
+	for i := from; i < b.size; {
+		word := ^b.bits[i/64] >> (i % 64)
+		if word != 0 {
+			i += uint32(bits.TrailingZeros64(word))
+			if i >= b.size {
+				return b.size
+			}
+			return i
+		}
+		i += 64 - i%64
+	}
+
+	return b.size
+}
+
+// Slice は [start, end) のビットを start を先頭にしたバイト列にする
+func (b *chunkBitmap) Slice(start, end uint32) []byte {
+	if end > b.size {
+		end = b.size
+	}
+	if start >= end {
+		return nil
+	}
+
+	raw := make([]byte, (end-start+7)/8)
+	for i := start; i < end; i++ {
+		if b.Has(i) {
+			raw[(i-start)/8] |= 1 << ((i - start) % 8)
+		}
+	}
+
+	return raw
+}
+
+// Reset は全チャンクを未受信に戻す
+func (b *chunkBitmap) Reset() {
+	for i := range b.bits {
+		b.bits[i] = 0
+	}
+	b.count = 0
+}
+
+// Bytes はビットマップをリトルエンディアンのバイト列にする
+func (b *chunkBitmap) Bytes() []byte {
+	raw := make([]byte, len(b.bits)*8)
+	for i, word := range b.bits {
+		binary.LittleEndian.PutUint64(raw[i*8:], word)
+	}
+
+	return raw
+}
+
+func chunkBitmapFromBytes(size uint32, raw []byte) (*chunkBitmap, error) {
+	b := newChunkBitmap(size)
+	if len(raw) != len(b.bits)*8 {
+		return nil, fmt.Errorf("bitmap length mismatch: expected %d bytes, got %d", len(b.bits)*8, len(raw))
+	}
+
+	for i := range b.bits {
+		b.bits[i] = binary.LittleEndian.Uint64(raw[i*8:])
+	}
+
+	// 範囲外のビットは落としてから数え直す
+	if size%64 != 0 {
+		b.bits[len(b.bits)-1] &= (1 << (size % 64)) - 1
+	}
+	for _, word := range b.bits {
+		b.count += uint32(bits.OnesCount64(word))
+	}
+
+	return b, nil
+}
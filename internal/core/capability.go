@@ -0,0 +1,124 @@
+package core
+
+import (
+	"QuickPort/tray"
+	"fmt"
+	"strings"
+)
+
+// Capability はピア間で合意する機能のビット集合
+type Capability uint64
+
+const (
+	CapCompressZstd Capability = 1 << iota
+	CapCompressGzip
+	CapCompressSnappy
+	CapHashFNV32
+	CapResume
+	CapFEC
+	CapSinglePort // 制御とデータを1つの UDP ポートで送る
+	CapPut        // put でこちらからファイルを送る
+	CapDirectory  // ディレクトリをファイル一覧と共に送る
+	CapHashSHA256
+	CapMerkle     // セグメントごとに Merkle 木で検証する
+	CapDelta      // 手元の古いファイルとの差分だけを送る
+	CapRateUpdate // 転送中に帯域上限を変える
+	CapPreparing  // FileIndex を用意している間も生存通知を送る
+)
+
+var capabilityNames = []struct {
+	cap  Capability
+	name string
+}{
+	{CapCompressZstd, "zstd"},
+	{CapCompressGzip, "gzip"},
+	{CapCompressSnappy, "snappy"},
+	{CapHashFNV32, "fnv32"},
+	{CapResume, "resume"},
+	{CapFEC, "fec"},
+	{CapSinglePort, "single-port"},
+	{CapPut, "put"},
+	{CapDirectory, "dir"},
+	{CapHashSHA256, "sha256"},
+	{CapMerkle, "merkle"},
+	{CapDelta, "delta"},
+	{CapRateUpdate, "rate-update"},
+	{CapPreparing, "preparing"},
+}
+
+// 各グループから最低1つは共通の機能が無いと通信できない
+var requiredCapabilities = []struct {
+	mask Capability
+	name string
+}{
+	{CapHashSHA256 | CapHashFNV32, "hash algorithm"},
+}
+
+// LocalCapabilities はこのビルドが対応している機能
+func LocalCapabilities() Capability {
+	return CapCompressZstd | CapCompressGzip | CapCompressSnappy | CapHashFNV32 | CapResume | CapFEC | CapSinglePort | CapPut | CapDirectory | CapHashSHA256 | CapMerkle | CapDelta | CapRateUpdate | CapPreparing
+}
+
+func (c Capability) Has(flag Capability) bool {
+	return c&flag == flag
+}
+
+func (c Capability) String() string {
+	names := []string{}
+	for _, n := range capabilityNames {
+		if c.Has(n.cap) {
+			names = append(names, n.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// negotiate はピアが提示したバージョンと機能から、双方が使える最大の組み合わせを決める
+func negotiate(auth *AuthData) (int, Capability, error) {
+	version := ProtocolVersion
+	if auth.Version < version {
+		version = auth.Version
+	}
+
+	if version < MinProtocolVersion || version < auth.MinVersion {
+		return 0, 0, fmt.Errorf("incompatible protocol version: peer supports %d-%d, we support %d-%d",
+			auth.MinVersion, auth.Version, MinProtocolVersion, ProtocolVersion)
+	}
+
+	caps := LocalCapabilities() & Capability(auth.Caps)
+	for _, required := range requiredCapabilities {
+		if caps&required.mask == 0 {
+			return 0, 0, fmt.Errorf("no common %s (peer: %s, local: %s)",
+				required.name, Capability(auth.Caps), LocalCapabilities())
+		}
+	}
+
+	return version, caps, nil
+}
+
+// HashAlgorithm はファイルの整合性確認に使うハッシュ。FNV は SHA-256 に対応していないピアとだけ使う
+func (p *PeerConfig) HashAlgorithm() string {
+	if p.Caps.Has(CapHashSHA256) {
+		return tray.HashSHA256
+	}
+
+	return tray.HashFNV32
+}
+
+// compModeCapability は圧縮モードに必要な機能を返す。圧縮しない場合は 0
+func compModeCapability(mode string) Capability {
+	switch mode {
+	case "high":
+		return CapCompressZstd
+	case "medium":
+		return CapCompressGzip
+	case "low":
+		return CapCompressSnappy
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"QuickPort/tray"
+	"testing"
+)
+
+func TestNegotiateHashAlgorithm(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    AuthData
+		version int
+		hash    string
+	}{
+		{"oldest supported peer", AuthData{Version: MinProtocolVersion, MinVersion: MinProtocolVersion, Caps: uint64(LocalCapabilities())}, MinProtocolVersion, tray.HashSHA256},
+		{"current peer", AuthData{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Caps: uint64(LocalCapabilities())}, ProtocolVersion, tray.HashSHA256},
+		{"newer peer", AuthData{Version: ProtocolVersion + 1, MinVersion: MinProtocolVersion, Caps: uint64(LocalCapabilities())}, ProtocolVersion, tray.HashSHA256},
+		// SHA-256 を名乗らないピアとは FNV で計算する
+		{"fnv only peer", AuthData{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Caps: uint64(CapHashFNV32 | CapResume | CapFEC)}, ProtocolVersion, tray.HashFNV32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, caps, err := negotiate(&tt.auth)
+			if err != nil {
+				t.Fatalf("negotiate: %v", err)
+			}
+			if version != tt.version {
+				t.Errorf("version = %d, want %d", version, tt.version)
+			}
+
+			peer := &PeerConfig{Version: version, Caps: caps}
+			if got := peer.HashAlgorithm(); got != tt.hash {
+				t.Errorf("HashAlgorithm() = %q, want %q", got, tt.hash)
+			}
+		})
+	}
+}
+
+func TestNegotiateRejectsVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		auth AuthData
+	}{
+		// セッション鍵とトークンの証明を送らないピアとは話せない
+		{"before session keys", AuthData{Version: MinProtocolVersion - 1, MinVersion: 2, Caps: uint64(LocalCapabilities())}},
+		{"peer requires newer", AuthData{Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1, Caps: uint64(LocalCapabilities())}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := negotiate(&tt.auth); err == nil {
+				t.Fatalf("negotiate accepted peer v%d-%d", tt.auth.MinVersion, tt.auth.Version)
+			}
+		})
+	}
+}
+
+func TestNegotiateRejectsNoCommonHash(t *testing.T) {
+	_, _, err := negotiate(&AuthData{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Caps: uint64(CapResume)})
+	if err == nil {
+		t.Fatal("negotiate succeeded without a usable hash algorithm")
+	}
+}
+
+func TestDecodeRejectsOldFrame(t *testing.T) {
+	raw, err := encodeFrame(&BaseData{Type: Message, Transfer: 1, Data: &MessageData{Text: "hi"}}, ProtocolVersion)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	raw[2] = MinProtocolVersion - 1
+	if _, err := decodeFrame(raw); err == nil {
+		t.Fatalf("decoded a v%d frame", MinProtocolVersion-1)
+	}
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// fileChunkSource はディスク上のファイルからチャンクを都度読み出す
+// ファイル全体をメモリに載せずに、再送もインデックス指定で行える
+type fileChunkSource struct {
+	file      *os.File
+	size      int64
+	chunkSize int
+	codec     *blockCodec
+	buf       []byte
+}
+
+func newFileChunkSource(file *os.File, size int64, chunkSize int, compMode string) (*fileChunkSource, error) {
+	codec, err := newBlockCodec(compMode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileChunkSource{
+		file:      file,
+		size:      size,
+		chunkSize: chunkSize,
+		codec:     codec,
+		buf:       make([]byte, chunkSize),
+	}, nil
+}
+
+func (s *fileChunkSource) Close() {
+	s.codec.Close()
+}
+
+func (s *fileChunkSource) Count() uint32 {
+	return uint32((s.size + int64(s.chunkSize) - 1) / int64(s.chunkSize))
+}
+
+// ReadChunk は index 番目のチャンクを読み出し、必要なら圧縮して返す
+// 返り値のスライスは次の呼び出しまでしか有効でない
+func (s *fileChunkSource) ReadChunk(index uint32) ([]byte, uint8, error) {
+	if index >= s.Count() {
+		return nil, 0, fmt.Errorf("chunk index out of range: %d", index)
+	}
+
+	offset := int64(index) * int64(s.chunkSize)
+	n, err := s.file.ReadAt(s.buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	data, compressed, err := s.codec.Compress(s.buf[:n])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var flags uint8
+	if compressed {
+		flags |= ChunkCompressed
+	}
+
+	return data, flags, nil
+}
@@ -1,8 +1,10 @@
 package core
 
 import (
+	"QuickPort/qrcode"
 	"QuickPort/tray"
 	"QuickPort/utils"
+	"errors"
 	"fmt"
 	"os"
 	"text/tabwriter"
@@ -27,13 +29,62 @@ func Client() (*Handle, error) {
 
 		cfg, err = ParseToken(token)
 		if err != nil {
-			logrus.Info("\ninvaid token")
+			logrus.Infof("\ninvalid token: %v", err)
 			continue
 		}
 
 		break
 	}
 
+	return clientSession(cfg)
+}
+
+// ClientFromImage は画像 (スクリーンショットなど) の QR コードからトークンを読んで接続する
+func ClientFromImage(path string) (*Handle, error) {
+	token, err := qrcode.DecodeFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := ParseToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token in %s: %v", path, err)
+	}
+
+	return clientSession(cfg)
+}
+
+// ClientCode はペアリングコードで host からトークンを受け取って接続する
+func ClientCode() (*Handle, error) {
+	tty, err := utils.UseTty()
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg *PeerConfig
+	for {
+		fmt.Print("Enter code: ")
+		code, err := tty.ReadString()
+		if err != nil {
+			return nil, err
+		}
+
+		cfg, err = joinCode(code)
+		if errors.Is(err, errInvalidCode) {
+			logrus.Infof("\ninvalid code: %v", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		break
+	}
+
+	return clientSession(cfg)
+}
+
+func clientSession(cfg *PeerConfig) (*Handle, error) {
 	fmt.Println("Connecting to:", cfg.Name, cfg.Addr.Ip, cfg.Addr.Port)
 
 	self, err := SetupPort()
@@ -67,6 +118,9 @@ func Client() (*Handle, error) {
 	}
 	logrus.Info("Tray sent successfully")
 
+	// 経路 MTU を調べてチャンクサイズを決める
+	peer.Datagram = ProbeMTU(self, peer)
+
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
 	fmt.Fprintf(w, "filename\tsize\thash\n")
 	for _, t := range *peertray {
@@ -74,5 +128,5 @@ func Client() (*Handle, error) {
 	}
 	w.Flush()
 
-	return &Handle{Self: self, Peer: peer}, nil
+	return &Handle{Self: self, Peer: peer, Limit: NewRateLimiter(0), PeerTray: *peertray}, nil
 }
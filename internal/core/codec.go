@@ -0,0 +1,701 @@
+package core
+
+import (
+	"QuickPort/tray"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// 制御パケットのフレーム
+// [Magic:2][Version:1][Type:1][Length:4][Transfer:4][Payload:Length]
+// Auth だけは古いピアとも交渉できるよう Transfer を持たない
+const (
+	ProtocolVersion    = 13
+	MinProtocolVersion = 13 // 暗号化とトークンの証明を必須にしたバージョン (Sync はこれより前のピアと接続できない)
+	authLayoutVersion  = 2  // Auth のレイアウトを固定したバージョン
+
+	frameMagic      = "QP"
+	frameHeaderSize = 12
+	authHeaderSize  = 8
+	maxFrameSize    = 65507 // UDP で送れる最大ペイロード
+	// 認証後のフレームにはチャンネルバイトと暗号化の分が付く
+	maxPayloadSize = maxFrameSize - frameHeaderSize - 1 - sessionOverhead
+)
+
+// 今後ペイロードにフィールドを足すときは、合意したバージョン (wireWriter/wireReader の version) で読み書きを分ける
+// 新しい機能はバージョンではなく機能のビットで合意し、MinProtocolVersion は古いピアと話せなくなるときだけ上げる
+
+var (
+	errFrameTooLarge = errors.New("frame too large")
+	errShortPayload  = errors.New("payload truncated")
+)
+
+// versionError は対応していないバージョンのフレームを受け取ったことを表す
+type versionError struct {
+	Version int
+}
+
+func (e *versionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version: %d (supported %d-%d)", e.Version, MinProtocolVersion, ProtocolVersion)
+}
+
+// Payload は dataType ごとの型付きペイロード
+type Payload interface {
+	encode(w *wireWriter)
+	decode(r *wireReader) error
+}
+
+// newPayload は dataType に対応するペイロードの空の値を返す
+func newPayload(t dataType) (Payload, error) {
+	switch t {
+	case SyncTray:
+		return &TrayData{}, nil
+	case Auth:
+		return &AuthData{}, nil
+	case Message:
+		return &MessageData{}, nil
+	case FileReqest:
+		return &fileRequestData{}, nil
+	case FileIndex:
+		return &FileIndexData{}, nil
+	case Sack:
+		return &SackData{}, nil
+	case Ping:
+		return &PingData{}, nil
+	case Error:
+		return &ErrorPacketData{}, nil
+	case Feedback:
+		return &FeedbackData{}, nil
+	case StartTransfer:
+		return &StartTransferData{}, nil
+	case Finish:
+		return &FinishPacketData{}, nil
+	case Probe:
+		return &ProbeData{}, nil
+	case ProbeAck:
+		return &ProbeAckData{}, nil
+	case PathMTU:
+		return &PathMTUData{}, nil
+	case PutOffer:
+		return &PutOfferData{}, nil
+	case ManifestRequest:
+		return &ManifestRequestData{}, nil
+	case Manifest:
+		return &ManifestData{}, nil
+	case SegmentHashRequest:
+		return &SegmentHashRequestData{}, nil
+	case SegmentHashes:
+		return &SegmentHashData{}, nil
+	case Resend:
+		return &ResendData{}, nil
+	case SignatureRequest:
+		return &SignatureRequestData{}, nil
+	case Signatures:
+		return &SignatureData{}, nil
+	case RateUpdate:
+		return &RateUpdateData{}, nil
+	case Preparing:
+		return &PreparingData{}, nil
+	default:
+		return nil, fmt.Errorf("unknown packet type: %d", t)
+	}
+}
+
+// encodeFrame は BaseData を version のレイアウトでフレームにする (Auth はどのバージョンでも同じ)
+func encodeFrame(data *BaseData, version int) ([]byte, error) {
+	expected, err := newPayload(data.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := data.Data
+	if payload == nil {
+		payload = expected
+	}
+	if reflect.TypeOf(payload) != reflect.TypeOf(expected) {
+		return nil, fmt.Errorf("payload %T does not match packet type %d", payload, data.Type)
+	}
+
+	headerSize := frameHeaderLen(data.Type)
+	w := &wireWriter{buf: make([]byte, headerSize, 256), version: version}
+	payload.encode(w)
+
+	length := len(w.buf) - headerSize
+	if length > maxPayloadSize {
+		return nil, fmt.Errorf("%w: %d bytes", errFrameTooLarge, length)
+	}
+
+	copy(w.buf[0:2], frameMagic)
+	w.buf[2] = byte(version)
+	w.buf[3] = byte(data.Type)
+	binary.LittleEndian.PutUint32(w.buf[4:8], uint32(length))
+	if headerSize == frameHeaderSize {
+		binary.LittleEndian.PutUint32(w.buf[8:12], data.Transfer)
+	}
+
+	return w.buf, nil
+}
+
+// decodeFrame はフレームを検証して BaseData に戻す
+func decodeFrame(raw []byte) (*BaseData, error) {
+	if len(raw) < authHeaderSize {
+		return nil, fmt.Errorf("frame too small: %d bytes", len(raw))
+	}
+	if string(raw[0:2]) != frameMagic {
+		return nil, fmt.Errorf("not a QuickPort frame")
+	}
+	// Auth はバージョン交渉に使うので、レイアウトが同じならどのバージョンからでも受け付ける
+	version := int(raw[2])
+	if dataType(raw[3]) == Auth {
+		if version < authLayoutVersion {
+			return nil, &versionError{Version: version}
+		}
+	} else if version < MinProtocolVersion || version > ProtocolVersion {
+		return nil, &versionError{Version: version}
+	}
+
+	t := dataType(raw[3])
+	headerSize := frameHeaderLen(t)
+	if len(raw) < headerSize {
+		return nil, fmt.Errorf("frame too small: %d bytes", len(raw))
+	}
+
+	length := binary.LittleEndian.Uint32(raw[4:8])
+	if length > maxPayloadSize {
+		return nil, fmt.Errorf("%w: %d bytes", errFrameTooLarge, length)
+	}
+	if int(length) != len(raw)-headerSize {
+		return nil, fmt.Errorf("frame length mismatch: header %d, actual %d", length, len(raw)-headerSize)
+	}
+
+	var transfer uint32
+	if headerSize == frameHeaderSize {
+		transfer = binary.LittleEndian.Uint32(raw[8:12])
+	}
+
+	payload, err := newPayload(t)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &wireReader{buf: raw[headerSize:], version: version}
+	err = payload.decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode packet type %d: %v", t, err)
+	}
+	if len(r.buf) != 0 {
+		return nil, fmt.Errorf("failed to decode packet type %d: %d trailing bytes", t, len(r.buf))
+	}
+
+	return &BaseData{Type: t, Transfer: transfer, Data: payload}, nil
+}
+
+// frameHeaderLen は dataType ごとのフレームヘッダーの大きさ
+func frameHeaderLen(t dataType) int {
+	if t == Auth {
+		return authHeaderSize
+	}
+
+	return frameHeaderSize
+}
+
+// wireWriter はリトルエンディアンでペイロードを書き出す
+type wireWriter struct {
+	buf     []byte
+	version int // 書き出すレイアウトのバージョン
+}
+
+func (w *wireWriter) u8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *wireWriter) bool(v bool) {
+	if v {
+		w.u8(1)
+	} else {
+		w.u8(0)
+	}
+}
+
+func (w *wireWriter) u32(v uint32) {
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+}
+
+func (w *wireWriter) u64(v uint64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, v)
+}
+
+func (w *wireWriter) i64(v int64) {
+	w.u64(uint64(v))
+}
+
+func (w *wireWriter) bytes(v []byte) {
+	w.u32(uint32(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *wireWriter) str(v string) {
+	w.u32(uint32(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *wireWriter) u32s(v []uint32) {
+	w.u32(uint32(len(v)))
+	for _, x := range v {
+		w.u32(x)
+	}
+}
+
+// wireReader はペイロードを読み出す。途中で足りなくなったら以降はゼロ値を返し err を残す
+type wireReader struct {
+	buf     []byte
+	err     error
+	version int // 読み出すレイアウトのバージョン
+}
+
+func (r *wireReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = errShortPayload
+		r.buf = nil
+		return nil
+	}
+
+	v := r.buf[:n]
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *wireReader) u8() uint8 {
+	v := r.take(1)
+	if v == nil {
+		return 0
+	}
+	return v[0]
+}
+
+func (r *wireReader) bool() bool {
+	return r.u8() != 0
+}
+
+func (r *wireReader) u32() uint32 {
+	v := r.take(4)
+	if v == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(v)
+}
+
+func (r *wireReader) u64() uint64 {
+	v := r.take(8)
+	if v == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(v)
+}
+
+func (r *wireReader) i64() int64 {
+	return int64(r.u64())
+}
+
+// count は要素数を読み、残りのバイト数で収まらない値は拒否する
+func (r *wireReader) count(elemSize int) int {
+	n := r.u32()
+	if r.err == nil && uint64(n)*uint64(elemSize) > uint64(len(r.buf)) {
+		r.err = errShortPayload
+		r.buf = nil
+		return 0
+	}
+	return int(n)
+}
+
+func (r *wireReader) bytes() []byte {
+	n := r.count(1)
+	v := r.take(n)
+	if v == nil {
+		return nil
+	}
+	return append([]byte(nil), v...)
+}
+
+func (r *wireReader) str() string {
+	return string(r.take(r.count(1)))
+}
+
+func (r *wireReader) u32s() []uint32 {
+	n := r.count(4)
+	if r.err != nil {
+		return nil
+	}
+
+	v := make([]uint32, n)
+	for i := range v {
+		v[i] = r.u32()
+	}
+	return v
+}
+
+// 各ペイロードのエンコード/デコード
+
+func (d *TrayData) encode(w *wireWriter) {
+	w.u32(uint32(len(*d)))
+	for _, f := range *d {
+		w.str(f.Filename)
+		w.i64(f.Size)
+		w.str(f.Hash)
+		w.str(f.HashAlgo)
+	}
+}
+
+func (d *TrayData) decode(r *wireReader) error {
+	n := r.count(16) // 最小でも文字列長2つとサイズ
+	items := make(TrayData, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		item := tray.FileMeta{
+			Filename: r.str(),
+			Size:     r.i64(),
+			Hash:     r.str(),
+			HashAlgo: r.str(),
+		}
+		items = append(items, item)
+	}
+	*d = items
+	return r.err
+}
+
+// Auth のレイアウトはバージョン間で変えない。新しいフィールドは末尾に追加する
+func (d *AuthData) encode(w *wireWriter) {
+	w.u8(uint8(d.Version))
+	w.u8(uint8(d.MinVersion))
+	w.u64(d.Caps)
+	w.str(d.Name)
+	w.u32(uint32(d.SubPort))
+	w.u8(uint8(d.Flag))
+	w.str(d.Reason)
+	w.bytes(d.PublicKey)
+	w.bytes(d.Nonce)
+	w.bytes(d.Proof)
+}
+
+func (d *AuthData) decode(r *wireReader) error {
+	d.Version = int(r.u8())
+	d.MinVersion = int(r.u8())
+	d.Caps = r.u64()
+	d.Name = r.str()
+	d.SubPort = int(r.u32())
+	d.Flag = tray.AuthFlag(r.u8())
+	d.Reason = r.str()
+	if len(r.buf) > 0 {
+		d.PublicKey = r.bytes()
+		d.Nonce = r.bytes()
+		d.Proof = r.bytes()
+	}
+
+	// 新しいバージョンが追加したフィールドは読み飛ばす
+	r.take(len(r.buf))
+	return r.err
+}
+
+func (d *MessageData) encode(w *wireWriter) {
+	w.str(d.Text)
+}
+
+func (d *MessageData) decode(r *wireReader) error {
+	d.Text = r.str()
+	return r.err
+}
+
+func (d *fileRequestData) encode(w *wireWriter) {
+	w.str(d.FilePath)
+	w.str(d.CompMode)
+	w.str(d.ResumeHash)
+	w.i64(d.RateLimit)
+	w.u32(uint32(d.Redundancy))
+	w.u32(uint32(d.ChunkSize))
+	w.bool(d.Offer)
+	w.u32(d.DeltaBlockSize)
+	w.u32(d.DeltaBlocks)
+}
+
+func (d *fileRequestData) decode(r *wireReader) error {
+	d.FilePath = r.str()
+	d.CompMode = r.str()
+	d.ResumeHash = r.str()
+	d.RateLimit = r.i64()
+	d.Redundancy = int(r.u32())
+	d.ChunkSize = int(r.u32())
+	d.Offer = r.bool()
+	d.DeltaBlockSize = r.u32()
+	d.DeltaBlocks = r.u32()
+	return r.err
+}
+
+func (d *FileIndexData) encode(w *wireWriter) {
+	w.str(d.FilePath)
+	w.i64(d.TotalSize)
+	w.u32(d.ChunkCount)
+	w.str(d.FileHash)
+	w.str(d.HashAlgo)
+	w.u32(uint32(d.ChunkSize))
+	w.u32(d.FecBlock)
+	w.u32(d.FecParity)
+	w.u32(d.SegmentChunks)
+	w.bytes(d.MerkleRoot)
+	w.bool(d.Delta)
+	w.i64(d.TargetSize)
+}
+
+func (d *FileIndexData) decode(r *wireReader) error {
+	d.FilePath = r.str()
+	d.TotalSize = r.i64()
+	d.ChunkCount = r.u32()
+	d.FileHash = r.str()
+	d.HashAlgo = r.str()
+	d.ChunkSize = int(r.u32())
+	d.FecBlock = r.u32()
+	d.FecParity = r.u32()
+	d.SegmentChunks = r.u32()
+	d.MerkleRoot = r.bytes()
+	d.Delta = r.bool()
+	d.TargetSize = r.i64()
+	if r.err == nil && !d.valid() {
+		return fmt.Errorf("invalid file index")
+	}
+	return r.err
+}
+
+// valid は受信側が確保する大きさを決めるフィールドが、互いに矛盾していないか確かめる
+func (d *FileIndexData) valid() bool {
+	if d.TotalSize < 0 || d.TargetSize < 0 || d.ChunkSize <= 0 || d.ChunkSize > math.MaxUint16 {
+		return false
+	}
+	if d.FecParity > 0 && (d.FecBlock == 0 || d.FecBlock+d.FecParity > 256) {
+		return false
+	}
+
+	// チャンクは実際に送るデータ (差分なら差分) を ChunkSize ごとに区切ったもの
+	chunks := d.TotalSize / int64(d.ChunkSize)
+	if d.TotalSize%int64(d.ChunkSize) != 0 {
+		chunks++
+	}
+	if int64(d.ChunkCount) != chunks {
+		return false
+	}
+
+	if d.SegmentChunks > 0 && (d.SegmentChunks < merkleMinSegmentChunks || d.SegmentChunks > merkleMaxSegmentChunks ||
+		len(d.MerkleRoot) != merkleHashSize) {
+		return false
+	}
+
+	return true
+}
+
+func (d *SackData) encode(w *wireWriter) {
+	w.u32(d.CumAck)
+	w.u32(d.Offset)
+	w.bytes(d.Bitmap)
+}
+
+func (d *SackData) decode(r *wireReader) error {
+	d.CumAck = r.u32()
+	d.Offset = r.u32()
+	d.Bitmap = r.bytes()
+	return r.err
+}
+
+func (d *PingData) encode(w *wireWriter) {}
+
+func (d *PingData) decode(r *wireReader) error {
+	return nil
+}
+
+func (d *ErrorPacketData) encode(w *wireWriter) {
+	w.str(d.Error)
+	w.u32(uint32(d.Code))
+}
+
+func (d *ErrorPacketData) decode(r *wireReader) error {
+	d.Error = r.str()
+	d.Code = ErrorCode(r.u32())
+	return r.err
+}
+
+func (d *FeedbackData) encode(w *wireWriter) {
+	w.u32(d.HighestSeq)
+	w.u32(d.Received)
+	w.u32(d.Window)
+}
+
+func (d *FeedbackData) decode(r *wireReader) error {
+	d.HighestSeq = r.u32()
+	d.Received = r.u32()
+	d.Window = r.u32()
+	return r.err
+}
+
+func (d *StartTransferData) encode(w *wireWriter) {
+	w.bool(d.Resume)
+}
+
+func (d *StartTransferData) decode(r *wireReader) error {
+	d.Resume = r.bool()
+	return r.err
+}
+
+func (d *FinishPacketData) encode(w *wireWriter) {
+	w.bool(d.Success)
+	w.str(d.Message)
+}
+
+func (d *FinishPacketData) decode(r *wireReader) error {
+	d.Success = r.bool()
+	d.Message = r.str()
+	return r.err
+}
+
+func (d *ProbeData) encode(w *wireWriter) {
+	w.bytes(d.Padding)
+}
+
+func (d *ProbeData) decode(r *wireReader) error {
+	r.take(r.count(1)) // 中身は使わない
+	return r.err
+}
+
+func (d *ProbeAckData) encode(w *wireWriter) {
+	w.u32(d.Size)
+}
+
+func (d *ProbeAckData) decode(r *wireReader) error {
+	d.Size = r.u32()
+	return r.err
+}
+
+func (d *PathMTUData) encode(w *wireWriter) {
+	w.u32(d.Size)
+}
+
+func (d *PathMTUData) decode(r *wireReader) error {
+	d.Size = r.u32()
+	return r.err
+}
+
+func (d *PutOfferData) encode(w *wireWriter) {
+	w.str(d.FileName)
+	w.i64(d.Size)
+}
+
+func (d *PutOfferData) decode(r *wireReader) error {
+	d.FileName = r.str()
+	d.Size = r.i64()
+	return r.err
+}
+
+func (d *ManifestRequestData) encode(w *wireWriter) {
+	w.str(d.Path)
+	w.u32(d.Offset)
+}
+
+func (d *ManifestRequestData) decode(r *wireReader) error {
+	d.Path = r.str()
+	d.Offset = r.u32()
+	return r.err
+}
+
+func (d *ManifestData) encode(w *wireWriter) {
+	w.u32(d.Offset)
+	w.u32(d.Total)
+	w.u32(uint32(len(d.Files)))
+	for _, f := range d.Files {
+		w.str(f.Path)
+		w.i64(f.Size)
+	}
+}
+
+func (d *ManifestData) decode(r *wireReader) error {
+	d.Offset = r.u32()
+	d.Total = r.u32()
+	n := r.count(12) // 最小でも文字列長とサイズ
+	d.Files = make([]ManifestEntry, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		d.Files = append(d.Files, ManifestEntry{
+			Path: r.str(),
+			Size: r.i64(),
+		})
+	}
+	return r.err
+}
+
+func (d *SegmentHashRequestData) encode(w *wireWriter) {
+	w.u32(d.Offset)
+}
+
+func (d *SegmentHashRequestData) decode(r *wireReader) error {
+	d.Offset = r.u32()
+	return r.err
+}
+
+func (d *SegmentHashData) encode(w *wireWriter) {
+	w.u32(d.Offset)
+	w.bytes(d.Hashes)
+}
+
+func (d *SegmentHashData) decode(r *wireReader) error {
+	d.Offset = r.u32()
+	d.Hashes = r.bytes()
+	if r.err == nil && len(d.Hashes)%merkleHashSize != 0 {
+		return fmt.Errorf("invalid segment hashes")
+	}
+	return r.err
+}
+
+func (d *ResendData) encode(w *wireWriter) {
+	w.u32(d.Start)
+	w.u32(d.Count)
+}
+
+func (d *ResendData) decode(r *wireReader) error {
+	d.Start = r.u32()
+	d.Count = r.u32()
+	return r.err
+}
+
+func (d *SignatureRequestData) encode(w *wireWriter) {
+	w.u32(d.Offset)
+}
+
+func (d *SignatureRequestData) decode(r *wireReader) error {
+	d.Offset = r.u32()
+	return r.err
+}
+
+func (d *SignatureData) encode(w *wireWriter) {
+	w.u32(d.Offset)
+	w.bytes(d.Blocks)
+}
+
+func (d *SignatureData) decode(r *wireReader) error {
+	d.Offset = r.u32()
+	d.Blocks = r.bytes()
+	return r.err
+}
+
+func (d *RateUpdateData) encode(w *wireWriter) {
+	w.i64(d.Rate)
+}
+
+func (d *RateUpdateData) decode(r *wireReader) error {
+	d.Rate = r.i64()
+	return r.err
+}
+
+func (d *PreparingData) encode(w *wireWriter) {}
+
+func (d *PreparingData) decode(r *wireReader) error {
+	return nil
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"QuickPort/tray"
+	"bytes"
+	"testing"
+)
+
+func TestFileIndexDecodeRejectsInconsistent(t *testing.T) {
+	valid := func() *FileIndexData {
+		return &FileIndexData{
+			FilePath:      "a.bin",
+			TotalSize:     int64(ChunkSize)*3 + 1,
+			ChunkCount:    4,
+			FileHash:      "00",
+			HashAlgo:      tray.HashSHA256,
+			ChunkSize:     ChunkSize,
+			SegmentChunks: merkleSegmentChunks,
+			MerkleRoot:    bytes.Repeat([]byte{1}, merkleHashSize),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(d *FileIndexData)
+		ok     bool
+	}{
+		{"valid", func(d *FileIndexData) {}, true},
+		{"empty file", func(d *FileIndexData) { d.TotalSize, d.ChunkCount = 0, 0 }, true},
+		{"exact chunks", func(d *FileIndexData) { d.TotalSize, d.ChunkCount = int64(ChunkSize)*3, 3 }, true},
+		// 差分ではチャンクは差分の大きさで数え、組み立て後の大きさは関係ない
+		{"delta", func(d *FileIndexData) { d.Delta, d.TargetSize = true, 1<<40 }, true},
+		{"too many chunks", func(d *FileIndexData) { d.ChunkCount = 1<<32 - 1 }, false},
+		{"too few chunks", func(d *FileIndexData) { d.ChunkCount = 3 }, false},
+		{"chunks for target size", func(d *FileIndexData) { d.Delta, d.TargetSize, d.TotalSize = true, d.TotalSize, 1 }, false},
+		{"segment too small", func(d *FileIndexData) { d.SegmentChunks = 1 }, false},
+		{"segment too large", func(d *FileIndexData) { d.SegmentChunks = 1<<32 - 1 }, false},
+		{"no merkle root", func(d *FileIndexData) { d.MerkleRoot = nil }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index := valid()
+			tt.modify(index)
+
+			raw, err := encodeFrame(&BaseData{Type: FileIndex, Transfer: 1, Data: index}, ProtocolVersion)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			_, err = decodeFrame(raw)
+			if (err == nil) != tt.ok {
+				t.Errorf("decode error = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
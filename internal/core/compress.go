@@ -3,6 +3,7 @@ package core
 import (
 	"bytes"
 	"compress/gzip"
+	"fmt"
 	"io"
 
 	"github.com/golang/snappy"
@@ -87,3 +88,102 @@ func Decompress(data []byte, mode string) ([]byte, error) {
 		return data, nil
 	}
 }
+
+// blockCodec はチャンク単位で独立に圧縮・展開する
+// (任意のチャンクをインデックスだけで再送・復元できるようにするため)
+type blockCodec struct {
+	mode string
+	zenc *zstd.Encoder
+	zdec *zstd.Decoder
+}
+
+func newBlockCodec(mode string) (*blockCodec, error) {
+	codec := &blockCodec{mode: mode}
+
+	if mode == "high" {
+		var err error
+		codec.zenc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		codec.zdec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			codec.zenc.Close()
+			return nil, err
+		}
+	}
+
+	return codec, nil
+}
+
+func (c *blockCodec) Close() {
+	if c.zenc != nil {
+		c.zenc.Close()
+	}
+	if c.zdec != nil {
+		c.zdec.Close()
+	}
+}
+
+// Compress はブロックを圧縮する。圧縮しても小さくならない場合は ok=false を返す
+func (c *blockCodec) Compress(raw []byte) ([]byte, bool, error) {
+	var compressed []byte
+
+	switch c.mode {
+	case "high":
+		compressed = c.zenc.EncodeAll(raw, nil)
+	case "medium", "low":
+		var err error
+		compressed, err = Compress(raw, c.mode)
+		if err != nil {
+			return nil, false, err
+		}
+	default:
+		return raw, false, nil
+	}
+
+	if len(compressed) >= len(raw) {
+		return raw, false, nil
+	}
+
+	return compressed, true, nil
+}
+
+// Decompress はブロックを展開する。展開後のサイズが maxSize を超える場合はエラー
+func (c *blockCodec) Decompress(data []byte, maxSize int) ([]byte, error) {
+	var (
+		raw []byte
+		err error
+	)
+
+	switch c.mode {
+	case "high":
+		raw, err = c.zdec.DecodeAll(data, nil)
+	case "medium":
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		raw, err = io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	case "low":
+		var n int
+		n, err = snappy.DecodedLen(data)
+		if err == nil && n > maxSize {
+			return nil, fmt.Errorf("decompressed block too large: %d bytes", n)
+		}
+		raw, err = snappy.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("unknown compression mode: %s", c.mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) > maxSize {
+		return nil, fmt.Errorf("decompressed block too large: %d bytes", len(raw))
+	}
+
+	return raw, nil
+}
@@ -1,11 +1,20 @@
 package core
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 type PeerConfig struct {
-	Name    string
-	Addr    *Address
-	SubAddr *Address
+	Name     string
+	Addr     *Address
+	SubAddr  *Address
+	Version  int        // 合意したプロトコルバージョン
+	Caps     Capability // 合意した機能
+	Datagram int        // 経路 MTU 探索で決めたデータグラムサイズ (0 は未探索)
+
+	Secret  []byte         // トークンに含まれる共有の秘密 (接続の認証に使う)
+	session *sessionCrypto // 認証後のパケットの暗号化
 }
 
 type SelfConfig struct {
@@ -14,4 +23,6 @@ type SelfConfig struct {
 	SubConn *net.UDPConn
 	Addr    *Address
 	SubAddr *Address
+	Secret  []byte    // トークンで配った共有の秘密 (host 側)
+	Expiry  time.Time // トークンの有効期限 (過ぎたら接続を受け付けない)
 }
@@ -0,0 +1,271 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	initialSendRate = 512 << 10 // bytes/s
+	minSendRate     = 64 << 10
+	maxSendRate     = 1 << 30
+
+	lossThreshold      = 0.02 // これを超える損失率で減速する
+	lossSamplePackets  = 256
+	decreaseFactor     = 0.7
+	slowStartGain      = 1.25
+	increaseRatio      = 0.02
+	minIncreaseStep    = 32 << 10
+	initialRTT         = 100 * time.Millisecond
+	pacingGranularity  = time.Millisecond
+	maxPacingBurst     = 5 * time.Millisecond
+	windowStallTimeout = 500 * time.Millisecond
+
+	sentRingSize = 4096
+
+	feedbackInterval = 50 * time.Millisecond
+	feedbackPackets  = 32
+
+	receiveBufferSize = 4 << 20
+)
+
+// receiveWindowFor は受信バッファに収まるチャンク数
+func receiveWindowFor(chunkSize int) uint32 {
+	return uint32(receiveBufferSize / (chunkSize + chunkHeaderSize))
+}
+
+// congestionController は受信側のフィードバックから損失率と RTT を測り、
+// AIMD で送信レートを調整してチャンク送信をペーシングする
+type congestionController struct {
+	mu sync.Mutex
+
+	rate      float64 // bytes/s
+	ceiling   float64 // 帯域制限がある場合の上限 (0 は無制限)
+	tolerance float64 // 減速せずに許容する損失率
+	slowStart bool
+	srtt      time.Duration
+	window    uint32 // 受信側が広告したウィンドウ (パケット数)
+
+	nextSeq  uint32
+	sentAt   [sentRingSize]time.Time
+	ackedSeq uint32 // 受信側が確認した最大シーケンス + 1
+
+	lastExpected uint32
+	lastReceived uint32
+	lastDecrease time.Time
+	nextSend     time.Time
+}
+
+func newCongestionController(chunkSize int) *congestionController {
+	return &congestionController{
+		rate:      initialSendRate,
+		slowStart: true,
+		srtt:      initialRTT,
+		window:    receiveWindowFor(chunkSize),
+		tolerance: lossThreshold,
+	}
+}
+
+// SetFecRatio は FEC で復元できる損失の分だけ許容する損失率を上げる
+// パリティ分を全て許容すると輻輳に気付けないので半分にとどめる
+func (c *congestionController) SetFecRatio(ratio float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tolerance = lossThreshold + ratio/2
+}
+
+// Pace は n バイトを送ってよいタイミングまで待ち、そのパケットのシーケンス番号を返す
+func (c *congestionController) Pace(n int) uint32 {
+	c.waitWindow()
+
+	c.mu.Lock()
+	now := time.Now()
+	// 長く送っていなかった分をまとめて吐き出さないようにする
+	if c.nextSend.Before(now.Add(-maxPacingBurst)) {
+		c.nextSend = now.Add(-maxPacingBurst)
+	}
+	wait := c.nextSend.Sub(now)
+	c.nextSend = c.nextSend.Add(time.Duration(float64(n) / c.rate * float64(time.Second)))
+
+	seq := c.nextSeq
+	c.nextSeq++
+	c.mu.Unlock()
+
+	if wait > pacingGranularity {
+		time.Sleep(wait)
+	}
+
+	c.mu.Lock()
+	c.sentAt[seq%sentRingSize] = time.Now()
+	c.mu.Unlock()
+
+	return seq
+}
+
+// waitWindow は未確認のパケット数が受信ウィンドウを超えている間待つ
+func (c *congestionController) waitWindow() {
+	start := time.Now()
+	for {
+		c.mu.Lock()
+		inflight := c.nextSeq - c.ackedSeq
+		if inflight < c.window {
+			c.mu.Unlock()
+			return
+		}
+
+		// フィードバックが途絶えたら損失とみなして減速し、送信を再開する
+		if time.Since(start) > windowStallTimeout {
+			c.decrease(time.Now())
+			c.ackedSeq = c.nextSeq
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+
+		time.Sleep(pacingGranularity)
+	}
+}
+
+// OnFeedback は受信側からのフィードバックでレートとウィンドウを更新する
+func (c *congestionController) OnFeedback(fb *FeedbackData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	expected := fb.HighestSeq + 1
+	if expected > c.nextSeq || expected < c.lastExpected {
+		// 古い、または不正なフィードバック
+		return
+	}
+
+	// RTT 計測
+	if c.nextSeq-fb.HighestSeq <= sentRingSize {
+		sample := now.Sub(c.sentAt[fb.HighestSeq%sentRingSize])
+		if sample > 0 {
+			c.srtt = (c.srtt*7 + sample) / 8
+		}
+	}
+
+	if expected > c.ackedSeq {
+		c.ackedSeq = expected
+	}
+	if fb.Window > 0 {
+		c.window = fb.Window
+	}
+
+	// 損失率はある程度のパケット数をまとめて判断する (少数だと1つの損失で閾値を超えてしまう)
+	expectedDelta := expected - c.lastExpected
+	receivedDelta := fb.Received - c.lastReceived
+	if expectedDelta == 0 {
+		return
+	}
+
+	loss := 1 - float64(receivedDelta)/float64(expectedDelta)
+	if expectedDelta >= lossSamplePackets {
+		c.lastExpected = expected
+		c.lastReceived = fb.Received
+		if loss > c.tolerance {
+			c.decrease(now)
+			return
+		}
+	}
+	if loss > c.tolerance {
+		// サンプルが溜まるまでは様子見
+		return
+	}
+
+	// 損失が無ければ加速 (スロースタート中は乗算、以降は加算)
+	if c.slowStart {
+		c.rate *= slowStartGain
+	} else {
+		step := c.rate * increaseRatio
+		if step < minIncreaseStep {
+			step = minIncreaseStep
+		}
+		c.rate += step
+	}
+	if c.rate > maxSendRate {
+		c.rate = maxSendRate
+	}
+	if c.ceiling > 0 && c.rate > c.ceiling {
+		c.rate = c.ceiling
+	}
+}
+
+// SetCeiling は帯域制限に合わせてレートの上限を設定する
+// 制限で送信が律速している間にレートだけが際限なく上がるのを防ぐ
+func (c *congestionController) SetCeiling(rate int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ceiling = float64(rate)
+}
+
+// decrease は 1 RTT に 1 回だけ送信レートを下げる (mu を保持して呼ぶ)
+func (c *congestionController) decrease(now time.Time) {
+	c.slowStart = false
+	if now.Sub(c.lastDecrease) < c.srtt {
+		return
+	}
+
+	c.rate *= decreaseFactor
+	if c.rate < minSendRate {
+		c.rate = minSendRate
+	}
+	c.lastDecrease = now
+}
+
+// RetransmitTimeout は届いていないチャンクを再送するまでの猶予
+func (c *congestionController) RetransmitTimeout() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rto := 2 * c.srtt
+	if rto < minRetransmitTimeout {
+		rto = minRetransmitTimeout
+	}
+	return rto
+}
+
+// Rate は現在の送信レート (bytes/s)
+func (c *congestionController) Rate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rate
+}
+
+// feedbackTracker は受信したパケットのシーケンス番号を集計してフィードバックを作る
+type feedbackTracker struct {
+	window     uint32
+	highestSeq uint32
+	received   uint32
+	started    bool
+	pending    int
+	lastSent   time.Time
+}
+
+func newFeedbackTracker(chunkSize int) *feedbackTracker {
+	return &feedbackTracker{window: receiveWindowFor(chunkSize)}
+}
+
+// OnPacket はパケットを数え、フィードバックを送るべきなら true を返す
+func (f *feedbackTracker) OnPacket(seq uint32) bool {
+	if !f.started || seq > f.highestSeq {
+		f.highestSeq = seq
+	}
+	f.started = true
+	f.received++
+	f.pending++
+
+	return f.pending >= feedbackPackets || time.Since(f.lastSent) >= feedbackInterval
+}
+
+func (f *feedbackTracker) Feedback() *FeedbackData {
+	f.pending = 0
+	f.lastSent = time.Now()
+
+	return &FeedbackData{
+		HighestSeq: f.highestSeq,
+		Received:   f.received,
+		Window:     f.window,
+	}
+}
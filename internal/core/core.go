@@ -3,48 +3,15 @@ package core
 import (
 	"QuickPort/tray"
 	"QuickPort/utils"
-	"encoding/json"
+	"crypto/hmac"
+	"errors"
 	"fmt"
-	"net"
 	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-func (h *Handle) ResetConn() error {
-	h.Self.Conn.Close()
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%s", strconv.Itoa(h.Self.Addr.Port)))
-	if err != nil {
-		return err
-	}
-	h.Self.Conn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return err
-	}
-
-	h.Self.SubConn.Close()
-	addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf(":%s", strconv.Itoa(h.Self.SubAddr.Port)))
-	if err != nil {
-		return err
-	}
-	h.Self.SubConn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return err
-	}
-
-	if h.Self.Conn != nil {
-		h.Self.Conn.SetReadDeadline(time.Time{})
-	}
-	if h.Self.SubConn != nil {
-		h.Self.SubConn.SetReadDeadline(time.Time{})
-	}
-
-	RecordPingTime()
-
-	return nil
-}
-
 func SetupPort() (*SelfConfig, error) {
 	self := SelfConfig{}
 
@@ -93,48 +60,103 @@ func SetupPort() (*SelfConfig, error) {
 func Sync(self *SelfConfig, peer *PeerConfig) (*PeerConfig, error) {
 	logrus.Infof("Listening on %s:%d", self.Addr.Ip.String(), self.Addr.Port)
 
-	// 認証リクエスト送信
+	// 認証リクエスト送信 (セッションの鍵交換の公開鍵を載せる)
 	addr := fmt.Sprintf("%s:%d", peer.Addr.Ip.String(), peer.Addr.Port)
 	logrus.Debug("Sending auth request to:", addr)
 
-	err := Write(self.Conn, addr, &BaseData{
+	key, err := newSessionKey()
+	if err != nil {
+		return nil, err
+	}
+	request := newAuthData(self, tray.AccessReq)
+	request.PublicKey = key.Public()
+
+	err = Write(self.Conn, addr, &BaseData{
 		Type: Auth,
-		Data: tray.AuthMeta{Name: self.Name, SubPort: self.SubAddr.Port, Flag: tray.AccessReq},
+		Data: request,
 	})
 	if err != nil {
 		logrus.Error("Failed to send auth request:", err)
 		return nil, err
 	}
 
-	// 認証レスポンス受信
+	// 認証レスポンス受信 (先にチャレンジが届くので、トークンの秘密で証明して要求し直す)
 	logrus.Debug("Waiting for auth response...")
-	meta, err := receiveFromPeer(self, peer, false)
-	if err != nil {
-		logrus.Error("Failed to receive auth response:", err)
-		return nil, err
-	}
+	var authmeta *AuthData
+	for {
+		meta, err := receiveFromPeer(self, peer, false)
+		if err != nil {
+			logrus.Error("Failed to receive auth response:", err)
+			return nil, err
+		}
 
-	if meta.Type != Auth {
-		logrus.Error("Invalid response type")
-		return nil, fmt.Errorf("invalid response type: %d", meta.Type)
-	}
+		if meta.Type != Auth {
+			logrus.Error("Invalid response type")
+			return nil, fmt.Errorf("invalid response type: %d", meta.Type)
+		}
 
-	authmeta, err := ConvertMapToAuthMeta(meta.Data)
-	if err != nil {
-		logrus.Error("Failed to parse auth meta:", err)
-		return nil, err
+		authmeta = meta.Data.(*AuthData)
+		if authmeta.Flag != tray.Challenge {
+			break
+		}
+		if request.Nonce != nil {
+			continue
+		}
+
+		request.Nonce = authmeta.Nonce
+		request.Proof = authProof(peer.Secret, authProofClientTag, authmeta.Nonce, key.Public(), authmeta.PublicKey)
+		err = Write(self.Conn, addr, &BaseData{Type: Auth, Data: request})
+		if err != nil {
+			logrus.Error("Failed to send auth response:", err)
+			return nil, err
+		}
 	}
 
 	switch authmeta.Flag {
 	case tray.AccessReq:
 		return nil, fmt.Errorf("invalid packet - received request instead of response")
 	case tray.Allow:
+		// 暗号化とトークンの証明はバージョンに関わらず必須 (これより前のビルドとは接続できない)
+		if authmeta.PublicKey == nil {
+			return nil, fmt.Errorf("peer does not support encrypted sessions (protocol v%d)", authmeta.Version)
+		}
+
+		// 相手もトークンの秘密を知っているか (トークンを発行した本人か) 確かめる
+		expected := authProof(peer.Secret, authProofHostTag, request.Nonce, key.Public(), authmeta.PublicKey)
+		if request.Nonce == nil || !hmac.Equal(authmeta.Nonce, request.Nonce) || !hmac.Equal(authmeta.Proof, expected) {
+			return nil, fmt.Errorf("peer could not prove it issued the token")
+		}
+
+		// ホストが決めた組み合わせがこちらでも使えるか確認する
+		version, caps, err := negotiate(authmeta)
+		if err != nil {
+			return nil, err
+		}
+		if version != authmeta.Version || caps != Capability(authmeta.Caps) {
+			return nil, fmt.Errorf("peer agreed on unsupported protocol v%d (%s)", authmeta.Version, Capability(authmeta.Caps))
+		}
+
+		// 以降のパケットは全て暗号化する
+		session, err := key.Session(authmeta.PublicKey, false)
+		if err != nil {
+			return nil, err
+		}
+		peer.session = session
+
 		logrus.Info("Connection accepted!")
+		logrus.Infof("Protocol v%d, capabilities: %s", version, caps)
+		logSessionFingerprint(session)
 		peer.SubAddr = &Address{
 			Ip:   peer.Addr.Ip,
 			Port: authmeta.SubPort,
 		}
+		peer.Version = version
+		peer.Caps = caps
+		useSinglePort(self, peer)
 	case tray.Deny:
+		if authmeta.Reason != "" {
+			return nil, fmt.Errorf("connection refused by peer: %s", authmeta.Reason)
+		}
 		logrus.Info("Connection denied by peer")
 		return nil, nil
 	}
@@ -146,7 +168,8 @@ func Sync(self *SelfConfig, peer *PeerConfig) (*PeerConfig, error) {
 func SyncListener(self *SelfConfig) (*PeerConfig, error) {
 	logrus.Infof("Listening on %s:%d", self.Addr.Ip.String(), self.Addr.Port)
 
-	buf := make([]byte, 1024)
+	buf := make([]byte, maxFrameSize)
+	challenges := newAuthChallenges()
 waitPeer:
 	for {
 		n, peerAddr, err := self.Conn.ReadFromUDP(buf)
@@ -155,10 +178,14 @@ waitPeer:
 			continue
 		}
 
-		var meta BaseData
-		err = json.Unmarshal(buf[:n], &meta)
+		meta, err := decodeFrame(buf[:n])
 		if err != nil {
-			logrus.Error("JSON unmarshal error:", err)
+			var verr *versionError
+			if errors.As(err, &verr) {
+				logrus.Warnf("Ignoring connection from %s: %v", peerAddr.String(), err)
+			} else {
+				logrus.Debug("Ignoring invalid packet:", err)
+			}
 			continue
 		}
 
@@ -167,14 +194,64 @@ waitPeer:
 			continue
 		}
 
-		authmeta, err := ConvertMapToAuthMeta(meta.Data)
+		authmeta := meta.Data.(*AuthData)
+
+		if authmeta.Flag != tray.AccessReq {
+			logrus.Debug("Ignoring non-request auth packet")
+			continue
+		}
+
+		// 期限切れのトークンでの接続は受け付けない
+		if !self.Expiry.IsZero() && time.Now().After(self.Expiry) {
+			logrus.Debugf("Ignoring auth request from %s: token has expired", peerAddr.String())
+			continue
+		}
+
+		// 証明の無い要求にはチャレンジを返し、トークンの秘密で証明し直してもらう
+		if authmeta.Proof == nil {
+			pending, err := challenges.Issue(peerAddr)
+			if err != nil {
+				return nil, err
+			}
+			if pending == nil {
+				logrus.Debugf("Ignoring auth request from %s: too many pending challenges", peerAddr.String())
+				continue
+			}
+
+			challenge := newAuthData(self, tray.Challenge)
+			challenge.PublicKey = pending.key.Public()
+			challenge.Nonce = pending.nonce
+			err = Write(self.Conn, peerAddr.String(), &BaseData{Type: Auth, Data: challenge})
+			if err != nil {
+				logrus.Debug("Failed to send auth challenge:", err)
+			}
+			continue
+		}
+
+		// 秘密を知らない相手の要求はユーザーに聞かずに黙って捨てる
+		pending, ok := challenges.Verify(peerAddr, self.Secret, authmeta)
+		if !ok {
+			logrus.Debugf("Ignoring auth request with an invalid token proof from %s", peerAddr.String())
+			continue
+		}
+
+		// 共通のバージョンと機能が無ければユーザーに聞かずに理由付きで拒否する (理由は認証できた相手にだけ返す)
+		version, caps, err := negotiate(authmeta)
 		if err != nil {
-			logrus.Error("Failed to parse auth meta:", err)
+			logrus.Warnf("Refusing %s (%s): %v", authmeta.Name, peerAddr.String(), err)
+			deny := newAuthData(self, tray.Deny)
+			deny.Reason = err.Error()
+			err = Write(self.Conn, peerAddr.String(), &BaseData{Type: Auth, Data: deny})
+			if err != nil {
+				logrus.Error("Failed to send deny response:", err)
+			}
 			continue
 		}
 
-		if authmeta.Flag != tray.AccessReq {
-			logrus.Debug("Ignoring non-request auth packet")
+		key := pending.key
+		session, err := key.Session(authmeta.PublicKey, true)
+		if err != nil {
+			logrus.Debugf("Ignoring auth request from %s: %v", peerAddr.String(), err)
 			continue
 		}
 
@@ -201,25 +278,37 @@ waitPeer:
 					Ip:   peerAddr.IP,
 					Port: authmeta.SubPort,
 				},
+				Version: version,
+				Caps:    caps,
+				session: session,
 			}
 
 			switch answer {
 			case "y":
-				// 承認レスポンス送信
+				// 承認レスポンス送信 (合意したバージョンと機能を返す)
+				allow := newAuthData(self, tray.Allow)
+				allow.Version = version
+				allow.Caps = uint64(caps)
+				allow.PublicKey = key.Public()
+				allow.Nonce = pending.nonce
+				allow.Proof = authProof(self.Secret, authProofHostTag, pending.nonce, authmeta.PublicKey, key.Public())
 				err = Write(self.Conn, fmt.Sprintf("%s:%d", peerAddr.IP.String(), peerAddr.Port),
-					&BaseData{Type: Auth, Data: tray.AuthMeta{Name: self.Name, SubPort: self.SubAddr.Port, Flag: tray.Allow}})
+					&BaseData{Type: Auth, Data: allow})
 				if err != nil {
 					logrus.Error("Failed to send allow response:", err)
 					return nil, err
 				}
 
 				logrus.Info("Connection accepted!")
+				logrus.Infof("Protocol v%d, capabilities: %s", version, caps)
+				logSessionFingerprint(session)
+				useSinglePort(self, peer)
 				return peer, nil
 
 			case "n":
 				// 拒否レスポンス送信
 				err = Write(self.Conn, fmt.Sprintf("%s:%d", peerAddr.IP.String(), peerAddr.Port),
-					&BaseData{Type: Auth, Data: tray.AuthMeta{Name: self.Name, SubPort: self.SubAddr.Port, Flag: tray.Deny}})
+					&BaseData{Type: Auth, Data: newAuthData(self, tray.Deny)})
 				if err != nil {
 					logrus.Error("Failed to send deny response:", err)
 				}
@@ -234,15 +323,33 @@ waitPeer:
 	}
 }
 
+// logSessionFingerprint はセッションの指紋を表示する (両者で同じなら鍵交換に中間者は居ない)
+func logSessionFingerprint(session *sessionCrypto) {
+	logrus.Infof("Session encrypted, fingerprint: %s (should match the peer's)", session.fingerprint)
+}
+
+// newAuthData は自分の対応バージョンと機能を載せた認証パケットを作る
+func newAuthData(self *SelfConfig, flag tray.AuthFlag) *AuthData {
+	return &AuthData{
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Caps:       uint64(LocalCapabilities()),
+		Name:       self.Name,
+		SubPort:    self.SubAddr.Port,
+		Flag:       flag,
+	}
+}
+
 func TraySync(self *SelfConfig, peer *PeerConfig, defaultTray string) error {
-	items, err := tray.GetTrayItems(defaultTray)
+	items, err := tray.GetTrayItems(defaultTray, peer.HashAlgorithm())
 	if err != nil {
 		return err
 	}
 
-	err = Write(self.Conn, fmt.Sprintf("%s:%d", peer.Addr.Ip.String(), peer.Addr.Port), &BaseData{
+	data := TrayData(items)
+	err = sendFrame(self, peer, false, &BaseData{
 		Type: SyncTray,
-		Data: items,
+		Data: &data,
 	})
 
 	if err != nil {
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+
+	"github.com/gtank/ristretto255"
+)
+
+// CPace (draft-irtf-cfrg-cpace) を ristretto255 と SHA-512 で使う
+// 短いコード (PRS) から生成元を作り、それぞれの一時的な秘密で共有の鍵 (ISK) を導く
+// 盗聴してもコードの総当たりはできず、なりすましは1回の接続につき1回しか試せない
+const (
+	cpaceDSI         = "CPaceRistretto255"
+	cpaceHashBlock   = 128 // SHA-512 のブロック長
+	cpaceElementSize = 32
+)
+
+var errCPaceInvalid = errors.New("invalid cpace share")
+
+// cpace は片側の CPace の状態
+type cpace struct {
+	sid    []byte
+	ci     []byte
+	secret *ristretto255.Scalar
+	share  []byte
+}
+
+// newCPace はコード prs と接続の識別子 ci, セッション ID sid から自分の公開値を作る
+func newCPace(prs, ci, sid []byte) (*cpace, error) {
+	random := make([]byte, 64)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cpace{sid: sid, ci: ci, secret: ristretto255.NewScalar().FromUniformBytes(random)}
+	share := ristretto255.NewElement().ScalarMult(c.secret, cpaceGenerator(prs, ci, sid))
+	c.share = share.Encode(nil)
+	return c, nil
+}
+
+// Share は相手に送る公開値
+func (c *cpace) Share() []byte {
+	return c.share
+}
+
+// Finish は相手の公開値から ISK を導く。initiator は先に公開値を送った側 (host) の公開値
+func (c *cpace) Finish(peerShare []byte, initiator, responder []byte) ([]byte, error) {
+	if len(peerShare) != cpaceElementSize {
+		return nil, errCPaceInvalid
+	}
+
+	peer := ristretto255.NewElement()
+	err := peer.Decode(peerShare)
+	if err != nil {
+		return nil, errCPaceInvalid
+	}
+
+	k := ristretto255.NewElement().ScalarMult(c.secret, peer)
+	if k.Equal(ristretto255.NewElement().Zero()) == 1 {
+		return nil, errCPaceInvalid
+	}
+
+	h := sha512.New()
+	h.Write(lvCat([]byte(cpaceDSI+"_ISK"), c.sid, k.Encode(nil)))
+	h.Write(lvCat(initiator, nil))
+	h.Write(lvCat(responder, nil))
+	return h.Sum(nil), nil
+}
+
+// cpaceGenerator はコードから生成元を作る (コードを知らないと離散対数が分からない)
+func cpaceGenerator(prs, ci, sid []byte) *ristretto255.Element {
+	// DSI と PRS が SHA-512 の最初のブロックに収まるようにゼロで埋める
+	zpad := cpaceHashBlock - 1 - len(prependLen(prs)) - len(prependLen([]byte(cpaceDSI)))
+	if zpad < 0 {
+		zpad = 0
+	}
+
+	sum := sha512.Sum512(lvCat([]byte(cpaceDSI), prs, make([]byte, zpad), ci, sid))
+	return ristretto255.NewElement().FromUniformBytes(sum[:])
+}
+
+// prependLen は LEB128 の長さを前に付ける
+func prependLen(data []byte) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(data))), data...)
+}
+
+func lvCat(parts ...[]byte) []byte {
+	out := []byte{}
+	for _, p := range parts {
+		out = append(out, prependLen(p)...)
+	}
+
+	return out
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCPace(t *testing.T) {
+	sid := bytes.Repeat([]byte{1}, pairingSIDSize)
+	otherSID := bytes.Repeat([]byte{2}, pairingSIDSize)
+
+	tests := []struct {
+		name       string
+		hostCode   string
+		clientCode string
+		hostCI     []byte
+		clientCI   []byte
+		hostSID    []byte
+		clientSID  []byte
+		agree      bool
+	}{
+		{"same code", "7-guitar-orbit-lotus", "7-guitar-orbit-lotus", pairingCI(7), pairingCI(7), sid, sid, true},
+		{"different word", "7-guitar-orbit-lotus", "7-guitar-orbit-lemon", pairingCI(7), pairingCI(7), sid, sid, false},
+		{"swapped words", "7-guitar-orbit-lotus", "7-orbit-guitar-lotus", pairingCI(7), pairingCI(7), sid, sid, false},
+		{"different nameplate", "7-guitar-orbit-lotus", "7-guitar-orbit-lotus", pairingCI(7), pairingCI(8), sid, sid, false},
+		{"different session", "7-guitar-orbit-lotus", "7-guitar-orbit-lotus", pairingCI(7), pairingCI(7), sid, otherSID, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, err := newCPace([]byte(tt.hostCode), tt.hostCI, tt.hostSID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := newCPace([]byte(tt.clientCode), tt.clientCI, tt.clientSID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ya, yb := host.Share(), client.Share()
+
+			hostISK, err := host.Finish(yb, ya, yb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientISK, err := client.Finish(ya, ya, yb)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := bytes.Equal(hostISK, clientISK); got != tt.agree {
+				t.Errorf("keys agree = %v, want %v", got, tt.agree)
+			}
+		})
+	}
+}
+
+func TestCPaceInvalidShare(t *testing.T) {
+	c, err := newCPace([]byte("7-guitar-orbit-lotus"), pairingCI(7), make([]byte, pairingSIDSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		share []byte
+	}{
+		{"identity", make([]byte, cpaceElementSize)},
+		{"short", c.Share()[:cpaceElementSize-1]},
+		{"not an element", bytes.Repeat([]byte{0xff}, cpaceElementSize)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.Finish(tt.share, tt.share, c.Share())
+			if !errors.Is(err, errCPaceInvalid) {
+				t.Errorf("Finish() = %v, want %v", err, errCPaceInvalid)
+			}
+		})
+	}
+}
+
+// 待ち合わせサーバーを挟まずに、両端のペアリングを直接つなぐ
+func TestPairing(t *testing.T) {
+	self := testTokenSelf("192.0.2.10")
+	token := GenToken(self)
+
+	tests := []struct {
+		name       string
+		clientCode string
+		err        error
+	}{
+		{"same code", "7-guitar-orbit-lotus", nil},
+		{"upper case and spaces", " 7-Guitar-ORBIT-lotus\n", nil},
+		{"wrong code", "7-guitar-orbit-lemon", errWrongCode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostConn, clientConn := net.Pipe()
+			defer hostConn.Close()
+			defer clientConn.Close()
+
+			hostErr := make(chan error, 1)
+			go func() {
+				err := pairHost(hostConn, bufio.NewReader(hostConn), "7-guitar-orbit-lotus", token)
+				// コードが違えば host は何も返さずに切断する
+				hostConn.Close()
+				hostErr <- err
+			}()
+
+			peer, err := pairClient(clientConn, bufio.NewReader(clientConn), tt.clientCode)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("pairClient() = %v, want %v", err, tt.err)
+			}
+			if !errors.Is(<-hostErr, tt.err) {
+				t.Errorf("pairHost() did not report %v", tt.err)
+			}
+			if err == nil && (!peer.Addr.Ip.Equal(self.Addr.Ip) || !bytes.Equal(peer.Secret, self.Secret)) {
+				t.Errorf("received peer %+v, want the host's token", peer)
+			}
+		})
+	}
+}
+
+func TestPairingCode(t *testing.T) {
+	code, err := newPairingCode(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nameplate, normalized, err := parsePairingCode(code)
+	if err != nil || nameplate != 42 || normalized != code {
+		t.Fatalf("parsePairingCode(%q) = %d, %q, %v", code, nameplate, normalized, err)
+	}
+
+	for _, bad := range []string{"", "42", "42-guitar-orbit", "0-guitar-orbit-lotus", "x-guitar-orbit-lotus", "42-guitar-orbit-notaword"} {
+		if _, _, err := parsePairingCode(bad); !errors.Is(err, errInvalidCode) {
+			t.Errorf("parsePairingCode(%q) = %v, want %v", bad, err, errInvalidCode)
+		}
+	}
+}
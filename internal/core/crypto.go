@@ -0,0 +1,202 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// 認証後のパケットの暗号化
+// Auth で X25519 の一時的な公開鍵を交換し、HKDF で向きごとの AES-256-GCM の鍵を導く
+// パケットは [Counter:8][暗号文][Tag:16] で、ノンスはカウンター、チャンネルバイトは追加データとして認証する
+// 双方がトークンの秘密で両方の公開鍵とノンスに HMAC (authProof) を付けるので、秘密を知らない中間者は鍵を差し替えられない
+// セッションの指紋は、トークン自体が漏れていないかを画面で見比べるためのもの
+const (
+	sessionCounterSize = 8
+	sessionOverhead    = sessionCounterSize + 16 // カウンター + GCM のタグ
+	sessionKeySize     = 32
+	replayWindowSize   = 4096 // 受け付ける並び替えの幅 (パケット数)
+	sessionKeyInfo     = "QuickPort session keys"
+	sessionFingerInfo  = "QuickPort session fingerprint"
+)
+
+// sessionKey は Auth で公開鍵を交換するための一時的な X25519 の鍵
+type sessionKey struct {
+	private *ecdh.PrivateKey
+}
+
+func newSessionKey() (*sessionKey, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session key: %v", err)
+	}
+
+	return &sessionKey{private: private}, nil
+}
+
+func (k *sessionKey) Public() []byte {
+	return k.private.PublicKey().Bytes()
+}
+
+// Session は相手の公開鍵と共有した秘密から暗号化の状態を作る
+// 鍵は接続した側 (client) と待ち受けた側 (host) の公開鍵の順で導くので、両者で host の指定だけが逆になる
+func (k *sessionKey) Session(peerPublic []byte, host bool) (*sessionCrypto, error) {
+	public, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer session key: %v", err)
+	}
+
+	shared, err := k.private.ECDH(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to agree on session key: %v", err)
+	}
+
+	clientPublic, hostPublic := k.Public(), peerPublic
+	if host {
+		clientPublic, hostPublic = peerPublic, k.Public()
+	}
+	salt := append(append([]byte(nil), clientPublic...), hostPublic...)
+
+	keys, err := hkdf.Key(sha256.New, shared, salt, sessionKeyInfo, 2*sessionKeySize)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := hkdf.Key(sha256.New, shared, salt, sessionFingerInfo, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	// 前半が client から host、後半が host から client への鍵
+	sendKey, receiveKey := keys[:sessionKeySize], keys[sessionKeySize:]
+	if host {
+		sendKey, receiveKey = receiveKey, sendKey
+	}
+
+	s := &sessionCrypto{fingerprint: hex.EncodeToString(fingerprint[:2]) + "-" + hex.EncodeToString(fingerprint[2:])}
+	s.send, err = newGCM(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	s.receive, err = newGCM(receiveKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sessionCrypto は1つのセッションの暗号化の状態 (送信と受信で鍵が別)
+type sessionCrypto struct {
+	send        cipher.AEAD
+	receive     cipher.AEAD
+	counter     atomic.Uint64 // 送信したパケット数 (ノンスに使うので同じ値は二度と使わない)
+	replay      replayWindow
+	fingerprint string // 両者で同じになる短い指紋 (中間者が居ないかを見比べる)
+}
+
+// Seal は plain を暗号化して dst に続けて書く
+func (s *sessionCrypto) Seal(dst []byte, channel byte, plain []byte) []byte {
+	counter := s.counter.Add(1)
+	dst = binary.LittleEndian.AppendUint64(dst, counter)
+
+	var nonce [12]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return s.send.Seal(dst, nonce[:], plain, []byte{channel})
+}
+
+// Open はパケットを検証して復号する (raw をその場で書き換える)。改ざんと再送攻撃のパケットは false
+func (s *sessionCrypto) Open(channel byte, raw []byte) ([]byte, bool) {
+	if len(raw) < sessionOverhead {
+		return nil, false
+	}
+
+	counter := binary.LittleEndian.Uint64(raw)
+	if !s.replay.Check(counter) {
+		return nil, false
+	}
+
+	var nonce [12]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	sealed := raw[sessionCounterSize:]
+	plain, err := s.receive.Open(sealed[:0], nonce[:], sealed, []byte{channel})
+	if err != nil {
+		return nil, false
+	}
+
+	// 認証できたものだけを受信済みにする
+	if !s.replay.Accept(counter) {
+		return nil, false
+	}
+
+	return plain, true
+}
+
+// replayWindow は受信したカウンターを記録し、同じパケットの再送を拒否する
+type replayWindow struct {
+	mu   sync.Mutex
+	top  uint64
+	bits [replayWindowSize / 64]uint64
+}
+
+// Check は counter がまだ受け付けられるか
+func (w *replayWindow) Check(counter uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.check(counter)
+}
+
+func (w *replayWindow) check(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > w.top {
+		return true
+	}
+	if w.top-counter >= replayWindowSize {
+		return false
+	}
+
+	i := counter % replayWindowSize
+	return w.bits[i/64]&(1<<(i%64)) == 0
+}
+
+// Accept は counter を受信済みにする。既に受信済みなら false
+func (w *replayWindow) Accept(counter uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.check(counter) {
+		return false
+	}
+
+	// 窓を進め、外れた分の記録を消す
+	if counter > w.top {
+		for c := w.top + 1; c <= counter && c-w.top <= replayWindowSize; c++ {
+			i := c % replayWindowSize
+			w.bits[i/64] &^= 1 << (i % 64)
+		}
+		w.top = counter
+	}
+
+	i := counter % replayWindowSize
+	w.bits[i/64] |= 1 << (i % 64)
+	return true
+}
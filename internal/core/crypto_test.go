@@ -0,0 +1,149 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newSessionPair は鍵を交換した client と host のセッションを作る
+func newSessionPair(t *testing.T) (client, host *sessionCrypto) {
+	t.Helper()
+
+	clientKey, err := newSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := newSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err = clientKey.Session(hostKey.Public(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err = hostKey.Session(clientKey.Public(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, host
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	client, host := newSessionPair(t)
+	if client.fingerprint != host.fingerprint {
+		t.Errorf("fingerprints differ: %s / %s", client.fingerprint, host.fingerprint)
+	}
+
+	tests := []struct {
+		name     string
+		from, to *sessionCrypto
+		ok       bool
+	}{
+		{"client to host", client, host, true},
+		{"host to client", host, client, true},
+		// 向きごとに鍵が違うので、自分の送ったパケットは自分では開けない
+		{"client to itself", client, client, false},
+		{"host to itself", host, host, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := []byte("QuickPort " + tt.name)
+			raw := tt.from.Seal(nil, channelData, plain)
+			if len(raw) != len(plain)+sessionOverhead {
+				t.Errorf("sealed %d bytes, want %d", len(raw), len(plain)+sessionOverhead)
+			}
+
+			got, ok := tt.to.Open(channelData, raw)
+			if ok != tt.ok {
+				t.Fatalf("Open() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && !bytes.Equal(got, plain) {
+				t.Errorf("Open() = %q, want %q", got, plain)
+			}
+		})
+	}
+}
+
+func TestSessionTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(raw []byte) []byte
+		open   byte
+	}{
+		{"counter", func(raw []byte) []byte { raw[0] ^= 1; return raw }, channelData},
+		{"ciphertext", func(raw []byte) []byte { raw[sessionCounterSize] ^= 0x80; return raw }, channelData},
+		{"tag", func(raw []byte) []byte { raw[len(raw)-1] ^= 1; return raw }, channelData},
+		{"truncated", func(raw []byte) []byte { return raw[:len(raw)-1] }, channelData},
+		{"shorter than overhead", func(raw []byte) []byte { return raw[:sessionOverhead-1] }, channelData},
+		// チャンネルは追加データとして認証している
+		{"other channel", func(raw []byte) []byte { return raw }, channelControl},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, host := newSessionPair(t)
+			raw := tt.tamper(client.Seal(nil, channelData, []byte("payload")))
+			if _, ok := host.Open(tt.open, raw); ok {
+				t.Fatal("Open() accepted a tampered packet")
+			}
+
+			// 改ざんされたパケットで窓が進んではいけない
+			if _, ok := host.Open(channelData, client.Seal(nil, channelData, []byte("next"))); !ok {
+				t.Error("Open() rejected the next valid packet")
+			}
+		})
+	}
+}
+
+func TestSessionReplay(t *testing.T) {
+	const count = replayWindowSize + 10
+
+	// 送った順 (カウンターは 1 から) と開く順
+	tests := []struct {
+		name  string
+		order []int
+		ok    []bool
+	}{
+		{"in order", []int{1, 2, 3}, []bool{true, true, true}},
+		{"replayed", []int{1, 2, 2, 1}, []bool{true, true, false, false}},
+		{"reordered", []int{3, 1, 2}, []bool{true, true, true}},
+		{"reordered then replayed", []int{3, 1, 3, 2, 1}, []bool{true, true, false, true, false}},
+		// 窓の端の1つ内側は受け付け、外側は拒否する
+		{"inside the window", []int{replayWindowSize, 1}, []bool{true, true}},
+		{"outside the window", []int{replayWindowSize + 1, 1}, []bool{true, false}},
+		{"far ahead", []int{count, 11, 10}, []bool{true, true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, host := newSessionPair(t)
+
+			sealed := make([][]byte, count+1)
+			for i := 1; i <= count; i++ {
+				sealed[i] = client.Seal(nil, channelData, []byte{byte(i), byte(i >> 8)})
+			}
+
+			for i, n := range tt.order {
+				// Open は raw をその場で書き換えるので写しを渡す
+				raw := append([]byte(nil), sealed[n]...)
+				plain, ok := host.Open(channelData, raw)
+				if ok != tt.ok[i] {
+					t.Fatalf("packet %d (step %d): Open() ok = %v, want %v", n, i, ok, tt.ok[i])
+				}
+				if ok && !bytes.Equal(plain, []byte{byte(n), byte(n >> 8)}) {
+					t.Errorf("packet %d: Open() = %x", n, plain)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayWindowRejectsZero(t *testing.T) {
+	var w replayWindow
+	if w.Check(0) || w.Accept(0) {
+		t.Error("counter 0 accepted")
+	}
+}
@@ -0,0 +1,530 @@
+package core
+
+import (
+	"QuickPort/tray"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 差分転送 (rsync と同じ方式)
+// 受信側は手元の古いファイルをブロックに分け、弱いローリングチェックサムと強いハッシュの署名を送る
+// 送信側は新しいファイルを1バイトずつずらしながら照合し、一致したブロックの参照と変わった部分のデータだけを差分にする
+// 差分は一時ファイルに書き出し、通常のファイルと同じくチャンクに分けて送る
+const (
+	deltaMinSize        = 64 << 10 // これより小さいファイルは丸ごと送る
+	deltaMinBlockSize   = 2 << 10
+	deltaMaxBlockSize   = 128 << 10
+	deltaStrongSize     = 16 // 強いハッシュ (SHA-256 の先頭) の大きさ
+	deltaSignatureSize  = 4 + deltaStrongSize
+	deltaMaxLiteral     = 64 << 10
+	deltaSignatureBurst = 32      // 1回のリクエストで返す署名のページ数
+	deltaMaxBlocks      = 1 << 23 // 署名の上限 (これを超える古いファイルは丸ごと送る)
+	deltaSuffix         = tray.DeltaSuffix
+	deltaNewSuffix      = tray.DeltaNewSuffix
+)
+
+// 差分の命令
+const (
+	deltaCopy    byte = 1 // [Block:4][Count:4] 古いファイルの Block から Count ブロックをコピー
+	deltaLiteral byte = 2 // [Length:4][Data] データをそのまま書く
+)
+
+// deltaSignatures は受信側の古いファイルのブロックの署名 (1ブロック deltaSignatureSize バイト)
+type deltaSignatures struct {
+	BlockSize int
+	Blocks    uint32
+	Data      []byte
+}
+
+// deltaBlockSize はファイルサイズの平方根程度のブロックサイズを返す (署名の量と差分の細かさの釣り合い)
+func deltaBlockSize(size int64) int {
+	block := int(math.Sqrt(float64(size))) &^ 1023
+	if block < deltaMinBlockSize {
+		return deltaMinBlockSize
+	}
+	if block > deltaMaxBlockSize {
+		return deltaMaxBlockSize
+	}
+
+	return block
+}
+
+// rollingChecksum は rsync の弱いチェックサム
+type rollingChecksum struct {
+	a, b uint32
+	size uint32
+}
+
+func newRollingChecksum(block []byte) rollingChecksum {
+	r := rollingChecksum{size: uint32(len(block))}
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+
+	return r
+}
+
+// Roll はウィンドウを1バイトずらす
+func (r *rollingChecksum) Roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.size*uint32(out)
+}
+
+func (r *rollingChecksum) Sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func strongHash(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:deltaStrongSize]
+}
+
+// computeSignatures は path の古いファイルの署名を計算する。差分転送に向かない場合は nil
+func computeSignatures(path string) (*deltaSignatures, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() < deltaMinSize {
+		return nil, nil
+	}
+
+	// 最後の半端なブロックは照合しない
+	sigs := &deltaSignatures{BlockSize: deltaBlockSize(info.Size())}
+	if info.Size()/int64(sigs.BlockSize) > deltaMaxBlocks {
+		return nil, nil
+	}
+	sigs.Blocks = uint32(info.Size() / int64(sigs.BlockSize))
+	sigs.Data = make([]byte, 0, int(sigs.Blocks)*deltaSignatureSize)
+
+	reader := bufio.NewReaderSize(file, sigs.BlockSize)
+	block := make([]byte, sigs.BlockSize)
+	for i := uint32(0); i < sigs.Blocks; i++ {
+		_, err = io.ReadFull(reader, block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+
+		roll := newRollingChecksum(block)
+		sigs.Data = binary.LittleEndian.AppendUint32(sigs.Data, roll.Sum())
+		sigs.Data = append(sigs.Data, strongHash(block)...)
+	}
+
+	return sigs, nil
+}
+
+// answerSignatureRequest は送信側の署名のリクエストに、Offset 番目のブロックから数ページ分を返す
+func answerSignatureRequest(tr *transfer, sigs *deltaSignatures, req *SignatureRequestData) {
+	perPage := uint32((tr.handle.Peer.ChunkSize() - 16) / deltaSignatureSize)
+	offset := req.Offset
+	for page := 0; page < deltaSignatureBurst && offset < sigs.Blocks; page++ {
+		end := offset + perPage
+		if end > sigs.Blocks {
+			end = sigs.Blocks
+		}
+
+		data := &SignatureData{Offset: offset, Blocks: sigs.Data[offset*deltaSignatureSize : end*deltaSignatureSize]}
+		err := tr.write(&BaseData{Type: Signatures, Data: data})
+		if err != nil {
+			logrus.Debugf("failed to send signatures: %v", err)
+			return
+		}
+		offset = end
+	}
+}
+
+// fetchSignatures は受信側から古いファイルの署名を全て受け取る
+func fetchSignatures(tr *transfer, filereq *fileRequestData) (*deltaSignatures, error) {
+	sigs := &deltaSignatures{
+		BlockSize: int(filereq.DeltaBlockSize),
+		Blocks:    filereq.DeltaBlocks,
+		Data:      make([]byte, int(filereq.DeltaBlocks)*deltaSignatureSize),
+	}
+	if sigs.BlockSize < deltaMinBlockSize || sigs.BlockSize > deltaMaxBlockSize || sigs.Blocks > deltaMaxBlocks {
+		return nil, fmt.Errorf("invalid delta signatures: %d blocks of %d bytes", sigs.Blocks, sigs.BlockSize)
+	}
+
+	// 届いたページを記録し、先頭から揃った所までを次のリクエストの Offset にする
+	received := newChunkBitmap(sigs.Blocks)
+	lastReply := time.Now()
+	for !received.Complete() {
+		offset := received.FirstMissing(0)
+		err := tr.write(&BaseData{Type: SignatureRequest, Data: &SignatureRequestData{Offset: offset}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to request signatures: %v", err)
+		}
+
+		for {
+			meta, err := tr.receiveFrame(manifestRetryInterval)
+			if err != nil {
+				if errors.Is(err, errTransferTimeout) && time.Since(lastReply) < peerTimeout {
+					break
+				}
+				return nil, fmt.Errorf("failed to receive signatures: %v", err)
+			}
+
+			page, ok := meta.Data.(*SignatureData)
+			if !ok || len(page.Blocks)%deltaSignatureSize != 0 {
+				continue
+			}
+			count := uint32(len(page.Blocks) / deltaSignatureSize)
+			if page.Offset >= sigs.Blocks || count > sigs.Blocks-page.Offset {
+				continue
+			}
+			lastReply = time.Now()
+
+			copy(sigs.Data[page.Offset*deltaSignatureSize:], page.Blocks)
+			for i := page.Offset; i < page.Offset+count; i++ {
+				received.Set(i)
+			}
+
+			// このリクエストの分が揃ったら次を求める (途中のページが落ちていればタイムアウト後にそこから求め直す)
+			if received.Complete() || received.FirstMissing(offset) >= offset+deltaSignatureBurst*count {
+				break
+			}
+		}
+	}
+
+	return sigs, nil
+}
+
+// prepareDelta は受信側の署名を受け取り、fullpath との差分を一時ファイルに書き出す
+// 差分が元のファイル (size バイト) より小さくならない場合は "" を返し、丸ごと送る
+func prepareDelta(tr *transfer, fullpath string, size int64, filereq *fileRequestData, algorithm string, fileHash string) (string, int64, error) {
+	// 署名の上限を超える大きさはリクエストを読んだ時点で断る
+	if filereq.DeltaBlocks > deltaMaxBlocks {
+		return "", 0, fmt.Errorf("peer requested delta with too many blocks: %d", filereq.DeltaBlocks)
+	}
+
+	sigs, err := fetchSignatures(tr, filereq)
+	if err != nil {
+		return "", 0, err
+	}
+
+	deltaPath, deltaHash, err := writeDelta(fullpath, sigs, algorithm)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to write delta: %v", err)
+	}
+
+	// ハッシュを計算してから差分を作るまでにファイルが変わっていたら使えない
+	if deltaHash != fileHash {
+		os.Remove(deltaPath)
+		return "", 0, fmt.Errorf("file has changed while preparing delta")
+	}
+
+	info, err := os.Stat(deltaPath)
+	if err != nil {
+		os.Remove(deltaPath)
+		return "", 0, err
+	}
+
+	if info.Size() >= size {
+		logrus.Infof("Delta is not smaller than the file, sending it whole")
+		os.Remove(deltaPath)
+		return "", 0, nil
+	}
+
+	return deltaPath, info.Size(), nil
+}
+
+// deltaWriter は差分の命令を書き出す
+type deltaWriter struct {
+	w         *bufio.Writer
+	literal   []byte
+	copyStart uint32
+	copyCount uint32
+}
+
+func (d *deltaWriter) Copy(block uint32) error {
+	err := d.flushLiteral()
+	if err != nil {
+		return err
+	}
+
+	if d.copyCount > 0 && d.copyStart+d.copyCount == block {
+		d.copyCount++
+		return nil
+	}
+
+	err = d.flushCopy()
+	d.copyStart, d.copyCount = block, 1
+	return err
+}
+
+func (d *deltaWriter) Literal(c byte) error {
+	err := d.flushCopy()
+	if err != nil {
+		return err
+	}
+
+	d.literal = append(d.literal, c)
+	if len(d.literal) >= deltaMaxLiteral {
+		return d.flushLiteral()
+	}
+	return nil
+}
+
+func (d *deltaWriter) flushCopy() error {
+	if d.copyCount == 0 {
+		return nil
+	}
+
+	op := []byte{deltaCopy}
+	op = binary.LittleEndian.AppendUint32(op, d.copyStart)
+	op = binary.LittleEndian.AppendUint32(op, d.copyCount)
+	d.copyCount = 0
+	return d.write(op)
+}
+
+func (d *deltaWriter) flushLiteral() error {
+	if len(d.literal) == 0 {
+		return nil
+	}
+
+	op := []byte{deltaLiteral}
+	op = binary.LittleEndian.AppendUint32(op, uint32(len(d.literal)))
+	err := d.write(op)
+	if err != nil {
+		return err
+	}
+
+	err = d.write(d.literal)
+	d.literal = d.literal[:0]
+	return err
+}
+
+func (d *deltaWriter) write(p []byte) error {
+	_, err := d.w.Write(p)
+	return err
+}
+
+func (d *deltaWriter) Close() error {
+	err := d.flushCopy()
+	if err != nil {
+		return err
+	}
+
+	err = d.flushLiteral()
+	if err != nil {
+		return err
+	}
+
+	return d.w.Flush()
+}
+
+// writeDelta は新しいファイル path と受信側の署名から差分を一時ファイルに書き出す
+// 新しいファイルの algorithm のハッシュも同じ読み込みで計算する
+func writeDelta(path string, sigs *deltaSignatures, algorithm string) (string, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	out, err := os.CreateTemp("", "quickport-*"+deltaSuffix)
+	if err != nil {
+		return "", "", err
+	}
+	defer out.Close()
+
+	fileHash, err := tray.NewHash(algorithm)
+	if err != nil {
+		os.Remove(out.Name())
+		return "", "", err
+	}
+
+	err = diffFile(io.TeeReader(file, fileHash), sigs, &deltaWriter{w: bufio.NewWriter(out)})
+	if err != nil {
+		os.Remove(out.Name())
+		return "", "", err
+	}
+
+	return out.Name(), tray.FormatHash(algorithm, fileHash), nil
+}
+
+// diffFile は r を署名と照合しながら差分を書く
+func diffFile(r io.Reader, sigs *deltaSignatures, delta *deltaWriter) error {
+	// 弱いチェックサムからブロックを引けるようにする
+	weak := make(map[uint32][]uint32, sigs.Blocks)
+	for i := uint32(0); i < sigs.Blocks; i++ {
+		sum := binary.LittleEndian.Uint32(sigs.Data[i*deltaSignatureSize:])
+		weak[sum] = append(weak[sum], i)
+	}
+
+	reader := bufio.NewReaderSize(r, 1<<20)
+	size := sigs.BlockSize
+	window := make([]byte, size) // リングバッファ
+	flat := make([]byte, size)
+	head := 0
+
+	// fill はウィンドウを読み直す。足りなければ読めた分を返す
+	fill := func() (int, error) {
+		n, err := io.ReadFull(reader, window)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return n, nil
+		}
+		return n, err
+	}
+
+	n, err := fill()
+	if err != nil {
+		return err
+	}
+	head = 0
+	roll := newRollingChecksum(window[:n])
+
+	for n == size {
+		if blocks, ok := weak[roll.Sum()]; ok {
+			copy(flat, window[head:])
+			copy(flat[size-head:], window[:head])
+			strong := strongHash(flat)
+
+			matched := false
+			for _, block := range blocks {
+				offset := int(block)*deltaSignatureSize + 4
+				if string(sigs.Data[offset:offset+deltaStrongSize]) == string(strong) {
+					err = delta.Copy(block)
+					matched = true
+					break
+				}
+			}
+			if err != nil {
+				return err
+			}
+
+			if matched {
+				n, err = fill()
+				if err != nil {
+					return err
+				}
+				head = 0
+				roll = newRollingChecksum(window[:n])
+				continue
+			}
+		}
+
+		// 一致しなかったので1バイトずらし、出ていくバイトはそのまま送る
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		out := window[head]
+		err = delta.Literal(out)
+		if err != nil {
+			return err
+		}
+		window[head] = c
+		head = (head + 1) % size
+		roll.Roll(out, c)
+	}
+
+	// 残りのウィンドウ (n < size の場合は先頭から n バイト)
+	for i := 0; i < n; i++ {
+		err = delta.Literal(window[(head+i)%size])
+		if err != nil {
+			return err
+		}
+	}
+
+	return delta.Close()
+}
+
+// applyDelta は古いファイルと差分から新しいファイルを newPath に組み立てる
+func applyDelta(oldPath, deltaPath, newPath string, sigs *deltaSignatures, targetSize int64) error {
+	old, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	deltaFile, err := os.Open(deltaPath)
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+
+	out, err := os.Create(newPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	r := bufio.NewReader(deltaFile)
+	w := bufio.NewWriter(out)
+	blockSize := int64(sigs.BlockSize)
+	var written int64
+	header := make([]byte, 8)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = io.ReadFull(r, header[:4])
+		if err != nil {
+			return fmt.Errorf("truncated delta: %v", err)
+		}
+
+		var n int64
+		switch op {
+		case deltaCopy:
+			_, err = io.ReadFull(r, header[4:8])
+			if err != nil {
+				return fmt.Errorf("truncated delta: %v", err)
+			}
+
+			start := binary.LittleEndian.Uint32(header[0:4])
+			count := binary.LittleEndian.Uint32(header[4:8])
+			if uint64(start)+uint64(count) > uint64(sigs.Blocks) {
+				return fmt.Errorf("delta refers to missing block %d", uint64(start)+uint64(count)-1)
+			}
+
+			n, err = io.Copy(w, io.NewSectionReader(old, int64(start)*blockSize, int64(count)*blockSize))
+		case deltaLiteral:
+			length := int64(binary.LittleEndian.Uint32(header[0:4]))
+			n, err = io.CopyN(w, r, length)
+		default:
+			return fmt.Errorf("unknown delta op: %d", op)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply delta: %v", err)
+		}
+
+		written += n
+		if written > targetSize {
+			return fmt.Errorf("delta is larger than the file")
+		}
+	}
+
+	if written != targetSize {
+		return fmt.Errorf("delta produced %d bytes, expected %d", written, targetSize)
+	}
+
+	return w.Flush()
+}
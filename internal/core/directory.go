@@ -0,0 +1,196 @@
+package core
+
+import (
+	"QuickPort/tray"
+	"QuickPort/utils"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ディレクトリの get は、ファイル一覧 (Manifest) を受け取ってから1ファイルずつ通常の get をする
+// 一覧はデータグラムに収まる分ずつ、受信側が Offset を指定して取りに行く
+const manifestRetryInterval = 2 * time.Second
+
+var errIsDirectory = errors.New("path is a directory")
+
+// sendManifest はトレイ内のディレクトリのファイル一覧を Offset 番目から返す
+func (h *Handle) sendManifest(id uint32, req *ManifestRequestData) {
+	if !h.Peer.Caps.Has(CapDirectory) {
+		h.sendTransferError(id, &ErrorPacketData{Error: "directory transfer not negotiated", Code: FileNotFound})
+		return
+	}
+
+	dir, err := tray.Resolve(req.Path)
+	if err != nil {
+		logrus.Errorf("Peer requested %v", err)
+		h.sendTransferError(id, &ErrorPacketData{Error: "Directory not found", Code: FileNotFound})
+		return
+	}
+
+	files, err := listManifest(dir)
+	if err != nil {
+		logrus.Errorf("Failed to list %s: %v", req.Path, err)
+		h.sendTransferError(id, &ErrorPacketData{Error: "Directory not found", Code: FileNotFound})
+		return
+	}
+
+	if int(req.Offset) > len(files) {
+		h.sendTransferError(id, &ErrorPacketData{Error: "directory has changed", Code: FailedFileOperations})
+		return
+	}
+
+	// フレームがデータグラム 1 つに収まるだけ詰める (1 件は必ず入れる)
+	page := &ManifestData{Offset: req.Offset, Total: uint32(len(files))}
+	budget := h.Peer.ChunkSize() - 12
+	for _, f := range files[req.Offset:] {
+		size := 12 + len(f.Path)
+		if len(page.Files) > 0 && size > budget {
+			break
+		}
+		page.Files = append(page.Files, f)
+		budget -= size
+	}
+
+	err = sendFrame(h.Self, h.Peer, true, &BaseData{Type: Manifest, Transfer: id, Data: page})
+	if err != nil {
+		logrus.Errorf("Failed to send manifest: %v", err)
+	}
+}
+
+// listManifest は dir 以下の通常ファイルを一覧にする (受信途中の部分ファイルは除く)
+func listManifest(dir string) ([]ManifestEntry, error) {
+	files := []ManifestEntry{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir {
+				return err
+			}
+
+			logrus.Warnf("Skipping %s: %v", p, err)
+			return nil
+		}
+		if d.IsDir() || isWorkFile(p) {
+			return nil
+		}
+
+		info, err := os.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, ManifestEntry{Path: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// fetchManifest は相手のディレクトリのファイル一覧を全て受け取る
+func fetchManifest(handle *Handle, dir string) ([]ManifestEntry, error) {
+	tr, err := handle.openTransfer(0)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+
+	files := []ManifestEntry{}
+	total := -1
+	lastReply := time.Now()
+	for total < 0 || len(files) < total {
+		request := &ManifestRequestData{Path: dir, Offset: uint32(len(files))}
+		err = sendFrame(handle.Self, handle.Peer, false, &BaseData{Type: ManifestRequest, Transfer: tr.ID, Data: request})
+		if err != nil {
+			return nil, fmt.Errorf("failed to send manifest request: %v", err)
+		}
+
+		meta, err := tr.receiveFrame(manifestRetryInterval)
+		if err != nil {
+			if errors.Is(err, errTransferTimeout) && time.Since(lastReply) < peerTimeout {
+				continue
+			}
+			return nil, fmt.Errorf("failed to receive manifest: %v", err)
+		}
+
+		// 再送で重複した返事は捨てる
+		page, ok := meta.Data.(*ManifestData)
+		if !ok || int(page.Offset) != len(files) {
+			continue
+		}
+		lastReply = time.Now()
+
+		if total >= 0 && int(page.Total) != total {
+			return nil, fmt.Errorf("directory %s has changed while listing", dir)
+		}
+		total = int(page.Total)
+
+		if len(page.Files) == 0 && len(files) < total {
+			return nil, fmt.Errorf("peer sent an empty manifest page")
+		}
+		files = append(files, page.Files...)
+	}
+
+	return files[:total], nil
+}
+
+// receiveDirectory は相手のディレクトリ dir を outputDir 以下に相対パスを保って受信する
+func receiveDirectory(handle *Handle, opts *transferOptions, dir string, outputDir string) error {
+	if !handle.Peer.Caps.Has(CapDirectory) {
+		fmt.Println("directory transfer is not supported by peer")
+		return nil
+	}
+
+	files, err := fetchManifest(handle, dir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	logrus.Infof("Directory %s: %d files, %s", dir, len(files), utils.FormatSize(total))
+
+	// 1ファイルずつ通常の get と同じく受信する (ハッシュの検証と途中からの再開もファイルごと)
+	failed := 0
+	for i, f := range files {
+		local := filepath.FromSlash(f.Path)
+		if !filepath.IsLocal(local) {
+			logrus.Errorf("Skipping unsafe path from peer: %s", f.Path)
+			failed++
+			continue
+		}
+
+		logrus.Infof("[%d/%d] %s", i+1, len(files), f.Path)
+		if reuseLocalCopy(handle, opts.reuse, path.Join(dir, f.Path), filepath.Join(outputDir, local)) {
+			continue
+		}
+
+		err := receiveFile(handle, 0, opts.request(path.Join(dir, f.Path)), filepath.Join(outputDir, local), nil)
+		if err != nil {
+			logrus.Errorf("Failed to receive %s: %v", f.Path, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files in %s failed, run get again to resume", failed, len(files), dir)
+	}
+
+	logrus.Infof("Directory downloaded successfully: %s", outputDir)
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package core
+
+import (
+	"net"
+	"syscall"
+)
+
+const ipv6PmtudiscDo = 2 // syscall に定義が無い
+
+// setDontFragment は送信するデータグラムに DF を立て、経路上で分割させない
+func setDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	// デュアルスタックのソケットなので IPv4/IPv6 の両方に設定する
+	var v4err, v6err error
+	err = raw.Control(func(fd uintptr) {
+		v4err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		v6err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, ipv6PmtudiscDo)
+	})
+	if err != nil {
+		return err
+	}
+	if v4err != nil && v6err != nil {
+		return v4err
+	}
+
+	return nil
+}
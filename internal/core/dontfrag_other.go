@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package core
+
+import (
+	"errors"
+	"net"
+)
+
+// setDontFragment はこのプラットフォームでは未対応 (経路 MTU の探索は行わない)
+func setDontFragment(conn *net.UDPConn) error {
+	return errors.New("don't fragment is not supported on this platform")
+}
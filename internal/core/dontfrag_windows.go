@@ -0,0 +1,37 @@
+//go:build windows
+
+package core
+
+import (
+	"net"
+	"syscall"
+)
+
+// syscall に定義が無い
+const (
+	ipDontFragment = 14
+	ipv6DontFrag   = 14
+)
+
+// setDontFragment は送信するデータグラムに DF を立て、経路上で分割させない
+func setDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	// デュアルスタックのソケットなので IPv4/IPv6 の両方に設定する
+	var v4err, v6err error
+	err = raw.Control(func(fd uintptr) {
+		v4err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, ipDontFragment, 1)
+		v6err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if v4err != nil && v6err != nil {
+		return v4err
+	}
+
+	return nil
+}
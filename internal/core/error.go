@@ -1,21 +1,22 @@
 package core
 
-func IsErrorPacket(packet *BaseData) (*ErrorPacketData, bool) {
-	errpac, err := convertMapToErrorPacketData(packet.Data)
-	if err != nil {
-		return nil, false
-	}
+import "fmt"
 
-	return errpac, true
+func IsErrorPacket(packet *BaseData) (*ErrorPacketData, bool) {
+	errpac, ok := packet.Data.(*ErrorPacketData)
+	return errpac, ok
 }
 
 func (h *Handle) SendError(packet *ErrorPacketData, useSub bool) error {
-	conn := h.Self.Conn
-	addr := h.Peer.Addr
-	if useSub {
-		conn = h.Self.SubConn
-		addr = h.Peer.SubAddr
-	}
+	return sendFrame(h.Self, h.Peer, useSub, &BaseData{Type: Error, Data: packet})
+}
+
+// PeerError はピアから Error パケットで通知されたエラー
+type PeerError struct {
+	Code    ErrorCode
+	Message string
+}
 
-	return Write(conn, addr.StrAddr(), &BaseData{Type: Error, Data: packet})
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer error: %s", e.Message)
 }
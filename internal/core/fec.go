@@ -0,0 +1,248 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// データチャンクをこの数ごとのブロックにまとめ、ブロック単位でパリティを付ける
+const fecBlockChunks = 32
+
+// fecParity は冗長度 (%) からブロックあたりのパリティチャンク数を決める
+func fecParity(redundancy int) uint32 {
+	if redundancy <= 0 {
+		return 0
+	}
+
+	return uint32((fecBlockChunks*redundancy + 99) / 100)
+}
+
+// fecBlockRange はブロックに含まれるデータチャンクの範囲 [start, end)
+func fecBlockRange(index *FileIndexData, block uint32) (uint32, uint32) {
+	start := block * index.FecBlock
+	end := start + index.FecBlock
+	if end > index.ChunkCount {
+		end = index.ChunkCount
+	}
+
+	return start, end
+}
+
+func fecBlockCount(index *FileIndexData) uint32 {
+	return (index.ChunkCount + index.FecBlock - 1) / index.FecBlock
+}
+
+// readShard は index 番目のチャンクの元データを ChunkSize に 0 埋めして読む
+func readShard(file *os.File, index uint32, chunkSize int) ([]byte, error) {
+	shard := make([]byte, chunkSize)
+	_, err := file.ReadAt(shard, int64(index)*int64(chunkSize))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return shard, nil
+}
+
+// fecEncoder は送信側でブロックごとの Reed-Solomon パリティを作る
+type fecEncoder struct {
+	enc   reedsolomon.Encoder
+	index *FileIndexData
+	file  *os.File
+	sent  *chunkBitmap // パリティを送ったブロック
+}
+
+func newFecEncoder(file *os.File, index *FileIndexData) (*fecEncoder, error) {
+	enc, err := reedsolomon.New(int(index.FecBlock), int(index.FecParity))
+	if err != nil {
+		return nil, err
+	}
+
+	return &fecEncoder{
+		enc:   enc,
+		index: index,
+		file:  file,
+		sent:  newChunkBitmap(fecBlockCount(index)),
+	}, nil
+}
+
+// BlockDone は index がブロック最後のチャンクで、そのブロックのパリティがまだなら true
+func (e *fecEncoder) BlockDone(index uint32) (uint32, bool) {
+	block := index / e.index.FecBlock
+	_, end := fecBlockRange(e.index, block)
+	if index != end-1 || e.sent.Has(block) {
+		return 0, false
+	}
+
+	return block, true
+}
+
+// Encode はブロックのパリティチャンクを返す
+func (e *fecEncoder) Encode(block uint32) ([][]byte, error) {
+	start, end := fecBlockRange(e.index, block)
+	shards := make([][]byte, e.index.FecBlock+e.index.FecParity)
+	for i := range shards {
+		index := start + uint32(i)
+		if i < int(e.index.FecBlock) && index < end {
+			shard, err := readShard(e.file, index, e.index.ChunkSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read chunk %d: %v", index, err)
+			}
+			shards[i] = shard
+		} else {
+			// 最後のブロックの足りない分とパリティは 0 埋め
+			shards[i] = make([]byte, e.index.ChunkSize)
+		}
+	}
+
+	err := e.enc.Encode(shards)
+	if err != nil {
+		return nil, err
+	}
+	e.sent.Set(block)
+
+	return shards[e.index.FecBlock:], nil
+}
+
+// recoveredChunk はパリティから復元したチャンク
+type recoveredChunk struct {
+	Index uint32
+	Data  []byte
+}
+
+// fecDecoder は受信側でパリティを保持し、欠けたチャンクを復元する
+// 受信済みチャンクは出力ファイルから読み直す
+type fecDecoder struct {
+	enc      reedsolomon.Encoder
+	index    *FileIndexData
+	file     *os.File
+	received *chunkBitmap
+	parity   map[uint32][][]byte // ブロックごとに届いたパリティ (未着は nil)
+}
+
+func newFecDecoder(file *os.File, index *FileIndexData, received *chunkBitmap) (*fecDecoder, error) {
+	enc, err := reedsolomon.New(int(index.FecBlock), int(index.FecParity))
+	if err != nil {
+		return nil, err
+	}
+
+	return &fecDecoder{
+		enc:      enc,
+		index:    index,
+		file:     file,
+		received: received,
+		parity:   make(map[uint32][][]byte),
+	}, nil
+}
+
+// OnParity はパリティチャンクを保持し、復元できたチャンクを返す
+// パリティの Index は block*FecParity + 番号
+func (d *fecDecoder) OnParity(chunk *FileChunk) ([]recoveredChunk, error) {
+	if chunk.Index >= fecBlockCount(d.index)*d.index.FecParity {
+		return nil, fmt.Errorf("parity index out of range")
+	}
+	if len(chunk.Data) != d.index.ChunkSize {
+		return nil, fmt.Errorf("unexpected parity length: %d", len(chunk.Data))
+	}
+
+	block := chunk.Index / d.index.FecParity
+	if d.blockComplete(block) {
+		return nil, nil
+	}
+
+	parity, ok := d.parity[block]
+	if !ok {
+		parity = make([][]byte, d.index.FecParity)
+		d.parity[block] = parity
+	}
+	parity[chunk.Index%d.index.FecParity] = append([]byte(nil), chunk.Data...)
+
+	return d.recover(block)
+}
+
+// OnData はデータチャンクの受信後に呼び、同じブロックで復元できたチャンクを返す
+func (d *fecDecoder) OnData(index uint32) ([]recoveredChunk, error) {
+	block := index / d.index.FecBlock
+	if _, ok := d.parity[block]; !ok {
+		return nil, nil
+	}
+
+	return d.recover(block)
+}
+
+func (d *fecDecoder) blockComplete(block uint32) bool {
+	start, end := fecBlockRange(d.index, block)
+	for i := start; i < end; i++ {
+		if !d.received.Has(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recover は欠けたチャンク数が届いたパリティ数以下なら復元する
+func (d *fecDecoder) recover(block uint32) ([]recoveredChunk, error) {
+	start, end := fecBlockRange(d.index, block)
+	parity := d.parity[block]
+
+	missing := 0
+	for i := start; i < end; i++ {
+		if !d.received.Has(i) {
+			missing++
+		}
+	}
+	if missing == 0 {
+		delete(d.parity, block)
+		return nil, nil
+	}
+
+	available := 0
+	for _, p := range parity {
+		if p != nil {
+			available++
+		}
+	}
+	if missing > available {
+		return nil, nil
+	}
+
+	shards := make([][]byte, d.index.FecBlock+d.index.FecParity)
+	for i := uint32(0); i < d.index.FecBlock; i++ {
+		index := start + i
+		switch {
+		case index >= end:
+			shards[i] = make([]byte, d.index.ChunkSize)
+		case d.received.Has(index):
+			shard, err := readShard(d.file, index, d.index.ChunkSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read chunk %d: %v", index, err)
+			}
+			shards[i] = shard
+		}
+	}
+	copy(shards[d.index.FecBlock:], parity)
+
+	err := d.enc.ReconstructData(shards)
+	if err != nil {
+		return nil, err
+	}
+	delete(d.parity, block)
+
+	recovered := []recoveredChunk{}
+	for i := start; i < end; i++ {
+		if d.received.Has(i) {
+			continue
+		}
+
+		length := d.index.TotalSize - int64(i)*int64(d.index.ChunkSize)
+		if length > int64(d.index.ChunkSize) {
+			length = int64(d.index.ChunkSize)
+		}
+		recovered = append(recovered, recoveredChunk{Index: i, Data: shards[i-start][:length]})
+	}
+
+	return recovered, nil
+}
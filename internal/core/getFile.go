@@ -3,9 +3,10 @@ package core
 import (
 	"QuickPort/tray"
 	"QuickPort/ui"
+	"QuickPort/utils"
+	"errors"
 	"fmt"
 	"hash/crc32"
-	"net"
 	"os"
 	"path/filepath"
 	"time"
@@ -14,215 +15,618 @@ import (
 )
 
 func GetFile(handle *Handle, args *ShellArgs) error {
+	// --all はトレイ全体 (トレイのルートをパスとして扱う)
+	all := args.TakeFlag("all")
+	if all {
+		args.Arg = append([]string{"."}, args.Arg...)
+	}
+	force := args.TakeFlag("force")
+
+	opts, err := parseTransferOptions(handle, args)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	// --force が無ければ、同じ内容のファイルが手元にあるものは受信しない
+	if !force {
+		opts.reuse = newLocalFiles(tray.UseTray())
+	}
+
 	if len(args.Arg) < 1 {
-		fmt.Println("get peer file\nget [path]")
+		fmt.Println("get peer files or directories\nget [path|pattern]... [--comp mode] [--limit rate] [--fec percent] [--force]\nget --all [--comp mode] [--limit rate] [--fec percent] [--force]")
 		return nil
 	}
 
-	filePath := args.Head()
-	var compMode string
+	if all {
+		return receiveDirectory(handle, opts, ".", tray.UseTray())
+	}
 
-	if len(args.Arg) >= 2 {
-		compMode = args.Next().Head()
+	if len(args.Arg) == 1 && !isGlob(args.Head()) {
+		return getPath(handle, opts, args.Head(), filepath.Join(tray.UseTray(), filepath.Base(args.Head())))
 	}
 
-	// Step 1: ファイルリクエスト送信
-	logrus.Infof("Requesting file: %s", filePath)
-	reqData := BaseData{
-		Type: FileReqest,
-		Data: fileRequestData{
-			FilePath: filePath,
-			CompMode: compMode,
-		},
+	return getFiles(handle, opts, args.Arg)
+}
+
+// getPath は1つのファイルかディレクトリを outputPath に受信する
+func getPath(handle *Handle, opts *transferOptions, filePath string, outputPath string) error {
+	if reuseLocalCopy(handle, opts.reuse, filePath, outputPath) {
+		return nil
+	}
+
+	err := receiveFile(handle, 0, opts.request(filePath), outputPath, nil)
+	if errors.Is(err, errIsDirectory) {
+		return receiveDirectory(handle, opts, filePath, outputPath)
+	}
+
+	return err
+}
+
+// getFiles は複数のパスとパターンを順に受信し、最後に結果をまとめて表示する
+// パターンは接続時に受け取った相手のトレイ一覧と照合し、一致したファイルはトレイからの相対パスのまま保存する
+func getFiles(handle *Handle, opts *transferOptions, patterns []string) error {
+	targets := []getTarget{}
+	seen := map[string]bool{}
+	add := func(filePath, outputPath string) {
+		if !seen[filePath] {
+			seen[filePath] = true
+			targets = append(targets, getTarget{FilePath: filePath, OutputPath: outputPath})
+		}
 	}
 
-	err := Write(handle.Self.Conn, handle.Peer.Addr.StrAddr(), &reqData)
+	for _, pattern := range patterns {
+		if !isGlob(pattern) {
+			add(pattern, filepath.Join(tray.UseTray(), filepath.Base(pattern)))
+			continue
+		}
+
+		matched := 0
+		for _, item := range handle.PeerTray {
+			ok, err := matchGlob(pattern, item.Filename)
+			if err != nil {
+				fmt.Printf("invalid pattern %s: %v\n", pattern, err)
+				return nil
+			}
+
+			local := filepath.FromSlash(item.Filename)
+			if !ok || isWorkFile(item.Filename) || !filepath.IsLocal(local) {
+				continue
+			}
+
+			add(item.Filename, filepath.Join(tray.UseTray(), local))
+			matched++
+		}
+
+		if matched == 0 {
+			fmt.Printf("no files match %s\n", pattern)
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	// パターンでないパスは名前だけで保存するので、別のパスが同じ名前になると後のもので上書きしてしまう
+	if a, b, ok := outputCollision(targets); ok {
+		fmt.Printf("%s and %s would both be saved as %s\nget them one at a time\n", a.FilePath, b.FilePath, a.OutputPath)
+		return nil
+	}
+
+	failed := []string{}
+	for i, t := range targets {
+		logrus.Infof("[%d/%d] %s", i+1, len(targets), t.FilePath)
+		err := getPath(handle, opts, t.FilePath, t.OutputPath)
+		if err != nil {
+			logrus.Errorf("Failed to receive %s: %v", t.FilePath, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", t.FilePath, err))
+		}
+	}
+
+	fmt.Printf("get: %d succeeded, %d failed\n", len(targets)-len(failed), len(failed))
+	for _, f := range failed {
+		fmt.Printf("  %s\n", f)
+	}
+
+	return nil
+}
+
+// getTarget は get で受信するパスと保存先
+type getTarget struct {
+	FilePath   string
+	OutputPath string
+}
+
+// outputCollision は保存先が同じになる最初の2つを返す
+func outputCollision(targets []getTarget) (getTarget, getTarget, bool) {
+	outputs := map[string]getTarget{}
+	for _, t := range targets {
+		if other, ok := outputs[t.OutputPath]; ok {
+			return other, t, true
+		}
+		outputs[t.OutputPath] = t
+	}
+
+	return getTarget{}, getTarget{}, false
+}
+
+// transferOptions は受信側が指定する転送方法 (get と accept で共通)
+type transferOptions struct {
+	CompMode   string
+	RateLimit  int64 // 帯域制限 (bytes/s, 0 は無制限)
+	Redundancy int   // FEC パリティの割合 (%)
+
+	reuse *localFiles // 同じ内容の手元のファイルを探す (nil なら常に受信する)
+}
+
+// parseTransferOptions は --comp, --limit, --fec を読む
+// 互換のため、2つ以上の引数の最後が圧縮モードの名前ならそれも圧縮モードとして取り除く
+// 残った引数が対象 (get のパス、accept の番号)
+func parseTransferOptions(handle *Handle, args *ShellArgs) (*transferOptions, error) {
+	compMode, hasComp, err := args.TakeOption("comp")
 	if err != nil {
-		return fmt.Errorf("failed to send request: %v", err)
+		return nil, err
+	}
+
+	limitText, hasLimit, err := args.TakeOption("limit")
+	if err != nil {
+		return nil, err
 	}
 
-	// Step 2: インデックス情報受信 (SubConnを使用)
-	logrus.Info("Waiting for file index...")
-	indexData, err := receiveFileIndex(handle)
+	fecText, hasFec, err := args.TakeOption("fec")
 	if err != nil {
-		handle.SendError(&ErrorPacketData{Error: "failed to receive file index", Code: FaildReceive}, true)
+		return nil, err
+	}
+
+	// 帯域制限 (指定が無ければセッションの既定値)
+	opts := &transferOptions{RateLimit: handle.Limit.Rate()}
+	if hasLimit {
+		opts.RateLimit, err = utils.ParseRate(limitText)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// FEC パリティの割合 (損失の多い回線向け)
+	if hasFec {
+		opts.Redundancy, err = utils.ParsePercent(fecText)
+		if err != nil {
+			return nil, err
+		}
+		if !handle.Peer.Caps.Has(CapFEC) {
+			return nil, fmt.Errorf("fec is not supported by peer")
+		}
+	}
+
+	opts.CompMode = compMode
+	if last := len(args.Arg) - 1; !hasComp && last >= 1 && compModeCapability(args.Arg[last]) != 0 {
+		opts.CompMode = args.Arg[last]
+		args.Arg = args.Arg[:last]
+	}
+
+	// 接続時に合意しなかった圧縮方式は使えない
+	if !handle.Peer.Caps.Has(compModeCapability(opts.CompMode)) {
+		return nil, fmt.Errorf("compression mode %q is not supported by peer (%s)", opts.CompMode, handle.Peer.Caps)
+	}
+
+	return opts, nil
+}
+
+func (o *transferOptions) request(filePath string) fileRequestData {
+	return fileRequestData{
+		FilePath:   filePath,
+		CompMode:   o.CompMode,
+		RateLimit:  o.RateLimit,
+		Redundancy: o.Redundancy,
+	}
+}
+
+// receiveFile は request を送って outputPath に受信する。id が 0 なら新しい転送 ID を振る
+// put を受け入れる場合は limit で申し出の大きさと上限を渡す (get では nil)
+func receiveFile(handle *Handle, id uint32, request fileRequestData, outputPath string, limit *putLimit) error {
+	// 同じファイルへの受信が同時に走ると部分ファイルを壊すので断る
+	if !handle.claimOutput(outputPath) {
+		fmt.Printf("already downloading %s\n", outputPath)
+		return nil
+	}
+	defer handle.releaseOutput(outputPath)
+
+	// この転送のパケットだけを受け取る
+	tr, err := handle.openTransfer(id)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	tr.markDownload()
+
+	// 前回の途中状態が残っていれば再開を試みる
+	var resumeIndex *FileIndexData
+	var received *chunkBitmap
+	if handle.Peer.Caps.Has(CapResume) {
+		resumeIndex, received, err = loadPartial(outputPath)
+		if err != nil {
+			logrus.Warnf("Ignoring partial download: %v", err)
+			removePartial(outputPath)
+		}
+	}
+
+	var indexData *FileIndexData
+	var sigs *deltaSignatures
+	for {
+		// Step 1: ファイルリクエスト送信
+		logrus.Infof("Requesting file: %s", request.FilePath)
+		request.ResumeHash, request.ChunkSize = "", 0
+		request.DeltaBlockSize, request.DeltaBlocks = 0, 0
+		if resumeIndex != nil {
+			logrus.Infof("Resuming partial download (%d/%d chunks)", received.Count(), resumeIndex.ChunkCount)
+			request.ResumeHash = resumeIndex.FileHash
+			request.ChunkSize = resumeIndex.ChunkSize
+		} else if handle.Peer.Caps.Has(CapDelta) {
+			// 古いファイルが手元にあれば、その署名を渡して差分だけを送ってもらう
+			sigs, err = computeSignatures(outputPath)
+			if err != nil {
+				logrus.Warnf("Not using delta transfer: %v", err)
+				sigs = nil
+			}
+			if sigs != nil {
+				request.DeltaBlockSize = uint32(sigs.BlockSize)
+				request.DeltaBlocks = sigs.Blocks
+			}
+		}
+
+		// Step 2: インデックス情報受信 (SubConnを使用)。リクエストは返事が来るまで送り直す
+		logrus.Info("Waiting for file index...")
+		indexData, err = receiveFileIndex(tr, &request, sigs)
+		if err == nil {
+			break
+		}
+
+		// ディレクトリは呼び出し側がファイル一覧から受信し直す
+		var peerErr *PeerError
+		if errors.As(err, &peerErr) && peerErr.Code == IsDirectory {
+			return fmt.Errorf("%s: %w", request.FilePath, errIsDirectory)
+		}
+
+		// 相手のファイルが変わっていたら最初からやり直す
+		if resumeIndex != nil && errors.As(err, &peerErr) && peerErr.Code == ResumeRejected {
+			logrus.Warn("Peer file has changed since the partial download, starting over")
+			removePartial(outputPath)
+			resumeIndex, received = nil, nil
+			continue
+		}
+
+		tr.SendError(&ErrorPacketData{Error: "failed to receive file index", Code: FaildReceive})
 		//retry
 		return fmt.Errorf("failed to receive file index: %v", err)
 	}
 
 	logrus.Infof("File info - Size: %d bytes, Chunks: %d", indexData.TotalSize, indexData.ChunkCount)
 
+	// put は申し出と違う大きさや上限を超える大きさを送ってきたら断る
+	if limit != nil {
+		err = limit.Check(indexData)
+		if err != nil {
+			tr.SendError(&ErrorPacketData{Error: err.Error(), Code: PutDeclined})
+			return fmt.Errorf("declined %s: %v", request.FilePath, err)
+		}
+	}
+
+	// 合意より弱いハッシュでの検証は受け付けない
+	if indexData.HashAlgo != handle.Peer.HashAlgorithm() {
+		tr.SendError(&ErrorPacketData{Error: "hash algorithm not negotiated", Code: FailedCalcFileHash})
+		return fmt.Errorf("peer used unnegotiated hash algorithm: %q", indexData.HashAlgo)
+	}
+
+	// Merkle 木のセグメントのハッシュを先に受け取り、揃ったセグメントから検証する
+	var segmentHashes [][]byte
+	if indexData.SegmentChunks > 0 && handle.Peer.Caps.Has(CapMerkle) {
+		segmentHashes, err = fetchSegmentHashes(tr, indexData)
+		if err != nil {
+			tr.SendError(&ErrorPacketData{Error: "failed to receive segment hashes", Code: FaildReceive})
+			return err
+		}
+	}
+
+	if indexData.Delta && sigs == nil {
+		tr.SendError(&ErrorPacketData{Error: "delta not requested", Code: FailedFileOperations})
+		return fmt.Errorf("peer sent a delta that was not requested")
+	}
+
+	if resumeIndex != nil && !resumeIndex.SameFile(indexData) {
+		logrus.Warn("File index differs from the partial download, starting over")
+		received = nil
+	}
+
 	// Step 3: ファイル受信準備
-	outputPath := filepath.Join(tray.UseTray(), filepath.Base(filePath))
 	err = os.MkdirAll(filepath.Dir(outputPath), 0755)
 	if err != nil {
-		handle.SendError(&ErrorPacketData{Error: "failed to create output directory", Code: FailedFileOperations}, true)
+		tr.SendError(&ErrorPacketData{Error: "failed to create output directory", Code: FailedFileOperations})
 		return fmt.Errorf("failed to create output directory: %v", err)
 	}
 
-	file, err := os.Create(outputPath)
+	// 差分は古いファイルの横に受け取り、揃ってから古いファイルと組み立てる (差分の受信は再開しない)
+	streamPath := outputPath
+	if indexData.Delta {
+		logrus.Infof("Receiving delta against the existing file (%d bytes after applying)", indexData.TargetSize)
+		streamPath = outputPath + deltaSuffix
+		defer os.Remove(streamPath)
+	}
+
+	var file *os.File
+	if received != nil {
+		file, err = os.OpenFile(streamPath, os.O_RDWR, 0644)
+	} else {
+		// ハードリンクされたファイルを上書きすると他の名前の中身まで変わるので、消してから作り直す
+		os.Remove(streamPath)
+		file, err = os.Create(streamPath)
+	}
 	if err != nil {
-		handle.SendError(&ErrorPacketData{Error: "failed to create output file", Code: FailedFileOperations}, true)
+		tr.SendError(&ErrorPacketData{Error: "failed to create output file", Code: FailedFileOperations})
 		return fmt.Errorf("failed to create output file: %v", err)
 	}
 	defer file.Close()
 
+	if received == nil {
+		// 出力ファイルを先に確保しておき、チャンクは届いた順にオフセットへ書き込む
+		err = file.Truncate(indexData.TotalSize)
+		if err != nil {
+			tr.SendError(&ErrorPacketData{Error: "failed to create output file", Code: FailedFileOperations})
+			return fmt.Errorf("failed to preallocate output file: %v", err)
+		}
+		received = newChunkBitmap(indexData.ChunkCount)
+	}
+
+	var verifier *segmentVerifier
+	if segmentHashes != nil {
+		verifier = newSegmentVerifier(indexData, segmentHashes, received)
+
+		// 前回受信したセグメントも壊れていないか確かめ、壊れていれば受信し直す
+		bad, err := verifier.VerifyReceived(file, received)
+		if err != nil {
+			tr.SendError(&ErrorPacketData{Error: "failed to verify partial download", Code: FailedFileOperations})
+			return err
+		}
+		if bad > 0 {
+			logrus.Warnf("%d segments of the partial download were corrupted, receiving them again", bad)
+		}
+	}
+	resuming := received.Count() > 0
+
+	// 受信状況をサイドカーに残し、中断しても次回の get で続きから受信できるようにする
+	var partial *partialTracker
+	if !indexData.Delta {
+		partial = newPartialTracker(outputPath, indexData, received)
+		err = partial.Save()
+		if err != nil {
+			logrus.Warnf("Failed to save partial download state: %v", err)
+		}
+	}
+	finished := false
+	defer func() {
+		if !finished && partial != nil {
+			err := partial.Save()
+			if err != nil {
+				logrus.Warnf("Failed to save partial download state: %v", err)
+				return
+			}
+			logrus.Infof("Partial download kept (%d/%d chunks), run get again to resume", received.Count(), indexData.ChunkCount)
+		}
+	}()
+
+	codec, err := newBlockCodec(request.CompMode)
+	if err != nil {
+		tr.SendError(&ErrorPacketData{Error: "failed to decompress", Code: FailedDeCompress})
+		return fmt.Errorf("failed to set up decompression: %v", err)
+	}
+	defer codec.Close()
+
 	// Step 4: 受信開始の合図を送信
 	startData := BaseData{
-		Type: Message,
-		Data: map[string]interface{}{"action": "start_transfer"},
+		Type: StartTransfer,
+		Data: &StartTransferData{Resume: resuming},
 	}
-	err = Write(handle.Self.SubConn, handle.Peer.SubAddr.StrAddr(), &startData)
+	err = tr.write(&startData)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %v", err)
 	}
 
 	logrus.Info("Sent start transfer signal, receiving file chunks...")
 
-	// Step 5: チャンク受信ループ
-	receivedChunks := make(map[uint32][]byte) // チャンクデータも保存
-	missingChunks := make([]uint32, 0)
-
 	//チャンクマップのセットアップ (チャンクからマスの計算とか)
 	chunks := ui.MakeChunks(int(indexData.ChunkCount))
+	for i := uint32(0); i < indexData.ChunkCount; i++ {
+		if received.Has(i) {
+			ui.SetChunkState(chunks, int(i), true)
+		}
+	}
+	progress := &progressMap{chunks: chunks}
 
-	for len(receivedChunks) < int(indexData.ChunkCount) {
-		// タイムアウト設定
-		handle.Self.SubConn.SetReadDeadline(time.Now().Add(time.Second * ChunkTimeoutSeconds))
+	// 受信状況を送信側へ返し、送信レートを調整してもらう
+	feedback := newFeedbackTracker(indexData.ChunkSize)
 
-		chunk, err := receiveFileChunk(handle.Self.SubConn)
+	// 受信状況を SACK で定期的に知らせ、送信側に欠落チャンクを随時再送してもらう
+	sack := newSackBuilder(received)
+	if resuming {
+		for _, data := range sack.Sweep() {
+			sendSack(tr, data)
+		}
+	}
+
+	// FEC 有りの場合、パリティから欠落チャンクを復元する
+	var fec *fecDecoder
+	if indexData.FecParity > 0 {
+		fec, err = newFecDecoder(file, indexData, received)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				logrus.Warn("Timeout occurred, requesting missing chunks...")
-				break
-			}
+			tr.SendError(&ErrorPacketData{Error: "failed to set up fec", Code: FailedFileOperations})
+			return fmt.Errorf("failed to set up fec: %v", err)
+		}
+	}
 
-			handle.SendError(&ErrorPacketData{Error: "failed to receive chunk", Code: FaildReceive}, true)
-			return fmt.Errorf("failed to receive chunk: %v", err)
+	// store は展開済みのチャンクを書き込み、受信済みとして記録する
+	// 受信済みのチャンクは書き直さない (検証の済んだセグメントを、遅れて届いた重複で上書きしないため)
+	store := func(index uint32, raw []byte) error {
+		if received.Has(index) {
+			return nil
 		}
 
-		// チェックサム検証
-		expectedChecksum := crc32.ChecksumIEEE(chunk.Data)
-		if expectedChecksum != chunk.Checksum {
-			logrus.Warnf("Checksum mismatch for chunk %d, will request again", chunk.Index)
-			continue
+		err := writeChunk(file, indexData.ChunkSize, index, raw)
+		if err != nil {
+			return err
 		}
 
-		// チャンクデータを保存（圧縮されたまま）
 		//チャンクマップの更新
-		go ui.UpdateState(chunks, int(chunk.Index), true)
-		receivedChunks[chunk.Index] = chunk.Data
-		logrus.Debugf("Received chunk %d/%d", len(receivedChunks), indexData.ChunkCount)
-	}
+		received.Set(index)
+		progress.Set(index)
+		markPartial(partial)
 
-	// Step 6: 欠落チャンクの確認と再送要求
-	for i := uint32(0); i < indexData.ChunkCount; i++ {
-		if _, exists := receivedChunks[i]; !exists {
-			missingChunks = append(missingChunks, i)
+		// セグメントが揃ったら検証し、壊れていればそのセグメントだけ送り直してもらう
+		if verifier != nil {
+			segment, bad, err := verifier.OnReceived(file, index)
+			if err != nil {
+				return err
+			}
+			if bad {
+				err := verifier.Reject(segment, received)
+				if err != nil {
+					tr.SendError(&ErrorPacketData{Error: "segment failed verification repeatedly", Code: FaildReceive})
+					return err
+				}
+				start, count := verifier.Range(segment)
+				for i := start; i < start+count; i++ {
+					ui.SetChunkState(chunks, int(i), false)
+				}
+				sendResend(tr, verifier, segment)
+			}
 		}
+		return nil
 	}
 
-	retryCount := 0
-	for len(missingChunks) > 0 && retryCount < MaxRetries {
-		logrus.Infof("Requesting %d missing chunks (retry %d/%d)", len(missingChunks), retryCount+1, MaxRetries)
-
-		// 欠落チャンクリスト送信
-		err = sendMissingChunksList(handle, missingChunks)
+	// Step 5: チャンク受信ループ
+	lastChunk := time.Now()
+	started := false
+	for !received.Complete() {
+		chunk, err := tr.receiveChunk(sackInterval)
 		if err != nil {
-			return fmt.Errorf("failed to send missing chunks list: %v", err)
-		}
-
-		for len(missingChunks) > 0 {
-			// 欠落チャンクの受信
-			handle.Self.SubConn.SetReadDeadline(time.Now().Add(time.Second * MissingChunkTimeoutSeconds))
+			if errors.Is(err, errTransferTimeout) {
+				if time.Since(lastChunk) > peerTimeout {
+					tr.SendError(&ErrorPacketData{Error: "failed to receive chunk", Code: FaildReceive})
+					return fmt.Errorf("no chunk received for %d seconds (%d/%d chunks)", PeerTimeoutSeconds, received.Count(), indexData.ChunkCount)
+				}
 
-			chunk, err := receiveFileChunk(handle.Self.SubConn)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					break
+				// 開始の合図が落ちていたら送信側は待ったままなので送り直す
+				if !started {
+					tr.write(&startData)
 				}
 
-				handle.SendError(&ErrorPacketData{Error: "failed to receive missing chunk", Code: FaildReceive}, true)
+				// 何も届かない間も SACK を送り続け、末尾の欠落を再送してもらう
+				sendSack(tr, sack.Next())
+				if verifier != nil {
+					for _, segment := range verifier.Resending() {
+						sendResend(tr, verifier, segment)
+					}
+				}
+				continue
+			}
 
-				logrus.Debug(fmt.Sprintf("failed to receive missing chunk: %v", err))
+			return fmt.Errorf("failed to receive chunk: %v", err)
+		}
+		lastChunk = time.Now()
+		started = true
+		sendFeedback(tr, feedback, chunk)
+
+		var recovered []recoveredChunk
+		if chunk.Flags&ChunkParity != 0 {
+			// パリティチャンク: ブロックの欠落を再送無しで復元する
+			if fec == nil || crc32.ChecksumIEEE(chunk.Data) != chunk.Checksum {
 				continue
 			}
 
-			// チェックサム検証
-			expectedChecksum := crc32.ChecksumIEEE(chunk.Data)
-			if expectedChecksum != chunk.Checksum {
-				logrus.Warnf("Checksum mismatch for missing chunk %d", chunk.Index)
+			recovered, err = fec.OnParity(chunk)
+			if err != nil {
+				logrus.Warnf("Dropping parity chunk %d: %v", chunk.Index, err)
+				continue
+			}
+		} else {
+			raw, err := verifyChunk(codec, indexData, chunk)
+			if err != nil {
+				logrus.Warnf("Dropping chunk %d, will request again: %v", chunk.Index, err)
 				continue
 			}
 
-			// チャンクデータを保存
-			receivedChunks[chunk.Index] = chunk.Data
+			// 展開済みのデータを所定の位置に書き込み
+			err = store(chunk.Index, raw)
+			if err != nil {
+				tr.SendError(&ErrorPacketData{Error: "failed to write chunk", Code: FailedFileOperations})
+				return err
+			}
+			logrus.Debugf("Received chunk %d/%d", received.Count(), indexData.ChunkCount)
 
-			//チャンクマップの更新
-			// 欠落リストから削除
-			go ui.UpdateState(chunks, int(chunk.Index), true)
-			for i, missing := range missingChunks {
-				if missing == chunk.Index {
-					missingChunks = append(missingChunks[:i], missingChunks[i+1:]...)
-					break
+			if fec != nil {
+				recovered, err = fec.OnData(chunk.Index)
+				if err != nil {
+					logrus.Warnf("Failed to recover block of chunk %d: %v", chunk.Index, err)
 				}
 			}
-		}
 
-		retryCount++
-	}
-
-	// Step 7: 全チャンクを結合して展開
-	ui.ClearState(chunks)
-	logrus.Info("Reconstructing file from chunks...")
+			if sack.OnChunk(chunk.Index) {
+				sendSack(tr, sack.Next())
+			}
+		}
 
-	// 圧縮されたデータを結合
-	compressedData := make([]byte, 0, indexData.TotalSize)
-	for i := uint32(0); i < indexData.ChunkCount; i++ {
-		if chunkData, exists := receivedChunks[i]; exists {
-			compressedData = append(compressedData, chunkData...)
-		} else {
-			handle.SendError(&ErrorPacketData{Error: "failed to receive chunk", Code: FaildReceive}, true)
-			//retry
-			return fmt.Errorf("missing chunk %d after retry", i)
+		for _, r := range recovered {
+			err = store(r.Index, r.Data)
+			if err != nil {
+				tr.SendError(&ErrorPacketData{Error: "failed to write chunk", Code: FailedFileOperations})
+				return err
+			}
+			logrus.Debugf("Recovered chunk %d from parity", r.Index)
 		}
 	}
 
-	// 圧縮されたデータを展開
-	decompressedData, err := Decompress(compressedData, compMode)
-	if err != nil {
-		handle.SendError(&ErrorPacketData{Error: "failed to decompress", Code: FailedDeCompress}, true)
-		return fmt.Errorf("failed to decompress data: %v", err)
-	}
+	// 全て受信したことを知らせ、送信側の再送を止める
+	// 検証が終わって終了通知を送るまで SACK を送り続け、送信側に待ってもらう
+	final := sack.Next()
+	sendSack(tr, final)
+	stopKeepalive := keepTransferAlive(tr, final)
+	defer stopKeepalive()
 
-	// 展開されたデータをファイルに書き込み
-	_, err = file.Write(decompressedData)
-	if err != nil {
-		handle.SendError(&ErrorPacketData{Error: "failed to write decompressed data", Code: FailedFileOperations}, true)
-		return fmt.Errorf("failed to write decompressed data: %v", err)
-	}
+	ui.ClearState(chunks)
 
 	// Step 8: ファイル整合性チェック
 	file.Close()
-	receivedHash, err := calculateFileHash(outputPath)
+	hashPath := outputPath
+	if indexData.Delta {
+		// 古いファイルと差分から別のファイルに組み立て、検証できてから置き換える
+		hashPath = outputPath + deltaNewSuffix
+		defer os.Remove(hashPath)
+
+		err = applyDelta(outputPath, streamPath, hashPath, sigs, indexData.TargetSize)
+		if err != nil {
+			tr.SendError(&ErrorPacketData{Error: "failed to apply delta", Code: FailedFileOperations})
+			return fmt.Errorf("failed to apply delta: %v", err)
+		}
+	}
+
+	receivedHash, err := calculateFileHash(hashPath, indexData.HashAlgo)
 	if err != nil {
-		handle.SendError(&ErrorPacketData{Error: "failed to calculate file hash", Code: FailedCalcFileHash}, true)
+		tr.SendError(&ErrorPacketData{Error: "failed to calculate file hash", Code: FailedCalcFileHash})
 		return fmt.Errorf("failed to calculate file hash: %v", err)
 	}
 
 	if receivedHash != indexData.FileHash {
 		// 終了パケット送信（失敗）
 		finishData := BaseData{
-			Type: Message,
-			Data: FinishPacketData{
+			Type: Finish,
+			Data: &FinishPacketData{
 				Success: false,
 				Message: "File hash mismatch",
 			},
 		}
 
-		os.Remove(outputPath)
+		// どのチャンクが壊れているか分からないので、次回は全チャンクを受信し直す
+		received.Reset()
 
-		err = Write(handle.Self.SubConn, handle.Peer.SubAddr.StrAddr(), &finishData)
+		err = tr.write(&finishData)
 		if err != nil {
 			return fmt.Errorf("failed to send request: %v", err)
 		}
@@ -230,59 +634,162 @@ func GetFile(handle *Handle, args *ShellArgs) error {
 		return fmt.Errorf("file hash mismatch - expected: %s, got: %s", indexData.FileHash, receivedHash)
 	}
 
+	if indexData.Delta {
+		err = os.Rename(hashPath, outputPath)
+		if err != nil {
+			tr.SendError(&ErrorPacketData{Error: "failed to replace file", Code: FailedFileOperations})
+			return fmt.Errorf("failed to replace %s: %v", outputPath, err)
+		}
+	}
+
 	// Step 9: 終了パケット送信（成功）
 	finishData := BaseData{
-		Type: Message,
-		Data: FinishPacketData{
+		Type: Finish,
+		Data: &FinishPacketData{
 			Success: true,
 			Message: "File received successfully",
 		},
 	}
 
-	err = Write(handle.Self.SubConn, handle.Peer.SubAddr.StrAddr(), &finishData)
+	err = tr.write(&finishData)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %v", err)
 	}
 
+	finished = true
+	removePartial(outputPath)
+
 	logrus.Infof("File downloaded successfully: %s", outputPath)
 	return nil
 }
 
-func sendMissingChunksList(handle *Handle, missingChunks []uint32) error {
-	const maxChunksPerPacket = 135 // 1つのパケットで送信可能な最大チャンク数
+const progressInterval = 100 * time.Millisecond
 
-	// 分割パケット数を計算
-	totalPackets := (len(missingChunks) + maxChunksPerPacket - 1) / maxChunksPerPacket
+// progressMap はチャンクマップの再描画を間引く (毎チャンク描画すると受信が追いつかない)
+type progressMap struct {
+	chunks   [][8]bool
+	lastDraw time.Time
+}
 
-	for i := 0; i < totalPackets; i++ {
-		start := i * maxChunksPerPacket
-		end := start + maxChunksPerPacket
-		if end > len(missingChunks) {
-			end = len(missingChunks)
-		}
+func (p *progressMap) Set(index uint32) {
+	if time.Since(p.lastDraw) < progressInterval {
+		ui.SetChunkState(p.chunks, int(index), true)
+		return
+	}
 
-		// 分割されたチャンクリスト
-		chunkSlice := missingChunks[start:end]
+	ui.UpdateState(p.chunks, int(index), true)
+	p.lastDraw = time.Now()
+}
 
-		// 分割パケットデータ
-		packetData := MissingPacketData{
-			MissingChunks: chunkSlice,
-			PacketIndex:   uint32(i),
-			TotalPackets:  uint32(totalPackets),
-		}
+// sendFeedback は必要に応じて送信側へ受信状況を通知する
+func sendFeedback(tr *transfer, feedback *feedbackTracker, chunk *FileChunk) {
+	if !feedback.OnPacket(chunk.Seq) {
+		return
+	}
 
-		missingData := BaseData{
-			Type: PacketInfo,
-			Data: packetData,
-		}
+	err := tr.write(&BaseData{Type: Feedback, Data: feedback.Feedback()})
+	if err != nil {
+		logrus.Debugf("failed to send feedback: %v", err)
+	}
+}
 
-		err := Write(handle.Self.SubConn, handle.Peer.SubAddr.StrAddr(), &missingData)
-		if err != nil {
-			return fmt.Errorf("failed to send missing chunk packet %d/%d: %v", i+1, totalPackets, err)
+// sendResend は検証に失敗したセグメントを送り直してもらう
+func sendResend(tr *transfer, verifier *segmentVerifier, segment uint32) {
+	start, count := verifier.Range(segment)
+	err := tr.write(&BaseData{Type: Resend, Data: &ResendData{Start: start, Count: count}})
+	if err != nil {
+		logrus.Debugf("failed to send resend: %v", err)
+	}
+}
+
+// sendSack は受信状況を送信側へ送る
+func sendSack(tr *transfer, sack *SackData) {
+	err := tr.write(&BaseData{Type: Sack, Data: sack})
+	if err != nil {
+		logrus.Debugf("failed to send sack: %v", err)
+	}
+}
+
+// keepTransferAlive は返り値の関数が呼ばれるまで、最後の SACK を定期的に送り直す
+func keepTransferAlive(tr *transfer, final *SackData) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(keepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sendSack(tr, final)
+			case <-done:
+				return
+			}
 		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func markPartial(partial *partialTracker) {
+	if partial == nil {
+		return
+	}
+
+	err := partial.Mark()
+	if err != nil {
+		logrus.Warnf("Failed to save partial download state: %v", err)
+	}
+}
+
+// verifyChunk はチャンクのチェックサムと長さを検証し、展開済みのデータを返す
+func verifyChunk(codec *blockCodec, indexData *FileIndexData, chunk *FileChunk) ([]byte, error) {
+	if chunk.Index >= indexData.ChunkCount {
+		return nil, fmt.Errorf("chunk index out of range")
+	}
 
-		logrus.Debugf("Sent missing chunk packet %d/%d with %d chunks", i+1, totalPackets, len(chunkSlice))
+	// チェックサム検証
+	if crc32.ChecksumIEEE(chunk.Data) != chunk.Checksum {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+
+	raw, err := decodeChunk(codec, chunk, indexData.ChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %v", err)
+	}
+
+	// 最後のチャンク以外は ChunkSize ちょうどのはず
+	chunkSize := int64(indexData.ChunkSize)
+	expected := indexData.TotalSize - int64(chunk.Index)*chunkSize
+	if expected > chunkSize {
+		expected = chunkSize
+	}
+	if int64(len(raw)) != expected {
+		return nil, fmt.Errorf("unexpected chunk length: %d", len(raw))
+	}
+
+	return raw, nil
+}
+
+// writeChunk は展開済みのチャンクを Index*ChunkSize の位置に書き込む
+func writeChunk(file *os.File, chunkSize int, index uint32, raw []byte) error {
+	_, err := file.WriteAt(raw, int64(index)*int64(chunkSize))
+	if err != nil {
+		return fmt.Errorf("failed to write chunk %d: %v", index, err)
 	}
 
 	return nil
 }
+
+// decodeChunk はチャンクのフラグに従って展開済みのデータを返す
+func decodeChunk(codec *blockCodec, chunk *FileChunk, chunkSize int) ([]byte, error) {
+	if chunk.Flags&ChunkCompressed == 0 {
+		return chunk.Data, nil
+	}
+
+	return codec.Decompress(chunk.Data, chunkSize)
+}
@@ -0,0 +1,30 @@
+package core
+
+import "testing"
+
+func TestOutputCollision(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []getTarget
+		want    bool
+	}{
+		{"distinct", []getTarget{{"a/x.txt", "tray/x.txt"}, {"b/y.txt", "tray/y.txt"}}, false},
+		// get a/x.txt b/x.txt
+		{"same base name", []getTarget{{"a/x.txt", "tray/x.txt"}, {"b/x.txt", "tray/x.txt"}}, true},
+		// get x.txt '*/x.txt' で、パターンはトレイからの相対パスのまま保存する
+		{"pattern keeps directories", []getTarget{{"a/x.txt", "tray/x.txt"}, {"b/x.txt", "tray/b/x.txt"}}, false},
+		{"path and pattern", []getTarget{{"a/x.txt", "tray/x.txt"}, {"c/y.txt", "tray/c/y.txt"}, {"x.txt", "tray/x.txt"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, ok := outputCollision(tt.targets)
+			if ok != tt.want {
+				t.Fatalf("outputCollision() ok = %v, want %v", ok, tt.want)
+			}
+			if ok && (a.OutputPath != b.OutputPath || a.FilePath == b.FilePath) {
+				t.Errorf("outputCollision() = %+v, %+v", a, b)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package core
+
+import (
+	"path"
+	"strings"
+)
+
+// isGlob はパスにワイルドカードが含まれるか
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// matchGlob は "/" 区切りのパスを path.Match のパターンで照合する。"**" は0個以上のディレクトリに一致する
+func matchGlob(pattern, name string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				ok, err := matchSegments(pattern[1:], name[i:])
+				if ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(name) == 0 {
+			// 残りのパターンも書式だけは確認する
+			_, err := path.Match(pattern[0], "")
+			return false, err
+		}
+
+		ok, err := path.Match(pattern[0], name[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0, nil
+}
@@ -1,23 +1,69 @@
 package core
 
 import (
+	"QuickPort/qrcode"
 	"QuickPort/tray"
 	"fmt"
 	"os"
 	"text/tabwriter"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 func Host() (*Handle, error) {
 	// トークン生成側（サーバー側）
-	self, err := SetupPort()
+	self, err := setupHost()
 	if err != nil {
 		return nil, err
 	}
 
 	token := GenToken(self)
-	logrus.Info(fmt.Sprintf("Your token: %s", token))
+	logrus.Info(fmt.Sprintf("Your token: %s (valid until %s)", token, self.Expiry.Format("2006-01-02 15:04")))
+
+	// 別の端末やスマートフォンで読み取れるように QR コードでも表示する
+	code, err := qrcode.Render(TokenURI(token))
+	if err != nil {
+		logrus.Warn("Failed to render token as QR code:", err)
+	} else {
+		fmt.Print(code)
+	}
+
+	return hostSession(self)
+}
+
+// HostCode はトークンの代わりに短いペアリングコードを表示して接続を待つ
+func HostCode() (*Handle, error) {
+	self, err := setupHost()
+	if err != nil {
+		return nil, err
+	}
+
+	err = hostCode(self)
+	if err != nil {
+		return nil, err
+	}
+
+	return hostSession(self)
+}
+
+func setupHost() (*SelfConfig, error) {
+	self, err := SetupPort()
+	if err != nil {
+		return nil, err
+	}
+
+	// トークンを持っている相手だけが接続を要求できる
+	self.Secret, err = newTokenSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	self.Expiry = time.Now().Add(tokenLifetime)
+	return self, nil
+}
+
+func hostSession(self *SelfConfig) (*Handle, error) {
 	// 接続待ち
 	peer, err := SyncListener(self)
 	if err != nil {
@@ -40,6 +86,9 @@ func Host() (*Handle, error) {
 		return nil, err
 	}
 
+	// クライアント側が経路 MTU を調べるので応答する
+	peer.Datagram = AnswerMTUProbes(self, peer)
+
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
 	fmt.Fprintf(w, "filename\tsize\thash\n")
 	for _, t := range *tray {
@@ -47,5 +96,5 @@ func Host() (*Handle, error) {
 	}
 	w.Flush()
 
-	return &Handle{Self: self, Peer: peer}, nil
+	return &Handle{Self: self, Peer: peer, Limit: NewRateLimiter(0), PeerTray: *tray}, nil
 }
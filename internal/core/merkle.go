@@ -0,0 +1,359 @@
+package core
+
+import (
+	"QuickPort/tray"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// チャンクを merkleSegmentChunks 個ずつのセグメントに分け、セグメントのハッシュを葉とする Merkle 木の根を FileIndex に載せる
+// 受信側は開始前にセグメントのハッシュ一覧を受け取って根と照合し、揃ったセグメントから検証する
+// 壊れていたセグメントだけを Resend で送り直してもらう
+const (
+	merkleSegmentChunks = 256
+	// 受け付けるセグメントの大きさ。小さすぎるとハッシュ一覧が、大きすぎると検証の読み込みバッファが膨らむ
+	merkleMinSegmentChunks = 16
+	merkleMaxSegmentChunks = 1024
+	merkleHashSize         = sha256.Size
+	merkleLeafPrefix       = 0x00
+	merkleNodePrefix       = 0x01
+	segmentHashBurst       = 32 // 1回にまとめて求めるハッシュのページ数
+	maxSegmentRetries      = 5  // 同じセグメントを送り直してもらう回数の上限 (送信側のファイルが壊れていると何度でも失敗する)
+)
+
+// segmentHasher は書き込まれたデータを segmentSize ごとに区切ってハッシュする
+type segmentHasher struct {
+	segmentSize int64
+	written     int64
+	current     hash.Hash
+	hashes      [][]byte
+}
+
+func newSegmentHasher(segmentSize int64) *segmentHasher {
+	return &segmentHasher{segmentSize: segmentSize}
+}
+
+func (s *segmentHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if s.current == nil {
+			s.current = sha256.New()
+			s.current.Write([]byte{merkleLeafPrefix})
+		}
+
+		take := s.segmentSize - s.written
+		if take > int64(len(p)) {
+			take = int64(len(p))
+		}
+		s.current.Write(p[:take])
+		s.written += take
+		p = p[take:]
+
+		if s.written == s.segmentSize {
+			s.flush()
+		}
+	}
+
+	return n, nil
+}
+
+func (s *segmentHasher) flush() {
+	if s.current != nil {
+		s.hashes = append(s.hashes, s.current.Sum(nil))
+	}
+	s.current = nil
+	s.written = 0
+}
+
+// Hashes は最後の半端なセグメントも含めたハッシュ一覧を返す
+func (s *segmentHasher) Hashes() [][]byte {
+	s.flush()
+	return s.hashes
+}
+
+// hashSegment はセグメント1つ分のデータの葉のハッシュ
+func hashSegment(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// merkleRoot は葉から Merkle 木の根を計算する (奇数個の段では最後のノードをそのまま上げる)
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+
+			h := sha256.New()
+			h.Write([]byte{merkleNodePrefix})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+
+	return level[0]
+}
+
+// segmentCount は index のセグメント数
+func segmentCount(index *FileIndexData) uint32 {
+	return (index.ChunkCount + index.SegmentChunks - 1) / index.SegmentChunks
+}
+
+// segmentHashPage は Offset 番目からデータグラムに収まるだけのセグメントのハッシュを返す
+func segmentHashPage(peer *PeerConfig, hashes [][]byte, offset uint32) *SegmentHashData {
+	page := &SegmentHashData{Offset: offset}
+	if int(offset) >= len(hashes) {
+		return page
+	}
+
+	end := int(offset) + segmentHashesPerPage(peer)
+	if end > len(hashes) {
+		end = len(hashes)
+	}
+	for _, h := range hashes[offset:end] {
+		page.Hashes = append(page.Hashes, h...)
+	}
+
+	return page
+}
+
+// segmentHashesPerPage は1つのデータグラムに載せるハッシュの数 (データグラムの大きさはセッションで共通)
+func segmentHashesPerPage(peer *PeerConfig) int {
+	return (peer.ChunkSize() - 16) / merkleHashSize
+}
+
+// fetchSegmentHashes は送信側からセグメントのハッシュ一覧を受け取り、FileIndex の根と照合する
+// 届いていないページのリクエストを数ページ分まとめて送り、返ってきた順に受け取る
+func fetchSegmentHashes(tr *transfer, index *FileIndexData) ([][]byte, error) {
+	count := segmentCount(index)
+	hashes := make([][]byte, count)
+	received := newChunkBitmap(count)
+	perPage := uint32(segmentHashesPerPage(tr.handle.Peer))
+	lastReply := time.Now()
+	for !received.Complete() {
+		if time.Since(lastReply) > peerTimeout {
+			return nil, fmt.Errorf("failed to receive segment hashes: %v", errTransferTimeout)
+		}
+
+		requested := 0
+		for offset := received.FirstMissing(0); offset < count && requested < segmentHashBurst; offset = received.FirstMissing(offset + perPage) {
+			err := tr.write(&BaseData{Type: SegmentHashRequest, Data: &SegmentHashRequestData{Offset: offset}})
+			if err != nil {
+				return nil, fmt.Errorf("failed to request segment hashes: %v", err)
+			}
+			requested++
+		}
+
+		// 求めた分が揃うか、途中のページが落ちて時間切れになったら、残りを求め直す
+		// 送信側は FileIndex を再送してくるので、待ち時間はフレームごとではなく1回分で数える
+		deadline := time.Now().Add(manifestRetryInterval)
+		for requested > 0 && time.Now().Before(deadline) {
+			meta, err := tr.receiveFrame(time.Until(deadline))
+			if err != nil {
+				if errors.Is(err, errTransferTimeout) && time.Since(lastReply) < peerTimeout {
+					break
+				}
+				return nil, fmt.Errorf("failed to receive segment hashes: %v", err)
+			}
+
+			page, ok := meta.Data.(*SegmentHashData)
+			if !ok || page.Offset >= count {
+				continue
+			}
+			if len(page.Hashes) == 0 {
+				return nil, fmt.Errorf("peer sent an empty segment hash page")
+			}
+			lastReply = time.Now()
+			requested--
+
+			segment := page.Offset
+			for i := 0; i+merkleHashSize <= len(page.Hashes) && segment < count; i += merkleHashSize {
+				if received.Set(segment) {
+					hashes[segment] = page.Hashes[i : i+merkleHashSize]
+				}
+				segment++
+			}
+		}
+	}
+
+	if !bytes.Equal(merkleRoot(hashes), index.MerkleRoot) {
+		return nil, fmt.Errorf("segment hashes do not match the merkle root")
+	}
+
+	return hashes, nil
+}
+
+// segmentVerifier は受信側でセグメントが揃うたびにハッシュを検証する
+type segmentVerifier struct {
+	index   *FileIndexData
+	hashes  [][]byte
+	pending []uint32        // セグメントごとの未受信チャンク数
+	resend  map[uint32]bool // 送り直してもらっているセグメント
+	retries map[uint32]int  // セグメントごとの送り直しの回数
+	buf     []byte
+}
+
+func newSegmentVerifier(index *FileIndexData, hashes [][]byte, received *chunkBitmap) *segmentVerifier {
+	v := &segmentVerifier{
+		index:   index,
+		hashes:  hashes,
+		pending: make([]uint32, len(hashes)),
+		resend:  make(map[uint32]bool),
+		retries: make(map[uint32]int),
+	}
+	for segment := range v.pending {
+		start, count := v.Range(uint32(segment))
+		for i := start; i < start+count; i++ {
+			if !received.Has(i) {
+				v.pending[segment]++
+			}
+		}
+	}
+
+	return v
+}
+
+// Range はセグメントのチャンクの範囲
+func (v *segmentVerifier) Range(segment uint32) (uint32, uint32) {
+	start := segment * v.index.SegmentChunks
+	count := v.index.SegmentChunks
+	if start+count > v.index.ChunkCount {
+		count = v.index.ChunkCount - start
+	}
+
+	return start, count
+}
+
+// OnReceived は新しく受信したチャンクを記録し、セグメントが揃ったら検証する
+// 壊れていたらそのセグメントを返す (呼び出し側で受信済みから外し、Resend を送る)
+func (v *segmentVerifier) OnReceived(file io.ReaderAt, index uint32) (uint32, bool, error) {
+	segment := index / v.index.SegmentChunks
+	v.pending[segment]--
+	if v.pending[segment] > 0 {
+		return 0, false, nil
+	}
+
+	ok, err := v.verify(file, segment)
+	if err != nil || ok {
+		return 0, false, err
+	}
+
+	return segment, true, nil
+}
+
+// VerifyReceived は再開時に受信済みのセグメントを検証し、壊れていたものを未受信に戻す (戻した数を返す)
+func (v *segmentVerifier) VerifyReceived(file io.ReaderAt, received *chunkBitmap) (int, error) {
+	bad := 0
+	for segment, pending := range v.pending {
+		if pending > 0 {
+			continue
+		}
+
+		ok, err := v.verify(file, uint32(segment))
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			v.clear(uint32(segment), received)
+			bad++
+		}
+	}
+
+	return bad, nil
+}
+
+// Reject は転送中に壊れていたセグメントを未受信に戻し、送り直しを待つ
+// 上限まで送り直しても壊れている場合はエラー
+func (v *segmentVerifier) Reject(segment uint32, received *chunkBitmap) error {
+	v.clear(segment, received)
+	v.retries[segment]++
+	if v.retries[segment] > maxSegmentRetries {
+		start, count := v.Range(segment)
+		return fmt.Errorf("segment %d (chunks %d-%d) failed verification %d times", segment, start, start+count-1, v.retries[segment])
+	}
+
+	v.resend[segment] = true
+	return nil
+}
+
+func (v *segmentVerifier) clear(segment uint32, received *chunkBitmap) {
+	start, count := v.Range(segment)
+	for i := start; i < start+count; i++ {
+		received.Clear(i)
+	}
+	v.pending[segment] = count
+}
+
+// Resending は送り直しを待っているセグメント (Resend が落ちた場合に送り直す)
+func (v *segmentVerifier) Resending() []uint32 {
+	segments := []uint32{}
+	for segment := range v.resend {
+		segments = append(segments, segment)
+	}
+
+	return segments
+}
+
+func (v *segmentVerifier) verify(file io.ReaderAt, segment uint32) (bool, error) {
+	start, count := v.Range(segment)
+	chunkSize := int64(v.index.ChunkSize)
+	offset := int64(start) * chunkSize
+	size := int64(count) * chunkSize
+	if offset+size > v.index.TotalSize {
+		size = v.index.TotalSize - offset
+	}
+
+	if int64(cap(v.buf)) < size {
+		v.buf = make([]byte, size)
+	}
+	data := v.buf[:size]
+	_, err := file.ReadAt(data, offset)
+	if err != nil {
+		return false, fmt.Errorf("failed to read segment %d: %v", segment, err)
+	}
+
+	if !bytes.Equal(hashSegment(data), v.hashes[segment]) {
+		logrus.Warnf("Segment %d (chunks %d-%d) failed verification, requesting it again", segment, start, start+count-1)
+		return false, nil
+	}
+
+	delete(v.resend, segment)
+	return true, nil
+}
+
+// hashFileSegments は algorithm のファイルハッシュとセグメントのハッシュを1回の読み込みで計算する
+func hashFileSegments(path string, algorithm string, segmentSize int64) (string, [][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	segments := newSegmentHasher(segmentSize)
+	fileHash, err := tray.HashReader(io.TeeReader(file, segments), algorithm)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return fileHash, segments.Hashes(), nil
+}
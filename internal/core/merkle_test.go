@@ -0,0 +1,56 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSegmentVerifierRetryLimit(t *testing.T) {
+	const chunkSize, segmentChunks = 4, 16
+	data := bytes.Repeat([]byte{0xaa}, chunkSize*segmentChunks*2)
+	index := &FileIndexData{TotalSize: int64(len(data)), ChunkCount: segmentChunks * 2, ChunkSize: chunkSize, SegmentChunks: segmentChunks}
+
+	// 2つ目のセグメントだけ、送信側が常に違う内容を送ってくる
+	hashes := [][]byte{hashSegment(data[:chunkSize*segmentChunks]), hashSegment(nil)}
+	received := newChunkBitmap(index.ChunkCount)
+	verifier := newSegmentVerifier(index, hashes, received)
+	file := bytes.NewReader(data)
+
+	receiveSegment := func(segment uint32) (bool, error) {
+		start, count := verifier.Range(segment)
+		bad := false
+		for i := start; i < start+count; i++ {
+			received.Set(i)
+			s, b, err := verifier.OnReceived(file, i)
+			if err != nil {
+				t.Fatalf("OnReceived: %v", err)
+			}
+			if b {
+				if s != segment {
+					t.Fatalf("segment %d reported bad, want %d", s, segment)
+				}
+				bad = true
+			}
+		}
+		if !bad {
+			return false, nil
+		}
+		return true, verifier.Reject(segment, received)
+	}
+
+	if bad, _ := receiveSegment(0); bad {
+		t.Fatal("intact segment failed verification")
+	}
+	for try := 1; try <= maxSegmentRetries; try++ {
+		bad, err := receiveSegment(1)
+		if !bad || err != nil {
+			t.Fatalf("try %d: bad = %v, err = %v", try, bad, err)
+		}
+		if received.Has(segmentChunks) {
+			t.Fatalf("try %d: rejected segment still marked received", try)
+		}
+	}
+	if _, err := receiveSegment(1); err == nil {
+		t.Fatalf("segment accepted a retry after %d failures", maxSegmentRetries)
+	}
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// packetMux はソケットごとに1つの goroutine で読み、届いたパケットを購読者へ振り分ける
+// 単一ポートモードでは Conn だけを読み、チャンネルバイトで制御とデータに分ける
+// 開いている転送宛てのパケットはその転送へ、それ以外は種類ごとのハンドラー (FileReqest, Ping など) へ渡す
+// 開始後は Conn/SubConn を直接読まないこと
+type packetMux struct {
+	once      sync.Once
+	mu        sync.Mutex
+	handlers  map[dataType]func(*BaseData)
+	transfers map[uint32]*transfer
+	outputs   map[string]bool // 受信中の出力先
+	downloads map[uint32]bool // 受信中の転送 (limit で帯域上限を変える対象)
+}
+
+// startMux は初回だけ読み取り goroutine を起動する
+func (h *Handle) startMux() *packetMux {
+	m := &h.mux
+	m.once.Do(func() {
+		m.mu.Lock()
+		if m.handlers == nil {
+			m.handlers = make(map[dataType]func(*BaseData))
+		}
+		m.transfers = make(map[uint32]*transfer)
+		m.outputs = make(map[string]bool)
+		m.downloads = make(map[uint32]bool)
+		m.mu.Unlock()
+
+		h.Self.SubConn.SetReadBuffer(receiveBufferSize)
+		if h.Peer.Caps.Has(CapSinglePort) {
+			go h.readLoop(h.Self.Conn, h.Peer.Addr, h.onSharedPacket)
+		} else {
+			go h.readLoop(h.Self.Conn, h.Peer.Addr, func(raw []byte) { h.onChannelPacket(false, raw) })
+			go h.readLoop(h.Self.SubConn, h.Peer.SubAddr, func(raw []byte) { h.onChannelPacket(true, raw) })
+		}
+	})
+
+	return m
+}
+
+// subscribe は t のパケットを fn で受け取る (fn は読み取り goroutine で呼ばれるので重い処理はしない)
+func (h *Handle) subscribe(t dataType, fn func(*BaseData)) {
+	m := &h.mux
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.handlers == nil {
+		m.handlers = make(map[dataType]func(*BaseData))
+	}
+	m.handlers[t] = fn
+}
+
+// readLoop は conn から相手のパケットを読み続けて onPacket に渡す (raw は次の読み取りで上書きされる)
+func (h *Handle) readLoop(conn *net.UDPConn, from *Address, onPacket func(raw []byte)) {
+	buf := make([]byte, maxFrameSize)
+	for {
+		n, peerAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			logrus.Debugf("read error: %v", err)
+			continue
+		}
+
+		if peerAddr.IP.String() != from.Ip.String() || peerAddr.Port != from.Port {
+			continue
+		}
+
+		onPacket(buf[:n])
+	}
+}
+
+// onSharedPacket は単一ポートモードのパケットをチャンネルバイトで制御とデータに分ける
+func (h *Handle) onSharedPacket(raw []byte) {
+	if len(raw) < 1 {
+		return
+	}
+
+	switch raw[0] {
+	case channelControl:
+		h.onChannelPacket(false, raw)
+	case channelData:
+		h.onChannelPacket(true, raw)
+	default:
+		logrus.Debugf("Ignoring packet on unknown channel %d", raw[0])
+	}
+}
+
+// onChannelPacket はパケットを復号して制御かデータのチャンネルへ渡す
+func (h *Handle) onChannelPacket(useSub bool, raw []byte) {
+	raw, ok := openRaw(h.Peer, useSub, raw)
+	if !ok {
+		logrus.Debug("Dropping packet that failed authentication")
+		return
+	}
+
+	if useSub {
+		h.onDataPacket(raw)
+	} else {
+		h.onControlPacket(raw)
+	}
+}
+
+// onControlPacket は制御チャンネルのフレームを振り分ける
+func (h *Handle) onControlPacket(raw []byte) {
+	// フレームのペイロードは raw を参照するのでコピーしてから渡す
+	meta, err := decodeFrame(append([]byte(nil), raw...))
+	if err != nil {
+		logrus.Debugf("Decode Error: %s", err.Error())
+		return
+	}
+
+	h.dispatch(meta)
+}
+
+// onDataPacket はデータチャンネルのチャンクと制御パケットを振り分ける
+// 終わった転送や知らない転送のパケットは捨てる
+func (h *Handle) onDataPacket(raw []byte) {
+	if len(raw) < 2 || string(raw[0:2]) != chunkMagic {
+		h.onControlPacket(raw)
+		return
+	}
+
+	chunk, err := parseChunk(raw)
+	if err != nil {
+		logrus.Debugf("Dropping chunk: %v", err)
+		return
+	}
+
+	t := h.lookupTransfer(chunk.Transfer)
+	if t == nil {
+		return
+	}
+
+	select {
+	case t.chunks <- chunk:
+	default:
+	}
+}
+
+// dispatch は制御パケットを転送か種類のハンドラーへ渡す
+// put の受け入れ (FileReqest) のように、こちらが開いた転送宛てならハンドラーより転送を優先する
+func (h *Handle) dispatch(meta *BaseData) {
+	h.mux.mu.Lock()
+	fn := h.mux.handlers[meta.Type]
+	t := h.mux.transfers[meta.Transfer]
+	h.mux.mu.Unlock()
+
+	if t == nil {
+		if fn != nil {
+			fn(meta)
+			return
+		}
+
+		logrus.Debugf("Ignoring packet type %d for unknown transfer %d", meta.Type, meta.Transfer)
+		return
+	}
+
+	select {
+	case t.frames <- meta:
+	default:
+		logrus.Debugf("Dropping packet type %d: transfer %d is busy", meta.Type, meta.Transfer)
+	}
+}
+
+func (h *Handle) lookupTransfer(id uint32) *transfer {
+	h.mux.mu.Lock()
+	defer h.mux.mu.Unlock()
+
+	return h.mux.transfers[id]
+}
@@ -2,7 +2,6 @@ package core
 
 import (
 	"QuickPort/utils"
-	"encoding/json"
 	"fmt"
 	"net"
 
@@ -10,8 +9,97 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// 単一ポートモードでは制御とデータを Conn だけで送り、認証後のパケットの先頭に付けたチャンネルバイトで区別する
+const (
+	channelControl byte = 'C'
+	channelData    byte = 'D'
+)
+
+func channelOf(useSub bool) byte {
+	if useSub {
+		return channelData
+	}
+
+	return channelControl
+}
+
+// packetOverhead は認証後のパケットに付くチャンネルバイトと暗号化の大きさ
+func (p *PeerConfig) packetOverhead() int {
+	overhead := 0
+	if p.Caps.Has(CapSinglePort) {
+		overhead++
+	}
+	if p.session != nil {
+		overhead += sessionOverhead
+	}
+
+	return overhead
+}
+
+// useSinglePort は単一ポートモードで合意した場合、SubConn を閉じて Conn を制御とデータで共有する
+func useSinglePort(self *SelfConfig, peer *PeerConfig) {
+	if !peer.Caps.Has(CapSinglePort) {
+		return
+	}
+
+	self.SubConn.Close()
+	self.SubConn = self.Conn
+	self.SubAddr = self.Addr
+	peer.SubAddr = peer.Addr
+	logrus.Info("Using a single port for control and data")
+}
+
+// sendFrame は認証後のフレームを制御 (useSub=false) かデータ (useSub=true) のチャンネルで送る
+func sendFrame(self *SelfConfig, peer *PeerConfig, useSub bool, data *BaseData) error {
+	raw, err := encodeFrame(data, peer.Version)
+	if err != nil {
+		return err
+	}
+
+	return sendRaw(self, peer, useSub, raw)
+}
+
+// sendRaw は暗号化し、単一ポートモードならチャンネルバイトを付けて送る
+func sendRaw(self *SelfConfig, peer *PeerConfig, useSub bool, raw []byte) error {
+	conn, addr := self.Conn, peer.Addr
+	if useSub {
+		conn, addr = self.SubConn, peer.SubAddr
+	}
+
+	channel := channelOf(useSub)
+	packet := make([]byte, 0, len(raw)+peer.packetOverhead())
+	if peer.Caps.Has(CapSinglePort) {
+		packet = append(packet, channel)
+	}
+	if peer.session != nil {
+		packet = peer.session.Seal(packet, channel, raw)
+	} else {
+		packet = append(packet, raw...)
+	}
+
+	_, err := conn.WriteToUDP(packet, &net.UDPAddr{IP: addr.Ip, Port: addr.Port})
+	return err
+}
+
+// openRaw は受信したパケットからチャンネルバイトを取り除いて復号する (raw を書き換える)
+// 別のチャンネルのものや、改ざん・再送されたものなら false
+func openRaw(peer *PeerConfig, useSub bool, raw []byte) ([]byte, bool) {
+	if peer.Caps.Has(CapSinglePort) {
+		if len(raw) < 1 || raw[0] != channelOf(useSub) {
+			return nil, false
+		}
+		raw = raw[1:]
+	}
+
+	if peer.session == nil {
+		return raw, true
+	}
+
+	return peer.session.Open(channelOf(useSub), raw)
+}
+
 func receiveFromPeer(self *SelfConfig, peer *PeerConfig, useSub bool) (*BaseData, error) {
-	buf := make([]byte, 1024)
+	buf := make([]byte, maxFrameSize)
 	conn := self.Conn
 	if useSub {
 		conn = self.SubConn
@@ -39,21 +127,22 @@ func receiveFromPeer(self *SelfConfig, peer *PeerConfig, useSub bool) (*BaseData
 			}
 		}
 
-		var meta BaseData
-		err = json.Unmarshal(buf[:n], &meta)
+		raw, ok := openRaw(peer, useSub, buf[:n])
+		if !ok {
+			continue
+		}
+
+		meta, err := decodeFrame(raw)
 		if err != nil {
 			return nil, err
 		}
 
 		if meta.Type == Error {
-			errpacket, err := convertMapToErrorPacketData(meta.Data)
-			if err != nil {
-				return nil, err
-			}
-			return nil, fmt.Errorf("peer error: %s", errpacket.Error)
+			errpacket := meta.Data.(*ErrorPacketData)
+			return nil, &PeerError{Code: errpacket.Code, Message: errpacket.Error}
 		}
 
-		return &meta, nil
+		return meta, nil
 	}
 }
 
@@ -195,7 +284,7 @@ func Write(conn *net.UDPConn, targetAddr string, data *BaseData) error {
 		return err
 	}
 
-	raw, err := json.Marshal(data)
+	raw, err := encodeFrame(data, ProtocolVersion)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,348 @@
+package core
+
+import (
+	"QuickPort/rendezvous"
+	"QuickPort/utils"
+	"bufio"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ペアリングコード ("7-guitar-orbit") による接続
+// host と client は待ち合わせサーバーで合流し、コードを元に CPace で共有の鍵を作る
+// その鍵で確認の MAC を交換してから、host は暗号化したトークンを client に渡す
+// 以降はトークンで接続するときと同じく、相手に直接 Sync する
+const (
+	pairingWordCount = 3 // 24 ビット。外れたら host はそこで打ち切るので、なりすましが当たるのは 1/2^24
+	pairingSIDSize   = 16
+	pairingTimeout   = 30 * time.Second
+	pairingKeyInfo   = "QuickPort pairing"
+	maxPairingMsg    = 1024
+)
+
+var (
+	errInvalidCode = errors.New("invalid code")
+	errWrongCode   = errors.New("wrong code")
+)
+
+// newPairingCode は nameplate に続けてランダムな単語を並べたコードを作る
+func newPairingCode(nameplate int) (string, error) {
+	random := make([]byte, pairingWordCount)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	parts := []string{strconv.Itoa(nameplate)}
+	for _, b := range random {
+		parts = append(parts, pairingWords[b])
+	}
+
+	return strings.Join(parts, "-"), nil
+}
+
+// parsePairingCode はコードを読み、nameplate と正規化したコードを返す (大文字小文字と前後の空白は無視する)
+func parsePairingCode(code string) (int, string, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(code)), "-")
+	if len(parts) != pairingWordCount+1 {
+		return 0, "", errInvalidCode
+	}
+
+	nameplate, err := strconv.Atoi(parts[0])
+	if err != nil || nameplate <= 0 {
+		return 0, "", errInvalidCode
+	}
+
+	for _, word := range parts[1:] {
+		if !isPairingWord(word) {
+			return 0, "", fmt.Errorf("%w: unknown word %q", errInvalidCode, word)
+		}
+	}
+
+	return nameplate, strings.Join(parts, "-"), nil
+}
+
+func isPairingWord(word string) bool {
+	for _, w := range pairingWords {
+		if w == word {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pairingKeys は ISK から導く鍵
+type pairingKeys struct {
+	confirmHost   []byte
+	confirmClient []byte
+	seal          []byte
+}
+
+func newPairingKeys(isk []byte) (*pairingKeys, error) {
+	keys, err := hkdf.Key(sha256.New, isk, nil, pairingKeyInfo, 3*sessionKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pairingKeys{
+		confirmHost:   keys[:sessionKeySize],
+		confirmClient: keys[sessionKeySize : 2*sessionKeySize],
+		seal:          keys[2*sessionKeySize:],
+	}, nil
+}
+
+// confirm は同じ鍵を持っていることを示す MAC
+func confirm(key, ya, yb []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ya)
+	mac.Write(yb)
+	return mac.Sum(nil)
+}
+
+// pairHost はコードを知っている相手にだけトークンを渡す
+func pairHost(conn net.Conn, reader *bufio.Reader, code string, token string) error {
+	nameplate, prs, err := parsePairingCode(code)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(pairingTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	sid := make([]byte, pairingSIDSize)
+	_, err = rand.Read(sid)
+	if err != nil {
+		return err
+	}
+
+	c, err := newCPace([]byte(prs), pairingCI(nameplate), sid)
+	if err != nil {
+		return err
+	}
+	ya := c.Share()
+
+	err = writePairingMsg(conn, append(append([]byte(nil), sid...), ya...))
+	if err != nil {
+		return err
+	}
+
+	// [Yb:32][Tb:32]
+	msg, err := readPairingMsg(reader)
+	if err != nil {
+		return err
+	}
+	if len(msg) != cpaceElementSize+sha256.Size {
+		return errCPaceInvalid
+	}
+	yb, tb := msg[:cpaceElementSize], msg[cpaceElementSize:]
+
+	isk, err := c.Finish(yb, ya, yb)
+	if err != nil {
+		return err
+	}
+	keys, err := newPairingKeys(isk)
+	if err != nil {
+		return err
+	}
+
+	// コードが違えば相手の MAC は合わない (ここで打ち切るので、試せるのは1回だけ)
+	if !hmac.Equal(tb, confirm(keys.confirmClient, ya, yb)) {
+		return errWrongCode
+	}
+
+	gcm, err := newGCM(keys.seal)
+	if err != nil {
+		return err
+	}
+	// 鍵は1回しか使わないのでノンスは固定でよい
+	nonce := make([]byte, gcm.NonceSize())
+	reply := confirm(keys.confirmHost, ya, yb)
+	reply = gcm.Seal(reply, nonce, []byte(token), nil)
+
+	return writePairingMsg(conn, reply)
+}
+
+// pairClient はコードで host と鍵を共有し、トークンを受け取る
+func pairClient(conn net.Conn, reader *bufio.Reader, code string) (*PeerConfig, error) {
+	nameplate, prs, err := parsePairingCode(code)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(pairingTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// [SID:16][Ya:32]
+	msg, err := readPairingMsg(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) != pairingSIDSize+cpaceElementSize {
+		return nil, errCPaceInvalid
+	}
+	sid, ya := msg[:pairingSIDSize], msg[pairingSIDSize:]
+
+	c, err := newCPace([]byte(prs), pairingCI(nameplate), sid)
+	if err != nil {
+		return nil, err
+	}
+	yb := c.Share()
+
+	isk, err := c.Finish(ya, ya, yb)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newPairingKeys(isk)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writePairingMsg(conn, append(append([]byte(nil), yb...), confirm(keys.confirmClient, ya, yb)...))
+	if err != nil {
+		return nil, err
+	}
+
+	// [Ta:32][暗号化したトークン]。コードが違えば host は何も返さずに切断する
+	msg, err = readPairingMsg(reader)
+	if err != nil {
+		return nil, errWrongCode
+	}
+	if len(msg) < sha256.Size || !hmac.Equal(msg[:sha256.Size], confirm(keys.confirmHost, ya, yb)) {
+		return nil, errWrongCode
+	}
+
+	gcm, err := newGCM(keys.seal)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	token, err := gcm.Open(nil, nonce, msg[sha256.Size:], nil)
+	if err != nil {
+		return nil, errWrongCode
+	}
+
+	return ParseToken(string(token))
+}
+
+// pairingCI は CPace の接続の識別子 (同じ nameplate の両端だけが一致する)
+func pairingCI(nameplate int) []byte {
+	return []byte(fmt.Sprintf("QuickPort/%d", nameplate))
+}
+
+// ペアリングのメッセージは [Len:2][Payload]
+func writePairingMsg(w io.Writer, payload []byte) error {
+	msg := binary.LittleEndian.AppendUint16(nil, uint16(len(payload)))
+	_, err := w.Write(append(msg, payload...))
+	return err
+}
+
+func readPairingMsg(r io.Reader) ([]byte, error) {
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+
+	n := int(binary.LittleEndian.Uint16(head[:]))
+	if n > maxPairingMsg {
+		return nil, fmt.Errorf("pairing message too large: %d", n)
+	}
+
+	payload := make([]byte, n)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// hostCode はペアリングコードを表示し、コードを入力した相手にトークンを渡す
+// コードを間違えられたら待ち直さずに打ち切る (何度でも試せると総当たりされる)
+func hostCode(self *SelfConfig) error {
+	addr, err := rendezvousAddr()
+	if err != nil {
+		return err
+	}
+
+	conn, reader, nameplate, err := rendezvous.Allocate(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	code, err := newPairingCode(nameplate)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Your code: %s", code)
+	err = rendezvous.Wait(reader)
+	if err != nil {
+		return err
+	}
+
+	err = pairHost(conn, reader, code, GenToken(self))
+	if errors.Is(err, errWrongCode) {
+		return fmt.Errorf("peer entered a wrong code, start again to get a new code")
+	}
+
+	return err
+}
+
+// joinCode はコードで host と合流し、トークンの中身を受け取る
+func joinCode(code string) (*PeerConfig, error) {
+	nameplate, _, err := parsePairingCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := rendezvousAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, reader, err := rendezvous.Join(addr, nameplate)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return pairClient(conn, reader, code)
+}
+
+// rendezvousAddr は待ち合わせサーバーのアドレスを環境変数から読み、無ければ尋ねる
+func rendezvousAddr() (string, error) {
+	addr := rendezvous.Addr()
+	if addr == "" {
+		tty, err := utils.UseTty()
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Printf("Rendezvous server (host[:port], or set %s): ", rendezvous.EnvAddr)
+		text, err := tty.ReadString()
+		if err != nil {
+			return "", err
+		}
+
+		addr = rendezvous.WithPort(text)
+		if addr == "" {
+			return "", fmt.Errorf("no rendezvous server: enter one or set %s", rendezvous.EnvAddr)
+		}
+	}
+
+	logrus.Infof("Using rendezvous server %s", addr)
+	return addr, nil
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"QuickPort/tray"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	partialSuffix        = tray.PartialSuffix
+	partialSaveInterval  = time.Second
+	partialSaveThreshold = 1024 // この数だけ新しいチャンクが届いたら保存する
+)
+
+// partialDownload は途中までダウンロードしたファイルの状態 (サイドカーファイルに保存する)
+type partialDownload struct {
+	Index    FileIndexData `json:"index"`
+	Received []byte        `json:"received"` // 受信済みチャンクのビットマップ
+}
+
+// partialTracker は受信状況をサイドカーファイルへ定期的に書き出す
+type partialTracker struct {
+	path     string
+	dataPath string // 受信中のファイル本体
+	index    *FileIndexData
+	received *chunkBitmap
+	lastSave time.Time
+	unsaved  int
+}
+
+func partialPath(outputPath string) string {
+	return outputPath + partialSuffix
+}
+
+// loadPartial は outputPath に対応するサイドカーを読み込む。存在しなければ nil を返す
+func loadPartial(outputPath string) (*FileIndexData, *chunkBitmap, error) {
+	raw, err := os.ReadFile(partialPath(outputPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	var partial partialDownload
+	err = json.Unmarshal(raw, &partial)
+	if err != nil {
+		return nil, nil, fmt.Errorf("broken partial download state: %v", err)
+	}
+
+	// 出力ファイル本体が無い、またはサイズが合わない場合は使えない
+	info, err := os.Stat(outputPath)
+	if err != nil || info.Size() != partial.Index.TotalSize {
+		return nil, nil, fmt.Errorf("partial download data is missing or truncated")
+	}
+
+	received, err := chunkBitmapFromBytes(partial.Index.ChunkCount, partial.Received)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &partial.Index, received, nil
+}
+
+// isWorkFile は受信途中の作業用ファイルか (一覧や glob の対象にしない)
+func isWorkFile(name string) bool {
+	return tray.IsWorkFile(name)
+}
+
+func removePartial(outputPath string) {
+	os.Remove(partialPath(outputPath))
+}
+
+func newPartialTracker(outputPath string, index *FileIndexData, received *chunkBitmap) *partialTracker {
+	return &partialTracker{
+		path:     partialPath(outputPath),
+		dataPath: outputPath,
+		index:    index,
+		received: received,
+	}
+}
+
+// Save はサイドカーを書き出す (一時ファイルに書いてから置き換える)
+// 先にファイル本体をディスクへ書き出し、電源が落ちてもディスクに無いチャンクを受信済みとして残さない
+func (p *partialTracker) Save() error {
+	err := syncFile(p.dataPath)
+	if err != nil {
+		return fmt.Errorf("failed to flush received data: %v", err)
+	}
+
+	raw, err := json.Marshal(partialDownload{
+		Index:    *p.index,
+		Received: p.received.Bytes(),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := p.path + tray.TempSuffix
+	err = os.WriteFile(tmp, raw, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, p.path)
+	if err != nil {
+		return err
+	}
+
+	p.lastSave = time.Now()
+	p.unsaved = 0
+	return nil
+}
+
+// Mark はチャンク受信を記録し、一定間隔ごとにサイドカーを更新する
+func (p *partialTracker) Mark() error {
+	p.unsaved++
+	if p.unsaved < partialSaveThreshold && time.Since(p.lastSave) < partialSaveInterval {
+		return nil
+	}
+
+	return p.Save()
+}
+
+// syncFile は path の内容をディスクへ書き出す (受信中に閉じられていてもよいように開き直す)
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
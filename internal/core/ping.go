@@ -15,23 +15,10 @@ var (
 )
 
 func (h *Handle) Ping() {
-	isPause := false
 	for {
-		select {
-		case p, ok := <-h.Pause:
-			if ok {
-				isPause = p
-				continue
-			}
-		default:
-			if isPause {
-				continue
-			}
+		sendFrame(h.Self, h.Peer, false, &BaseData{Type: Ping, Data: &PingData{}})
 
-			Write(h.Self.Conn, h.Peer.Addr.StrAddr(), &BaseData{Type: Ping})
-
-			time.Sleep(5 * time.Second)
-		}
+		time.Sleep(5 * time.Second)
 	}
 }
 
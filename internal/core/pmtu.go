@@ -0,0 +1,227 @@
+package core
+
+import (
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 経路 MTU の探索
+// DF を立てた大きさの違うプローブを送り、相手に届いた最大のものをセッションのデータグラムサイズにする
+const (
+	defaultDatagramSize = ChunkSize + chunkHeaderSize // 探索できなかった場合
+	minDatagramSize     = 1200                        // これより小さい経路は想定しない
+	maxDatagramSize     = 9000 - ipv4Overhead         // ジャンボフレーム
+
+	ipv4Overhead = 20 + 8 // IP + UDP ヘッダー
+	ipv6Overhead = 40 + 8
+
+	probeAttempts      = 3
+	probeInterval      = 50 * time.Millisecond
+	probeWait          = 300 * time.Millisecond
+	probeAnswerTimeout = 5 * time.Second
+	probeOverhead      = frameHeaderSize + 4 // パディング長
+)
+
+// よく使われるリンクの MTU (ジャンボフレーム, Ethernet, PPPoE, VPN など)
+var probeMTUs = []int{9000, 1500, 1492, 1480, 1460, 1420, 1400, 1380, 1280}
+
+// ChunkSize はこのセッションで1チャンクに載せられるデータ量
+func (p *PeerConfig) ChunkSize() int {
+	return datagramChunkSize(p, p.Datagram)
+}
+
+func datagramChunkSize(peer *PeerConfig, datagram int) int {
+	if datagram <= 0 {
+		datagram = defaultDatagramSize
+	}
+
+	return datagram - chunkHeaderSize - peer.packetOverhead()
+}
+
+// ProbeMTU は相手にプローブを送って使えるデータグラムサイズを調べ、結果を相手にも伝える
+// 相手は AnswerMTUProbes で応答する
+func ProbeMTU(self *SelfConfig, peer *PeerConfig) int {
+	err := setDontFragment(self.SubConn)
+	if err != nil {
+		logrus.Debugf("Skipping path MTU discovery: %v", err)
+		sendPathMTU(self, peer, defaultDatagramSize)
+		return defaultDatagramSize
+	}
+
+	candidates := probeCandidates(self, peer)
+	acked := make(map[int]bool)
+	for attempt := 0; attempt < probeAttempts; attempt++ {
+		for _, size := range candidates {
+			if acked[size] {
+				continue
+			}
+
+			// 手元の MTU を超えるものは送信時にエラーになるので無視する
+			err := sendFrame(self, peer, true, &BaseData{
+				Type: Probe,
+				Data: &ProbeData{Padding: make([]byte, size-probeOverhead-peer.packetOverhead())},
+			})
+			if err != nil {
+				logrus.Debugf("probe %d: %v", size, err)
+			}
+		}
+
+		wait := probeInterval
+		if attempt == probeAttempts-1 {
+			wait = probeWait
+		}
+		readProbeAcks(self, peer, acked, time.Now().Add(wait))
+	}
+
+	best := 0
+	for size := range acked {
+		if size > best {
+			best = size
+		}
+	}
+	if best == 0 {
+		logrus.Warn("Path MTU discovery failed, using default chunk size")
+		best = defaultDatagramSize
+	}
+
+	sendPathMTU(self, peer, best)
+	logrus.Infof("Path MTU: %d byte datagrams (chunk size %d)", best, datagramChunkSize(peer, best))
+	return best
+}
+
+// AnswerMTUProbes は ProbeMTU からのプローブに応答し、相手が決めたデータグラムサイズを返す
+func AnswerMTUProbes(self *SelfConfig, peer *PeerConfig) int {
+	err := setDontFragment(self.SubConn)
+	if err != nil {
+		logrus.Debugf("Failed to set don't fragment: %v", err)
+	}
+	defer self.SubConn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, maxFrameSize)
+	self.SubConn.SetReadDeadline(time.Now().Add(probeAnswerTimeout))
+	for {
+		n, peerAddr, err := self.SubConn.ReadFromUDP(buf)
+		if err != nil {
+			logrus.Warn("Path MTU discovery timed out, using default chunk size")
+			return defaultDatagramSize
+		}
+		if peerAddr.IP.String() != peer.SubAddr.Ip.String() || peerAddr.Port != peer.SubAddr.Port {
+			continue
+		}
+
+		raw, ok := openRaw(peer, true, buf[:n])
+		if !ok {
+			continue
+		}
+
+		meta, err := decodeFrame(raw)
+		if err != nil {
+			continue
+		}
+
+		switch meta.Type {
+		case Probe:
+			err = sendFrame(self, peer, true, &BaseData{Type: ProbeAck, Data: &ProbeAckData{Size: uint32(n)}})
+			if err != nil {
+				logrus.Debugf("failed to answer probe: %v", err)
+			}
+		case PathMTU:
+			size := int(meta.Data.(*PathMTUData).Size)
+			if size < minDatagramSize || size > maxDatagramSize {
+				size = defaultDatagramSize
+			}
+
+			logrus.Infof("Path MTU: %d byte datagrams (chunk size %d)", size, datagramChunkSize(peer, size))
+			return size
+		}
+	}
+}
+
+// probeCandidates は手元のインターフェースの MTU を超えない候補を大きい順に返す (probeMTUs は降順)
+func probeCandidates(self *SelfConfig, peer *PeerConfig) []int {
+	overhead := ipv4Overhead
+	if peer.SubAddr.Ip.To4() == nil {
+		overhead = ipv6Overhead
+	}
+
+	limit := maxDatagramSize
+	if mtu := interfaceMTU(self.Addr.Ip); mtu > 0 && mtu-overhead < limit {
+		limit = mtu - overhead
+	}
+
+	candidates := []int{}
+	for _, mtu := range probeMTUs {
+		size := mtu - overhead
+		if size > limit {
+			size = limit
+		}
+		if size >= minDatagramSize && (len(candidates) == 0 || candidates[len(candidates)-1] != size) {
+			candidates = append(candidates, size)
+		}
+	}
+	return candidates
+}
+
+// interfaceMTU は ip を持つインターフェースの MTU を返す。見つからなければ 0
+func interfaceMTU(ip net.IP) int {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return 0
+	}
+
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.MTU
+			}
+		}
+	}
+
+	return 0
+}
+
+// readProbeAcks は deadline まで ProbeAck を読み、届いたサイズを acked に記録する
+func readProbeAcks(self *SelfConfig, peer *PeerConfig, acked map[int]bool, deadline time.Time) {
+	defer self.SubConn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, maxFrameSize)
+	self.SubConn.SetReadDeadline(deadline)
+	for {
+		n, peerAddr, err := self.SubConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if peerAddr.IP.String() != peer.SubAddr.Ip.String() || peerAddr.Port != peer.SubAddr.Port {
+			continue
+		}
+
+		raw, ok := openRaw(peer, true, buf[:n])
+		if !ok {
+			continue
+		}
+
+		meta, err := decodeFrame(raw)
+		if err != nil || meta.Type != ProbeAck {
+			continue
+		}
+
+		acked[int(meta.Data.(*ProbeAckData).Size)] = true
+	}
+}
+
+// sendPathMTU は決めたデータグラムサイズを相手に伝える (取りこぼしに備えて複数回送る)
+func sendPathMTU(self *SelfConfig, peer *PeerConfig, size int) {
+	for i := 0; i < probeAttempts; i++ {
+		err := sendFrame(self, peer, true, &BaseData{Type: PathMTU, Data: &PathMTUData{Size: uint32(size)}})
+		if err != nil {
+			logrus.Debugf("failed to send path mtu: %v", err)
+		}
+	}
+}
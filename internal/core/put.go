@@ -0,0 +1,323 @@
+package core
+
+import (
+	"QuickPort/tray"
+	"QuickPort/utils"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// put はこちらのファイルを相手に送る
+// 送信側が PutOffer で申し出て、受信側が accept すると同じ転送 ID で FileReqest が返る (以降は get と同じ流れ)
+// decline や大きさの上限を超えた場合は Error (PutDeclined) が返る
+const putOfferTimeout = 5 * time.Minute
+
+// pendingOffer は受け入れるか決めていない put の申し出
+type pendingOffer struct {
+	ID       uint32 // 転送 ID
+	FileName string
+	Size     int64
+}
+
+// putLimit は受け入れた put で受信してよい大きさ
+type putLimit struct {
+	Offered int64 // 申し出の大きさ
+	MaxSize int64 // 受け入れた時点の上限 (0 は無制限)
+}
+
+// Check は FileIndex の大きさが申し出と同じで、上限を超えていないか確かめる
+func (l *putLimit) Check(index *FileIndexData) error {
+	size := index.TotalSize
+	if index.Delta {
+		size = index.TargetSize
+	}
+
+	if size != l.Offered {
+		return fmt.Errorf("file size %s differs from the offered %s", utils.FormatSize(size), utils.FormatSize(l.Offered))
+	}
+	if l.MaxSize > 0 && size > l.MaxSize {
+		return fmt.Errorf("file too large (limit %s)", utils.FormatSize(l.MaxSize))
+	}
+
+	return nil
+}
+
+// putOffers は受け取った put の申し出と、受け入れる大きさの上限
+type putOffers struct {
+	mu      sync.Mutex
+	next    int
+	pending map[int]*pendingOffer
+	maxSize int64 // 0 は無制限
+}
+
+func PutFile(handle *Handle, args *ShellArgs) error {
+	if len(args.Arg) < 1 {
+		fmt.Println("send file to peer\nput [localpath]")
+		return nil
+	}
+
+	if !handle.Peer.Caps.Has(CapPut) {
+		fmt.Println("put is not supported by peer")
+		return nil
+	}
+
+	path := args.Head()
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	if fileInfo.IsDir() {
+		fmt.Printf("%s is a directory\n", path)
+		return nil
+	}
+
+	tr, err := handle.openTransfer(0)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	offer := &PutOfferData{FileName: filepath.Base(path), Size: fileInfo.Size()}
+	err = sendFrame(handle.Self, handle.Peer, false, &BaseData{Type: PutOffer, Transfer: tr.ID, Data: offer})
+	if err != nil {
+		return fmt.Errorf("failed to send offer: %v", err)
+	}
+	logrus.Infof("Offered %s (%s), waiting for peer to accept...", offer.FileName, utils.FormatSize(offer.Size))
+
+	// 受け入れられると FileReqest が届く。再開を断った場合は最初からのリクエストを待つ
+	// 受信側はリクエストを返事が来るまで送り直すので、断った再開のリクエストが後から届くことがある
+	deadline := time.Now().Add(putOfferTimeout)
+	rejected := ""
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return fmt.Errorf("peer did not answer the offer for %s", offer.FileName)
+		}
+
+		meta, err := tr.receiveFrame(wait)
+		if err != nil {
+			var peerErr *PeerError
+			if errors.As(err, &peerErr) && peerErr.Code == PutDeclined {
+				logrus.Infof("Peer declined %s: %s", offer.FileName, peerErr.Message)
+				return nil
+			}
+			if errors.Is(err, errTransferTimeout) {
+				return fmt.Errorf("peer did not answer the offer for %s", offer.FileName)
+			}
+			return err
+		}
+
+		if meta.Type != FileReqest {
+			continue
+		}
+		request := meta.Data.(*fileRequestData)
+		if request.ResumeHash != "" && request.ResumeHash == rejected {
+			continue
+		}
+
+		err = sendFile(tr, path, request)
+		if errors.Is(err, errResumeRejected) {
+			rejected = request.ResumeHash
+			deadline = time.Now().Add(peerTimeout)
+			continue
+		}
+		return err
+	}
+}
+
+// onPutOffer は put の申し出を受け取り、accept/decline を待つ (上限を超えるものはすぐに断る)
+func (h *Handle) onPutOffer(id uint32, offer *PutOfferData) {
+	name := filepath.Base(offer.FileName)
+	if !h.Peer.Caps.Has(CapPut) || name == "." || name == ".." || name == string(filepath.Separator) {
+		h.sendTransferError(id, &ErrorPacketData{Error: "invalid offer", Code: PutDeclined})
+		return
+	}
+
+	h.offers.mu.Lock()
+	defer h.offers.mu.Unlock()
+
+	if h.offers.maxSize > 0 && offer.Size > h.offers.maxSize {
+		h.sendTransferError(id, &ErrorPacketData{
+			Error: fmt.Sprintf("file too large (limit %s)", utils.FormatSize(h.offers.maxSize)),
+			Code:  PutDeclined,
+		})
+		logrus.Infof("Declined %s from %s: %s exceeds the limit", name, h.Peer.Name, utils.FormatSize(offer.Size))
+		return
+	}
+
+	if h.offers.pending == nil {
+		h.offers.pending = make(map[int]*pendingOffer)
+	}
+	h.offers.next++
+	h.offers.pending[h.offers.next] = &pendingOffer{ID: id, FileName: name, Size: offer.Size}
+
+	fmt.Printf("\n%s wants to send %s (%s)\naccept %d / decline %d\n> ",
+		h.Peer.Name, name, utils.FormatSize(offer.Size), h.offers.next, h.offers.next)
+}
+
+// takeOffer は番号の申し出を取り出す
+func (h *Handle) takeOffer(number string) (*pendingOffer, error) {
+	return h.findOffer(number, true)
+}
+
+// findOffer は番号の申し出を返す。take なら一覧から取り除く
+func (h *Handle) findOffer(number string, take bool) (*pendingOffer, error) {
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return nil, fmt.Errorf("invalid offer number: %s", number)
+	}
+
+	h.offers.mu.Lock()
+	defer h.offers.mu.Unlock()
+
+	offer, ok := h.offers.pending[n]
+	if !ok {
+		return nil, fmt.Errorf("no such offer: %d", n)
+	}
+	if take {
+		delete(h.offers.pending, n)
+	}
+
+	return offer, nil
+}
+
+func (h *Handle) printOffers() {
+	h.offers.mu.Lock()
+	defer h.offers.mu.Unlock()
+
+	numbers := []int{}
+	for n := range h.offers.pending {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	for _, n := range numbers {
+		offer := h.offers.pending[n]
+		fmt.Printf("%d: %s (%s)\n", n, offer.FileName, utils.FormatSize(offer.Size))
+	}
+}
+
+// AcceptPut は put の申し出を受け入れてトレイに受信する
+// トレイに同じ名前のファイルがあれば、--overwrite が無い限り受け入れない (申し出は残す)
+func AcceptPut(handle *Handle, args *ShellArgs) error {
+	overwrite := args.TakeFlag("overwrite")
+	opts, err := parseTransferOptions(handle, args)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	if len(args.Arg) < 1 {
+		handle.printOffers()
+		fmt.Println("accept peer's put\naccept [number] [--overwrite] [--comp mode] [--limit rate] [--fec percent]")
+		return nil
+	}
+
+	offer, err := handle.findOffer(args.Head(), false)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	outputPath := filepath.Join(tray.UseTray(), offer.FileName)
+	if !overwrite && existingOutput(outputPath) {
+		fmt.Printf("%s already exists in the tray\nuse accept %s --overwrite to replace it\n", offer.FileName, args.Head())
+		return nil
+	}
+
+	offer, err = handle.takeOffer(args.Head())
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	request := opts.request(offer.FileName)
+	request.Offer = true
+	limit := &putLimit{Offered: offer.Size, MaxSize: handle.maxPutSize()}
+
+	return receiveFile(handle, offer.ID, request, outputPath, limit)
+}
+
+// existingOutput は path に受信すると手元のファイルを上書きするか (途中まで受信したものは再開するだけなので含めない)
+func existingOutput(path string) bool {
+	_, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(partialPath(path))
+	return err != nil
+}
+
+// DeclinePut は put の申し出を断る
+func DeclinePut(handle *Handle, args *ShellArgs) error {
+	if len(args.Arg) < 1 {
+		handle.printOffers()
+		fmt.Println("decline peer's put\ndecline [number]")
+		return nil
+	}
+
+	offer, err := handle.takeOffer(args.Head())
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	err = handle.sendTransferError(offer.ID, &ErrorPacketData{Error: "declined by peer", Code: PutDeclined})
+	if err != nil {
+		return fmt.Errorf("failed to decline offer: %v", err)
+	}
+
+	fmt.Printf("declined %s\n", offer.FileName)
+	return nil
+}
+
+// SetMaxPut は受け入れる put の大きさの上限を設定する
+func SetMaxPut(handle *Handle, args *ShellArgs) error {
+	if args.Len() < 1 {
+		fmt.Printf("maxput: %s\n", formatMaxPut(handle.maxPutSize()))
+		fmt.Println("set maximum size of accepted puts\nmaxput [size|off] (e.g. maxput 1GB)")
+		return nil
+	}
+
+	var size int64
+	if args.Head() != "off" {
+		var err error
+		size, err = utils.ParseSize(args.Head())
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+	}
+
+	handle.offers.mu.Lock()
+	handle.offers.maxSize = size
+	handle.offers.mu.Unlock()
+
+	fmt.Printf("maxput: %s\n", formatMaxPut(size))
+	return nil
+}
+
+func (h *Handle) maxPutSize() int64 {
+	h.offers.mu.Lock()
+	defer h.offers.mu.Unlock()
+
+	return h.offers.maxSize
+}
+
+func formatMaxPut(size int64) string {
+	if size <= 0 {
+		return "off"
+	}
+
+	return utils.FormatSize(size)
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutLimitCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit putLimit
+		index FileIndexData
+		ok    bool
+	}{
+		{"as offered", putLimit{Offered: 100}, FileIndexData{TotalSize: 100}, true},
+		{"as offered within limit", putLimit{Offered: 100, MaxSize: 100}, FileIndexData{TotalSize: 100}, true},
+		{"larger than offered", putLimit{Offered: 1}, FileIndexData{TotalSize: 1 << 30}, false},
+		{"smaller than offered", putLimit{Offered: 100}, FileIndexData{TotalSize: 99}, false},
+		// 申し出の後に maxput を下げた
+		{"over the limit", putLimit{Offered: 100, MaxSize: 50}, FileIndexData{TotalSize: 100}, false},
+		// 差分では組み立てた後の大きさで比べる
+		{"delta", putLimit{Offered: 100, MaxSize: 100}, FileIndexData{TotalSize: 10, Delta: true, TargetSize: 100}, true},
+		{"delta larger than offered", putLimit{Offered: 100}, FileIndexData{TotalSize: 10, Delta: true, TargetSize: 1 << 30}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limit.Check(&tt.index)
+			if (err == nil) != tt.ok {
+				t.Errorf("Check() = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestExistingOutput(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("kept.txt")
+	write("resume.txt")
+	write("resume.txt" + partialSuffix)
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"new.txt", false},
+		{"kept.txt", true},
+		// 前回受け入れた put の続きは上書きではない
+		{"resume.txt", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := existingOutput(filepath.Join(dir, tt.name)); got != tt.want {
+				t.Errorf("existingOutput() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"QuickPort/utils"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	minLimiterBurst = 64 << 10
+	maxLimiterSleep = 50 * time.Millisecond // レート変更をすぐ反映できるよう細かく待つ
+)
+
+// RateLimiter はトークンバケットで送信量を制限する。レート 0 は無制限
+// 転送中でも SetRate で変更できる
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   int64 // bytes/s
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate, last: time.Now()}
+}
+
+func (l *RateLimiter) SetRate(rate int64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+}
+
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait は n バイト分のトークンが貯まるまで待つ
+func (l *RateLimiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return
+		}
+
+		now := time.Now()
+		l.refill(now)
+		if l.tokens >= float64(n) {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return
+		}
+
+		wait := time.Duration((float64(n) - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+
+		if wait > maxLimiterSleep {
+			wait = maxLimiterSleep
+		}
+		time.Sleep(wait)
+	}
+}
+
+// refill は経過時間分のトークンを補充する (mu を保持して呼ぶ)
+func (l *RateLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		burst := float64(l.rate) / 10
+		if burst < minLimiterBurst {
+			burst = minLimiterBurst
+		}
+
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+}
+
+// minLimit は 0 (無制限) を除いた小さい方の制限を返す
+func minLimit(a, b int64) int64 {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 || a < b {
+		return a
+	}
+	return b
+}
+
+// SetLimit はセッション全体の帯域制限を表示・変更する
+// 受信中の転送にも新しい上限を送り、送信側のレートをその場で変えてもらう
+// limit [rate|off]
+func SetLimit(handle *Handle, args *ShellArgs) error {
+	if args.Len() < 1 {
+		fmt.Printf("limit: %s\n", formatLimit(handle.Limit.Rate()))
+		fmt.Println("set bandwidth limit (also applied to downloads in progress)\nlimit [rate|off] (e.g. limit 5MB/s)")
+		return nil
+	}
+
+	var rate int64
+	if args.Head() != "off" {
+		var err error
+		rate, err = utils.ParseRate(args.Head())
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+	}
+
+	handle.Limit.SetRate(rate)
+	fmt.Printf("limit: %s\n", formatLimit(rate))
+
+	updated := updateDownloadRates(handle, rate)
+	if updated > 0 {
+		fmt.Printf("limit: applied to %d downloads in progress\n", updated)
+	}
+	return nil
+}
+
+// updateDownloadRates は受信中の転送の送信側へ新しい帯域上限を送り、送れた数を返す
+func updateDownloadRates(handle *Handle, rate int64) int {
+	if !handle.Peer.Caps.Has(CapRateUpdate) {
+		return 0
+	}
+
+	updated := 0
+	for _, id := range handle.downloadIDs() {
+		err := sendFrame(handle.Self, handle.Peer, true, &BaseData{Type: RateUpdate, Transfer: id, Data: &RateUpdateData{Rate: rate}})
+		if err != nil {
+			logrus.Warnf("Failed to update bandwidth limit of transfer %d: %v", id, err)
+			continue
+		}
+		updated++
+	}
+
+	return updated
+}
+
+func formatLimit(rate int64) string {
+	if rate <= 0 {
+		return "off"
+	}
+
+	return utils.FormatRate(rate)
+}
@@ -2,172 +2,147 @@ package core
 
 import (
 	"QuickPort/tray"
+	"bytes"
 	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/fnv"
 	"net"
-	"os"
-	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Receiver は相手からのリクエストに応え始める (受信は packetMux の goroutine が行う)
 func (h *Handle) Receiver() {
-	isPause := false
-	for {
-		select {
-		case p, ok := <-h.Pause:
-			if ok {
-				isPause = p
-				continue
-			}
-		default:
-			if isPause {
-				continue
-			}
-
-			buf := make([]byte, 1024)
-
-			h.Self.Conn.SetReadDeadline(time.Now().Add(time.Microsecond * 100))
-			n, peerAddr, err := h.Self.Conn.ReadFromUDP(buf)
-			if err != nil {
-				if n == 0 && peerAddr == nil {
-					continue
-				}
-
-				logrus.Debugf("fuckin packet: %d %s", n, err.Error())
-				continue
-			}
-
-			if peerAddr.IP.String() != h.Self.Addr.Ip.String() || peerAddr.Port != h.Peer.Addr.Port {
-				continue
-			}
+	h.subscribe(FileReqest, func(meta *BaseData) {
+		// 転送はここで開く。FileIndex を待つ受信側が送り直してきたリクエストは、開いた転送に届いて無視される
+		tr, err := h.openTransfer(meta.Transfer)
+		if err != nil {
+			logrus.Debugf("Ignoring file request: %v", err)
+			return
+		}
 
-			var meta BaseData
-			err = json.Unmarshal(buf[:n], &meta)
+		// 送信は転送 ID ごとに並行して行う (こちらの get とも同時に動く)
+		go func() {
+			err := SendFile(tr, meta.Data.(*fileRequestData))
 			if err != nil {
-				logrus.Debugf("JSON Error: %s", err.Error())
-				continue
+				logrus.Error(err)
 			}
 
-			switch meta.Type {
-			case FileReqest:
-				filereq, err := ConvertMapToFileReqestMeta(meta.Data)
-				if err != nil {
-					logrus.Errorf("Decode Error: %s", err)
-					continue
-				}
-
-				err = SendFile(h, filereq)
-				if err != nil {
-					logrus.Error(err)
-				}
-				h.ResetConn()
-
-				//rewrite Prefix
-				fmt.Printf("> ")
-			case Message:
-				// 他のメッセージ処理
-			case Ping:
-				RecordPingTime()
-			case FileIndex:
-				logrus.Debug("Ignoring FileIndex packet in Receiver")
-				continue
-			default:
-				logrus.Debugf("Ignoring unknown packet type: %d", dataType(meta.Type))
-				continue
-			}
-		}
-	}
+			//rewrite Prefix
+			fmt.Printf("> ")
+		}()
+	})
+	h.subscribe(ManifestRequest, func(meta *BaseData) {
+		go h.sendManifest(meta.Transfer, meta.Data.(*ManifestRequestData))
+	})
+	h.subscribe(PutOffer, func(meta *BaseData) {
+		h.onPutOffer(meta.Transfer, meta.Data.(*PutOfferData))
+	})
+	h.subscribe(Ping, func(*BaseData) {
+		RecordPingTime()
+	})
+	h.subscribe(Message, func(*BaseData) {
+		// 他のメッセージ処理
+	})
+
+	h.startMux()
 }
 
-func calculateFileHash(path string) (string, error) {
-	raw, err := os.ReadFile(path)
-	if err != nil {
-		return "", err
-	}
-
-	h := fnv.New32a()
-	h.Write([]byte(raw))
-	return strconv.FormatUint(uint64(h.Sum32()), 10), nil
+// calculateFileHash はファイルを読みながら algorithm のハッシュを計算する
+func calculateFileHash(path string, algorithm string) (string, error) {
+	return tray.HashFile(path, algorithm)
 }
 
-func calculateBinaryHash(raw []byte) (string, error) {
-	h := fnv.New32a()
-	h.Write([]byte(raw))
-	return strconv.FormatUint(uint64(h.Sum32()), 10), nil
+func calculateBinaryHash(raw []byte, algorithm string) (string, error) {
+	return tray.HashReader(bytes.NewReader(raw), algorithm)
 }
 
-func receiveFileIndex(handle *Handle) (*FileIndexData, error) {
-	// FileIndexはSubConnで受信
-	for {
-		meta, err := receiveFromPeer(handle.Self, handle.Peer, true)
-		if err != nil {
-			return nil, err
-		}
+// Preparing を送ってこない古い送信側のハッシュ計算を待つ上限
+const legacyIndexTimeout = 5 * time.Minute
+
+// receiveFileIndex は request を送って FileIndex を待つ。差分転送では待っている間に手元のファイルの署名 sigs を送信側へ返す
+// request が落ちても分かるよう、送信側から何か届くまでは送り直す
+func receiveFileIndex(tr *transfer, request *fileRequestData, sigs *deltaSignatures) (*FileIndexData, error) {
+	// 送信側はハッシュ計算に時間がかかることがあるので、その間は Preparing で生きていることを知らせてくる
+	silence := peerTimeout
+	if !tr.handle.Peer.Caps.Has(CapPreparing) {
+		silence = legacyIndexTimeout
+	}
 
-		if meta.Type != Error {
-			packet, err := convertMapToErrorPacketData(meta.Data)
+	heard := false
+	lastHeard := time.Now()
+	for {
+		if !heard {
+			err := sendFrame(tr.handle.Self, tr.handle.Peer, false, &BaseData{Type: FileReqest, Transfer: tr.ID, Data: request})
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("failed to send request: %v", err)
 			}
+		}
 
-			if packet.Code == FileNotFound {
-
+		meta, err := tr.receiveFrame(keepaliveInterval)
+		if errors.Is(err, errTransferTimeout) {
+			if time.Since(lastHeard) > silence {
+				return nil, fmt.Errorf("no reply from peer for %d seconds", int(silence/time.Second))
 			}
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
+		heard = true
+		lastHeard = time.Now()
 
-		if meta.Type != FileIndex {
-			logrus.Debugf("Ignoring packet type: %d, waiting for FileIndex", meta.Type)
+		if meta.Type == Preparing {
 			continue
 		}
 
-		bytes, err := json.Marshal(meta.Data)
-		if err != nil {
-			return nil, err
+		if meta.Type == SignatureRequest && sigs != nil {
+			answerSignatureRequest(tr, sigs, meta.Data.(*SignatureRequestData))
+			continue
 		}
 
-		var indexData FileIndexData
-		err = json.Unmarshal(bytes, &indexData)
-		if err != nil {
-			return nil, err
+		if meta.Type != FileIndex {
+			logrus.Debugf("Ignoring packet type: %d, waiting for FileIndex", meta.Type)
+			continue
 		}
 
-		return &indexData, nil
+		return meta.Data.(*FileIndexData), nil
 	}
 }
 
-// receiveFileChunk receives file chunk using custom protocol
-func receiveFileChunk(conn *net.UDPConn) (*FileChunk, error) {
-	buf := make([]byte, ChunkSize+16) // チャンクサイズ + ヘッダー
-
-	n, _, err := conn.ReadFromUDP(buf)
-	if err != nil {
-		return nil, err
+// parseChunk はチャンクのデータグラムを FileChunk に戻す (Data は raw をコピーしたもの)
+func parseChunk(raw []byte) (*FileChunk, error) {
+	if len(raw) < chunkHeaderSize { // 最小ヘッダーサイズ
+		return nil, fmt.Errorf("packet too small: %d bytes", len(raw))
 	}
-
-	if n < 12 { // 最小ヘッダーサイズ
-		return nil, fmt.Errorf("packet too small: %d bytes", n)
+	if string(raw[0:2]) != chunkMagic {
+		return nil, fmt.Errorf("not a chunk")
 	}
 
 	// カスタムプロトコルのパース
-	// [Index:4][Length:4][Checksum:4][Data:Length]
-	index := binary.LittleEndian.Uint32(buf[0:4])
-	length := binary.LittleEndian.Uint32(buf[4:8])
-	checksum := binary.LittleEndian.Uint32(buf[8:12])
-
-	if n < int(12+length) {
-		return nil, fmt.Errorf("incomplete chunk: expected %d bytes, got %d", 12+length, n)
+	// [Magic:2][Transfer:4][Index:4][Length:4][Checksum:4][Flags:1][Seq:4][Data:Length]
+	transfer := binary.LittleEndian.Uint32(raw[2:6])
+	index := binary.LittleEndian.Uint32(raw[6:10])
+	length := binary.LittleEndian.Uint32(raw[10:14])
+	checksum := binary.LittleEndian.Uint32(raw[14:18])
+	flags := raw[18]
+	seq := binary.LittleEndian.Uint32(raw[19:23])
+
+	if len(raw) < chunkHeaderSize+int(length) {
+		return nil, fmt.Errorf("incomplete chunk: expected %d bytes, got %d", chunkHeaderSize+int(length), len(raw))
 	}
 
-	data := buf[12 : 12+length]
+	data := make([]byte, length)
+	copy(data, raw[chunkHeaderSize:])
 
 	return &FileChunk{
+		Transfer: transfer,
 		Index:    index,
 		Length:   length,
 		Checksum: checksum,
+		Flags:    flags,
+		Seq:      seq,
 		Data:     data,
 	}, nil
 }
@@ -187,11 +162,12 @@ func ReceiveTray(self *SelfConfig, peer *PeerConfig) (*[]tray.FileMeta, error) {
 	}
 
 	logrus.Debug("Received tray sync packet")
-	return ConvertMapToFileMeta(meta.Data)
+	items := []tray.FileMeta(*meta.Data.(*TrayData))
+	return &items, nil
 }
 
 func ReceiveSync(conn *net.UDPConn) (*BaseData, error) {
-	buf := make([]byte, 1024)
+	buf := make([]byte, maxFrameSize)
 	for {
 		n, _, err := conn.ReadFromUDP(buf)
 		if err != nil {
@@ -199,11 +175,10 @@ func ReceiveSync(conn *net.UDPConn) (*BaseData, error) {
 			continue
 		}
 
-		var meta BaseData
-		err = json.Unmarshal(buf[:n], &meta)
+		meta, err := decodeFrame(buf[:n])
 		if err != nil {
-			logrus.Fatal(err)
-			return nil, err
+			logrus.Debug(err)
+			continue
 		}
 
 		if meta.Type != SyncTray {
@@ -211,16 +186,13 @@ func ReceiveSync(conn *net.UDPConn) (*BaseData, error) {
 			continue
 		}
 
-		//Read(&meta)
-		//ConvertMapToFileMeta()
-
-		return &meta, nil
+		return meta, nil
 	}
 }
 
 // 受信処理
 func ReceiveLoop(conn *net.UDPConn) {
-	buf := make([]byte, 1024*1024)
+	buf := make([]byte, maxFrameSize)
 	for {
 		n, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
@@ -229,13 +201,10 @@ func ReceiveLoop(conn *net.UDPConn) {
 		}
 		logrus.Infof("Received from %s", addr.String())
 
-		var meta BaseData
-		err = json.Unmarshal(buf[:n], &meta)
+		_, err = decodeFrame(buf[:n])
 		if err != nil {
-			logrus.Fatal(err)
-			return
+			logrus.Debug(err)
+			continue
 		}
-
-		ConvertMapToFileMeta(meta.Data)
 	}
 }
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"QuickPort/tray"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// get の前に相手のトレイ一覧のハッシュと大きさを手元のトレイのファイルと比べ、
+// 同じ内容のファイルがあれば転送せずにハードリンク (できなければコピー) で済ませる
+// 一覧は接続時に受け取ったものなので、相手がその後にファイルを変えた場合は --force で受信し直す
+// FNV は衝突しやすいので SHA-256 で合意した場合だけ使う
+
+// localFiles は手元のトレイのファイルを大きさごとにまとめ、ハッシュは必要になったものだけ計算する
+type localFiles struct {
+	root    string
+	bySize  map[int64][]string
+	hashes  map[string]string
+	scanned bool
+}
+
+func newLocalFiles(root string) *localFiles {
+	return &localFiles{root: root, hashes: make(map[string]string)}
+}
+
+func (l *localFiles) scan() {
+	l.scanned = true
+	l.bySize = make(map[int64][]string)
+	err := filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || isWorkFile(p) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		l.bySize[info.Size()] = append(l.bySize[info.Size()], p)
+		return nil
+	})
+	if err != nil {
+		logrus.Warnf("Failed to list the tray for identical files: %v", err)
+	}
+}
+
+// Find は size バイトで SHA-256 が hash のファイルを探す。保存先 prefer に同じ内容があればそれを優先する
+func (l *localFiles) Find(size int64, hash string, prefer string) string {
+	if !l.scanned {
+		l.scan()
+	}
+
+	candidates := l.bySize[size]
+	for i, p := range candidates {
+		if p == prefer {
+			candidates[0], candidates[i] = candidates[i], candidates[0]
+			break
+		}
+	}
+
+	for _, p := range candidates {
+		h, ok := l.hashes[p]
+		if !ok {
+			var err error
+			h, err = tray.HashFile(p, tray.HashSHA256)
+			if err != nil {
+				logrus.Debugf("failed to hash %s: %v", p, err)
+				continue
+			}
+			l.hashes[p] = h
+		}
+
+		if h == hash {
+			return p
+		}
+	}
+
+	return ""
+}
+
+// Add は新しく置いたファイルを候補に加える
+func (l *localFiles) Add(p string, size int64, hash string) {
+	if !l.scanned {
+		return
+	}
+
+	l.bySize[size] = append(l.bySize[size], p)
+	l.hashes[p] = hash
+}
+
+// peerFile は相手のトレイ一覧から filePath のファイルを探す
+func peerFile(handle *Handle, filePath string) *tray.FileMeta {
+	name := path.Clean(filePath)
+	for i := range handle.PeerTray {
+		if handle.PeerTray[i].Filename == name {
+			return &handle.PeerTray[i]
+		}
+	}
+
+	return nil
+}
+
+// reuseLocalCopy は filePath と同じ内容のファイルが手元にあれば outputPath に置き、転送を省いたら true を返す
+func reuseLocalCopy(handle *Handle, local *localFiles, filePath string, outputPath string) bool {
+	if local == nil || handle.Peer.HashAlgorithm() != tray.HashSHA256 {
+		return false
+	}
+
+	meta := peerFile(handle, filePath)
+	if meta == nil || meta.HashAlgo != tray.HashSHA256 || meta.Hash == "" {
+		return false
+	}
+
+	src := local.Find(meta.Size, meta.Hash, outputPath)
+	if src == "" {
+		return false
+	}
+
+	if src == outputPath {
+		logrus.Infof("%s is already up to date, skipping", filePath)
+		removePartial(outputPath)
+		return true
+	}
+
+	err := linkOrCopy(src, outputPath)
+	if err != nil {
+		logrus.Warnf("Failed to reuse %s, receiving it instead: %v", src, err)
+		return false
+	}
+	local.Add(outputPath, meta.Size, meta.Hash)
+	removePartial(outputPath)
+
+	if rel, err := filepath.Rel(local.root, src); err == nil {
+		src = filepath.ToSlash(rel)
+	}
+	logrus.Infof("%s has the same content as %s in the tray, linked instead of receiving", filePath, src)
+	return true
+}
+
+// linkOrCopy は src を dst にハードリンクし、できなければコピーする (一時ファイルから置き換える)
+func linkOrCopy(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + deltaNewSuffix
+	os.Remove(tmp)
+	if os.Link(src, tmp) != nil {
+		err = copyFile(src, tmp)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %v", dst, err)
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,236 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	sackInterval         = 20 * time.Millisecond
+	sackBitmapBytes      = 1024
+	sackWindow           = sackBitmapBytes * 8 // 1つの SACK で報告できるチャンク数
+	minRetransmitTimeout = 20 * time.Millisecond
+	resumeSweepTimeout   = time.Second
+	peerTimeout          = PeerTimeoutSeconds * time.Second
+	keepaliveInterval    = time.Second // 全チャンク受信後の SACK と、開始の合図を待つ間の FileIndex を送り直す間隔
+)
+
+// sackBuilder は受信側で SACK を作る
+// 直近に届いた範囲と、CumAck から順に巡回する範囲を交互に報告する
+type sackBuilder struct {
+	received *chunkBitmap
+	highest  uint32 // 受信した最大のチャンク番号 + 1
+	cursor   uint32 // 巡回中の位置
+	recent   bool
+	lastSent time.Time
+}
+
+func newSackBuilder(received *chunkBitmap) *sackBuilder {
+	return &sackBuilder{received: received}
+}
+
+// OnChunk はチャンク受信を記録し、SACK を送るべきなら true を返す
+func (b *sackBuilder) OnChunk(index uint32) bool {
+	if index >= b.highest {
+		b.highest = index + 1
+	}
+
+	return time.Since(b.lastSent) >= sackInterval
+}
+
+func (b *sackBuilder) Next() *SackData {
+	b.lastSent = time.Now()
+	cumAck := b.received.FirstMissing(0)
+
+	var offset uint32
+	if b.recent && b.highest > cumAck {
+		offset = cumAck
+		if b.highest-cumAck > sackWindow {
+			offset = b.highest - sackWindow
+		}
+	} else {
+		if b.cursor < cumAck || b.cursor >= b.received.Size() {
+			b.cursor = cumAck
+		}
+		offset = b.cursor
+		b.cursor += sackWindow
+	}
+	b.recent = !b.recent
+
+	return &SackData{
+		CumAck: cumAck,
+		Offset: offset,
+		Bitmap: b.received.Slice(offset, offset+sackWindow),
+	}
+}
+
+// Sweep はファイル全体の受信状況を SACK に分けて返す (再開時に送る)
+func (b *sackBuilder) Sweep() []*SackData {
+	cumAck := b.received.FirstMissing(0)
+	sacks := []*SackData{}
+	for offset := cumAck; offset < b.received.Size(); offset += sackWindow {
+		sacks = append(sacks, &SackData{
+			CumAck: cumAck,
+			Offset: offset,
+			Bitmap: b.received.Slice(offset, offset+sackWindow),
+		})
+	}
+	if len(sacks) == 0 {
+		sacks = append(sacks, &SackData{CumAck: cumAck})
+	}
+
+	b.lastSent = time.Now()
+	return sacks
+}
+
+// sackScoreboard は送信側で SACK を集計し、次に送るチャンクを決める
+// 欠落が分かったチャンクは新しいチャンクより先に再送する
+type sackScoreboard struct {
+	mu sync.Mutex
+
+	acked    *chunkBitmap
+	queued   *chunkBitmap
+	resend   []uint32
+	lastSent []int64 // UnixNano (0 は未送信)
+	next     uint32  // まだ一度も送っていない最初のチャンク
+	covered  uint32  // SACK で状況が分かっている範囲の終端
+	lastSack time.Time
+	notify   chan struct{}
+}
+
+func newSackScoreboard(count uint32) *sackScoreboard {
+	return &sackScoreboard{
+		acked:    newChunkBitmap(count),
+		queued:   newChunkBitmap(count),
+		lastSent: make([]int64, count),
+		lastSack: time.Now(),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// OnSack は受信済みチャンクを記録し、送ってから rto 以上経っても届いていないチャンクを再送に回す
+func (s *sackScoreboard) OnSack(sack *SackData, rto time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := s.acked.Size()
+	now := time.Now()
+	s.lastSack = now
+
+	for i := s.acked.FirstMissing(0); i < sack.CumAck && i < size; i = s.acked.FirstMissing(i) {
+		s.acked.Set(i)
+	}
+	if sack.CumAck > s.covered {
+		s.covered = sack.CumAck
+	}
+
+	end := uint64(sack.Offset) + uint64(len(sack.Bitmap))*8
+	if end > uint64(size) {
+		end = uint64(size)
+	}
+	for i := uint64(sack.Offset); i < end; i++ {
+		index := uint32(i)
+		if sack.Bitmap[(index-sack.Offset)/8]&(1<<((index-sack.Offset)%8)) != 0 {
+			s.acked.Set(index)
+			continue
+		}
+
+		sentAt := s.lastSent[index]
+		if sentAt != 0 && !s.acked.Has(index) && !s.queued.Has(index) && now.UnixNano()-sentAt >= int64(rto) {
+			s.queued.Set(index)
+			s.resend = append(s.resend, index)
+		}
+	}
+	if uint32(end) > s.covered {
+		s.covered = uint32(end)
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Next は次に送るチャンクを返す。今送るものが無ければ false
+func (s *sackScoreboard) Next() (uint32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.resend) > 0 {
+		index := s.resend[0]
+		s.resend = s.resend[1:]
+		s.queued.Clear(index)
+		if !s.acked.Has(index) {
+			return index, true
+		}
+	}
+
+	s.next = s.acked.FirstMissing(s.next)
+	for s.next < s.acked.Size() {
+		index := s.next
+		s.next++
+		if s.lastSent[index] == 0 && !s.acked.Has(index) {
+			return index, true
+		}
+	}
+
+	return 0, false
+}
+
+// Requeue は受信側で検証に失敗したチャンクを未確認に戻して再送に回す
+func (s *sackScoreboard) Requeue(start, count uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := s.acked.Size()
+	for i := start; i < start+count && i < size; i++ {
+		s.acked.Clear(i)
+		if !s.queued.Has(i) {
+			s.queued.Set(i)
+			s.resend = append(s.resend, i)
+		}
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sackScoreboard) OnSent(index uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSent[index] = time.Now().UnixNano()
+}
+
+// WaitCovered はファイル全体の受信状況が分かるまで待つ (再開時)
+func (s *sackScoreboard) WaitCovered(timeout time.Duration) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		covered := s.covered >= s.acked.Size()
+		s.mu.Unlock()
+		if covered {
+			return
+		}
+
+		select {
+		case <-s.notify:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func (s *sackScoreboard) Complete() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked.Complete()
+}
+
+// SinceLastSack は最後に SACK を受け取ってからの時間
+func (s *sackScoreboard) SinceLastSack() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastSack)
+}
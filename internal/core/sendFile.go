@@ -2,299 +2,528 @@ package core
 
 import (
 	"QuickPort/tray"
-	"bytes"
+	"QuickPort/utils"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
-	"io"
-	"net"
 	"os"
-	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-func SendFile(handle *Handle, filereq *fileRequestData) error {
+var errResumeRejected = errors.New("file has changed, cannot resume")
+
+// SendFile は受信側が振った転送 ID で開いた tr で、トレイ内の filereq のファイルを送る
+func SendFile(tr *transfer, filereq *fileRequestData) error {
+	defer tr.Close()
+
+	// put の受け入れが、こちらが待つのをやめた後に届いた
+	if filereq.Offer {
+		tr.SendError(&ErrorPacketData{Error: "offer expired", Code: PutDeclined})
+		return fmt.Errorf("peer accepted an expired offer: %s", filereq.FilePath)
+	}
+
+	fullpath, err := tray.Resolve(filereq.FilePath)
+	if err != nil {
+		tr.SendError(&ErrorPacketData{Error: "File not found", Code: FileNotFound})
+		return fmt.Errorf("peer requested %v", err)
+	}
+
+	return sendFile(tr, fullpath, filereq)
+}
+
+// sendFile は fullpath のファイルを tr で送る
+func sendFile(tr *transfer, fullpath string, filereq *fileRequestData) error {
 	logrus.Debug(filereq.CompMode)
+	handle := tr.handle
+
+	// FileIndex を送るまでは生存通知を送り、ハッシュの計算に時間がかかっても受信側に諦めさせない
+	stopPreparing := keepPreparing(tr)
+	defer stopPreparing()
+
+	// 接続時に合意した機能以外は受け付けない
+	if !handle.Peer.Caps.Has(compModeCapability(filereq.CompMode)) {
+		tr.SendError(&ErrorPacketData{Error: "compression mode not negotiated", Code: FailedCompress})
+		return fmt.Errorf("peer requested unnegotiated compression mode: %s", filereq.CompMode)
+	}
+	if filereq.ResumeHash != "" && !handle.Peer.Caps.Has(CapResume) {
+		tr.SendError(&ErrorPacketData{Error: "resume not negotiated", Code: ResumeRejected})
+		return fmt.Errorf("peer requested resume without negotiating it")
+	}
+	if filereq.Redundancy < 0 || filereq.Redundancy > 100 || (filereq.Redundancy > 0 && !handle.Peer.Caps.Has(CapFEC)) {
+		tr.SendError(&ErrorPacketData{Error: "invalid fec redundancy", Code: FailedFileOperations})
+		return fmt.Errorf("peer requested unsupported fec redundancy: %d%%", filereq.Redundancy)
+	}
 
 	// Step 1: ファイルの存在確認とメタデータ取得
-	fullpath := tray.UseTray() + filepath.Clean(filereq.FilePath)
 	fileInfo, err := os.Stat(fullpath)
 	logrus.Debugf("fileinfo: %v", fileInfo)
 	if err != nil {
 		logrus.Errorf("File not found: %s", filereq.FilePath)
-		handle.SendError(&ErrorPacketData{Error: "File not found", Code: FileNotFound}, true)
+		tr.SendError(&ErrorPacketData{Error: "File not found", Code: FileNotFound})
 		return nil
 	}
 
+	// ディレクトリは受信側がファイル一覧を取り直して1つずつ get する
 	if fileInfo.IsDir() {
-		handle.SendError(&ErrorPacketData{Error: "File not found", Code: FailedCalcFileHash}, true)
+		if handle.Peer.Caps.Has(CapDirectory) {
+			tr.SendError(&ErrorPacketData{Error: "path is a directory", Code: IsDirectory})
+			return nil
+		}
+		tr.SendError(&ErrorPacketData{Error: "File not found", Code: FailedCalcFileHash})
 		return fmt.Errorf("path is a directory, not a file: %s", filereq.FilePath)
 	}
 
-	// Step 2: 元のファイルハッシュを計算（圧縮前）
-	originalFileHash, err := calculateFileHash(fullpath)
+	// チャンクサイズはセッションの経路 MTU から決める (再開時は前回と同じ大きさが収まるならそれに合わせる)
+	chunkSize := handle.Peer.ChunkSize()
+	if filereq.ChunkSize >= minDatagramSize-chunkHeaderSize && filereq.ChunkSize < chunkSize {
+		chunkSize = filereq.ChunkSize
+	}
+
+	// Step 2: 元のファイルハッシュを計算（圧縮前、合意したアルゴリズムで）
+	// Merkle 木で検証する場合はセグメントのハッシュも同じ読み込みで計算する
+	hashAlgo := handle.Peer.HashAlgorithm()
+	var originalFileHash string
+	var segments [][]byte
+	if handle.Peer.Caps.Has(CapMerkle) && fileInfo.Size() > 0 {
+		originalFileHash, segments, err = hashFileSegments(fullpath, hashAlgo, int64(chunkSize)*merkleSegmentChunks)
+	} else {
+		originalFileHash, err = calculateFileHash(fullpath, hashAlgo)
+	}
 	logrus.Debugf("original file hash: %s", originalFileHash)
 	if err != nil {
-		handle.SendError(&ErrorPacketData{Error: "failed to calculate file hash", Code: FailedCalcFileHash}, true)
+		tr.SendError(&ErrorPacketData{Error: "failed to calculate file hash", Code: FailedCalcFileHash})
 		return fmt.Errorf("failed to calculate file hash: %v", err)
 	}
 
-	// Step 3: ファイルを読み込んで圧縮
-	file, err := os.Open(fullpath)
-	if err != nil {
-		handle.SendError(&ErrorPacketData{Error: "failed to file operations", Code: FailedFileOperations}, true)
-		return fmt.Errorf("failed to open file: %v", err)
+	// 再開要求の場合、ファイルが変わっていないか確認
+	if filereq.ResumeHash != "" && filereq.ResumeHash != originalFileHash {
+		tr.SendError(&ErrorPacketData{Error: errResumeRejected.Error(), Code: ResumeRejected})
+		return fmt.Errorf("rejected resume of %s: %w", filereq.FilePath, errResumeRejected)
 	}
-	defer file.Close()
 
-	// ファイル全体を読み込み
-	raw, err := io.ReadAll(file)
-	if err != nil {
-		handle.SendError(&ErrorPacketData{Error: "failed to file operations", Code: FailedFileOperations}, true)
-		return fmt.Errorf("failed to read file: %v", err)
+	// 受信側に古いファイルがあれば、その署名との差分だけを送る
+	payloadPath, payloadSize := fullpath, fileInfo.Size()
+	if filereq.DeltaBlocks > 0 && handle.Peer.Caps.Has(CapDelta) && fileInfo.Size() > 0 {
+		deltaPath, deltaSize, err := prepareDelta(tr, fullpath, fileInfo.Size(), filereq, hashAlgo, originalFileHash)
+		if err != nil {
+			tr.SendError(&ErrorPacketData{Error: "failed to prepare delta", Code: FailedFileOperations})
+			return err
+		}
+		if deltaPath != "" {
+			defer os.Remove(deltaPath)
+			logrus.Infof("Sending delta: %s instead of %s", utils.FormatSize(deltaSize), utils.FormatSize(fileInfo.Size()))
+			payloadPath, payloadSize = deltaPath, deltaSize
+
+			// Merkle 木は実際に送る差分に対して作り直す
+			if segments != nil {
+				_, segments, err = hashFileSegments(deltaPath, hashAlgo, int64(chunkSize)*merkleSegmentChunks)
+				if err != nil {
+					tr.SendError(&ErrorPacketData{Error: "failed to calculate file hash", Code: FailedCalcFileHash})
+					return fmt.Errorf("failed to hash delta: %v", err)
+				}
+			}
+		}
 	}
 
-	// 圧縮処理
-	compressed, err := Compress(raw, filereq.CompMode)
+	// Step 3: ファイルを開く (全体は読み込まず、チャンク単位で読み出す)
+	file, err := os.Open(payloadPath)
 	if err != nil {
-		handle.SendError(&ErrorPacketData{Error: "failed to file compress", Code: FailedCompress}, true)
-		return fmt.Errorf("failed to compress file: %v", err)
+		tr.SendError(&ErrorPacketData{Error: "failed to file operations", Code: FailedFileOperations})
+		return fmt.Errorf("failed to open file: %v", err)
 	}
+	defer file.Close()
 
-	compressedSize := int64(len(compressed))
-	logrus.Debugf("Original size: %d, Compressed size: %d", len(raw), compressedSize)
+	source, err := newFileChunkSource(file, payloadSize, chunkSize, filereq.CompMode)
+	if err != nil {
+		tr.SendError(&ErrorPacketData{Error: "failed to file compress", Code: FailedCompress})
+		return fmt.Errorf("failed to set up compression: %v", err)
+	}
+	defer source.Close()
 
-	// Step 4: チャンク数計算（圧縮されたデータのサイズに基づく）
-	chunkCount := uint32((compressedSize + int64(ChunkSize) - 1) / int64(ChunkSize))
+	// Step 4: チャンク数計算（元ファイルのサイズに基づく）
+	chunkCount := source.Count()
 	logrus.Debugf("chunk count: %d", chunkCount)
 
 	// Step 5: ファイルインデックス情報送信 (SubConnで送信)
-	indexData := BaseData{
-		Type: FileIndex,
-		Data: FileIndexData{
-			FilePath:   filereq.FilePath,
-			TotalSize:  compressedSize, // 圧縮されたサイズ
-			ChunkCount: chunkCount,
-			FileHash:   originalFileHash, // 元のファイルハッシュ
-			ChunkSize:  ChunkSize,
-		},
-	}
-
-	err = Write(handle.Self.SubConn, handle.Peer.SubAddr.StrAddr(), &indexData)
+	index := &FileIndexData{
+		FilePath:   filereq.FilePath,
+		TotalSize:  payloadSize,
+		ChunkCount: chunkCount,
+		FileHash:   originalFileHash, // 元のファイルハッシュ
+		HashAlgo:   hashAlgo,
+		ChunkSize:  chunkSize,
+	}
+	if segments != nil {
+		index.SegmentChunks = merkleSegmentChunks
+		index.MerkleRoot = merkleRoot(segments)
+	}
+	if payloadPath != fullpath {
+		index.Delta = true
+		index.TargetSize = fileInfo.Size()
+	}
+
+	// FEC: ブロックごとにパリティチャンクを付け、受信側で欠落を再送無しに復元できるようにする
+	var fec *fecEncoder
+	if filereq.Redundancy > 0 && chunkCount > 0 {
+		index.FecBlock = fecBlockChunks
+		index.FecParity = fecParity(filereq.Redundancy)
+		fec, err = newFecEncoder(file, index)
+		if err != nil {
+			tr.SendError(&ErrorPacketData{Error: "failed to set up fec", Code: FailedFileOperations})
+			return fmt.Errorf("failed to set up fec: %v", err)
+		}
+	}
+
+	stopPreparing()
+	err = tr.write(&BaseData{Type: FileIndex, Data: index})
 	if err != nil {
 		return fmt.Errorf("failed to send file index: %v", err)
 	}
 
-	logrus.Infof("Sent file index - Original size: %d bytes, Compressed size: %d bytes, Chunks: %d",
-		len(raw), compressedSize, chunkCount)
+	logrus.Infof("Sent file index - Size: %d bytes, Chunks: %d", payloadSize, chunkCount)
+	if fec != nil {
+		logrus.Infof("FEC enabled: %d parity chunks per %d data chunks", index.FecParity, index.FecBlock)
+	}
 
-	// Step 6: 転送開始信号を待機
+	// Step 6: 転送開始信号を待機 (FileIndex が落ちると受信側は待ち続けるので、合図が来るまで送り直す)
 	logrus.Info("Waiting for transfer start signal...")
+	resume := false
+	lastHeard := time.Now()
 	for {
-		meta, err := receiveFromPeer(handle.Self, handle.Peer, true)
+		meta, err := tr.receiveFrame(keepaliveInterval)
+		if errors.Is(err, errTransferTimeout) && time.Since(lastHeard) < peerTimeout {
+			err = tr.write(&BaseData{Type: FileIndex, Data: index})
+			if err != nil {
+				return fmt.Errorf("failed to send file index: %v", err)
+			}
+			continue
+		}
 		if err != nil {
-			logrus.Debug(fmt.Sprintf("failed to receive start signal: %v", err))
+			return fmt.Errorf("failed to receive start signal: %v", err)
+		}
+		lastHeard = time.Now()
+
+		if meta.Type == StartTransfer {
+			resume = meta.Data.(*StartTransferData).Resume
+			break
+		}
+
+		// 開始前に変わった帯域上限は送信開始時から使う
+		if meta.Type == RateUpdate {
+			filereq.RateLimit = meta.Data.(*RateUpdateData).Rate
 			continue
 		}
 
-		if meta.Type == Message {
-			if data, ok := meta.Data.(map[string]interface{}); ok {
-				if action, exists := data["action"]; exists && action == "start_transfer" {
-					break
-				}
+		// 受信側は開始前にセグメントのハッシュを取りに来る
+		if meta.Type == SegmentHashRequest {
+			page := segmentHashPage(handle.Peer, segments, meta.Data.(*SegmentHashRequestData).Offset)
+			err = tr.write(&BaseData{Type: SegmentHashes, Data: page})
+			if err != nil {
+				return fmt.Errorf("failed to send segment hashes: %v", err)
 			}
 		}
 	}
 
-	// Step 7: 初回ファイル送信
-	logrus.Info("Starting file transmission...")
-	compressedReader := bytes.NewReader(compressed)
-	err = sendFileChunks(handle, compressedReader, chunkCount)
+	// 以降の制御パケットは送信と並行して読む (フィードバックで送信レートを、SACK で再送を決める)
+	cc := newCongestionController(chunkSize)
+	if fec != nil {
+		cc.SetFecRatio(float64(index.FecParity) / float64(index.FecBlock+index.FecParity))
+	}
+	board := newSackScoreboard(chunkCount)
+	limit := NewRateLimiter(filereq.RateLimit)
+	control := startControlReader(tr, cc, board, limit)
+	defer control.Stop()
+
+	sender := &chunkSender{tr: tr, source: source, cc: cc, limit: limit, fec: fec}
+	if filereq.RateLimit > 0 {
+		logrus.Infof("Peer requested bandwidth limit: %s", utils.FormatRate(filereq.RateLimit))
+	}
+
+	// Step 7: ファイル送信 (再開時は受信済みチャンクを SACK で知ってから始める)
+	if resume {
+		logrus.Info("Resuming file transmission...")
+		board.WaitCovered(resumeSweepTimeout)
+	} else {
+		logrus.Info("Starting file transmission...")
+	}
+
+	err = sendFileChunks(sender, board, control.packets)
 	if err != nil {
 		return fmt.Errorf("failed to send file chunks: %v", err)
 	}
 
-	// Step 8: 欠落チャンクの再送処理
-	retryCount := 0
+	logrus.Info("File transfer completed successfully")
+	logrus.Debugf("Final send rate: %.0f bytes/s", cc.Rate())
+	return nil
+}
 
-	for retryCount < MaxRetries {
-		// 欠落チャンクリストまたは終了パケットを待機
-		logrus.Debug("Waiting for missing chunks request or finish packet...")
+// sendFileChunks は受信側から終了通知が来るまでチャンクを送り続ける
+// SACK で欠落が分かったチャンクは初回送信の途中でもすぐに再送する
+func sendFileChunks(sender *chunkSender, board *sackScoreboard, packets <-chan *BaseData) error {
+	sent := 0
+	for {
+		// 受信側からの終了/エラー通知
+		select {
+		case meta, ok := <-packets:
+			done, err := handleTransferControl(meta, ok)
+			if done || err != nil {
+				return err
+			}
+		default:
+		}
+
+		index, ok := board.Next()
+		if !ok {
+			// 今送るものが無い: SACK か終了通知を待つ
+			// 受信側はハッシュの検証中も SACK を送り続けるので、全チャンク届いた後も SACK が途絶えたら諦める
+			if board.SinceLastSack() > peerTimeout {
+				if board.Complete() {
+					// 終了通知が落ちたか、受信側が検証中に居なくなった
+					return fmt.Errorf("receiver did not confirm the transfer for %d seconds", PeerTimeoutSeconds)
+				}
+				sender.tr.SendError(&ErrorPacketData{Error: "no response from receiver", Code: LimitExceeded})
+				return fmt.Errorf("no response from peer for %d seconds", PeerTimeoutSeconds)
+			}
 
-		// 分割パケットを受信して結合
-		missingChunks, finished, err := receiveMissingChunksList(handle)
+			select {
+			case meta, ok := <-packets:
+				done, err := handleTransferControl(meta, ok)
+				if done || err != nil {
+					return err
+				}
+			case <-board.notify:
+			case <-time.After(sackInterval):
+			}
+			continue
+		}
+
+		err := sender.send(index)
 		if err != nil {
-			handle.SendError(&ErrorPacketData{Error: "failed to receive missing chunks list", Code: FaildReceive}, true)
-			//retry
-			return fmt.Errorf("failed to receive missing chunks list: %v", err)
+			sender.tr.SendError(&ErrorPacketData{Error: "failed to send chunk", Code: FailedFileOperations})
+			return err
 		}
+		board.OnSent(index)
 
-		if finished {
-			logrus.Info("File transfer completed successfully")
-			return nil
+		// ブロックを送り終えたらパリティを続けて送る
+		err = sender.sendParity(index)
+		if err != nil {
+			sender.tr.SendError(&ErrorPacketData{Error: "failed to send parity", Code: FailedFileOperations})
+			return err
 		}
 
-		if len(missingChunks) == 0 {
-			logrus.Info("No missing chunks, transfer completed")
-			return nil
+		sent++
+		if sent%1000 == 0 {
+			logrus.Debugf("Sent %d chunks (%d in file)", sent, sender.source.Count())
 		}
+	}
+}
 
-		logrus.Infof("Resending %d missing chunks (retry %d/%d)",
-			len(missingChunks), retryCount+1, MaxRetries)
+// handleTransferControl は転送中に届いた制御パケットを処理する。転送が終わったら true
+func handleTransferControl(meta *BaseData, ok bool) (bool, error) {
+	if !ok {
+		return false, fmt.Errorf("failed to receive response: connection closed")
+	}
 
-		// 圧縮されたデータから欠落チャンクを再送
-		err = sendMissingChunks(handle, compressed, missingChunks)
-		if err != nil {
-			handle.SendError(&ErrorPacketData{Error: "failed to receive missing chunks", Code: FaildReceive}, true)
-			//retry
-			return fmt.Errorf("failed to resend missing chunks: %v", err)
+	switch meta.Type {
+	case Error:
+		errpacket := meta.Data.(*ErrorPacketData)
+		return false, &PeerError{Code: errpacket.Code, Message: errpacket.Error}
+	case Finish:
+		finishData := meta.Data.(*FinishPacketData)
+		if !finishData.Success {
+			return false, fmt.Errorf("file transfer failed: %s", finishData.Message)
 		}
+		return true, nil
+	}
+
+	return false, nil
+}
 
-		retryCount++
+// controlReader は送信中に届く制御パケットを読み続け、
+// フィードバックは輻輳制御へ、SACK はスコアボードへ、帯域上限の変更は limit へ、それ以外は packets へ渡す
+type controlReader struct {
+	packets chan *BaseData
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func startControlReader(tr *transfer, cc *congestionController, board *sackScoreboard, limit *RateLimiter) *controlReader {
+	r := &controlReader{
+		packets: make(chan *BaseData, 16),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
+	go r.run(tr, cc, board, limit)
 
-	handle.SendError(&ErrorPacketData{Error: "maximum retries exceeded, file transfer failed", Code: LimitExceeded}, true)
-	//retry
-	return fmt.Errorf("maximum retries exceeded, file transfer failed")
+	return r
 }
 
-func receiveMissingChunksList(handle *Handle) ([]uint32, bool, error) {
-	receivedPackets := make(map[uint32][]uint32)
-	var totalPackets uint32
+func (r *controlReader) run(tr *transfer, cc *congestionController, board *sackScoreboard, limit *RateLimiter) {
+	defer close(r.stopped)
+	defer close(r.packets)
 
 	for {
-		meta, err := receiveFromPeer(handle.Self, handle.Peer, true)
-		if err != nil {
-			return nil, false, fmt.Errorf("failed to receive response: %v", err)
+		var meta *BaseData
+		select {
+		case meta = <-tr.frames:
+		case <-r.done:
+			return
 		}
 
-		if meta.Type == Message {
-			// 終了パケットの確認
-			if finishData, err := convertMapToFinishPacketData(meta.Data); err == nil {
-				if finishData.Success {
-					return nil, true, nil
-				} else {
-					return nil, false, fmt.Errorf("file transfer failed: %v", finishData)
-				}
-			}
-		} else if meta.Type == PacketInfo {
-			// 欠落チャンクリストの処理
-			if missingData, err := convertMapToMissingPacketData(meta.Data); err == nil {
-				// 分割パケットの場合
-				if missingData.TotalPackets > 1 {
-					receivedPackets[missingData.PacketIndex] = missingData.MissingChunks
-					totalPackets = missingData.TotalPackets
-
-					// 全てのパケットが受信されたかチェック
-					if len(receivedPackets) == int(totalPackets) {
-						// パケットを順番に結合
-						allMissingChunks := make([]uint32, 0)
-						for i := uint32(0); i < totalPackets; i++ {
-							if chunks, exists := receivedPackets[i]; exists {
-								allMissingChunks = append(allMissingChunks, chunks...)
-							}
-						}
-						return allMissingChunks, false, nil
-					}
-					// まだ全てのパケットが揃っていない場合は継続
-					continue
-				} else {
-					// 単一パケットの場合（従来の処理）
-					return missingData.MissingChunks, false, nil
-				}
-			}
+		switch meta.Type {
+		case Feedback:
+			cc.OnFeedback(meta.Data.(*FeedbackData))
+			continue
+		case Sack:
+			board.OnSack(meta.Data.(*SackData), cc.RetransmitTimeout())
+			continue
+		case Resend:
+			resend := meta.Data.(*ResendData)
+			logrus.Warnf("Peer failed to verify chunks %d-%d, sending them again", resend.Start, resend.Start+resend.Count-1)
+			board.Requeue(resend.Start, resend.Count)
+			continue
+		case RateUpdate:
+			rate := meta.Data.(*RateUpdateData).Rate
+			logrus.Infof("Peer changed bandwidth limit: %s", formatLimit(rate))
+			limit.SetRate(rate)
+			continue
 		}
-	}
-}
 
-// sendFileChunks sends all file chunks sequentially
-func sendFileChunks(handle *Handle, reader io.Reader, chunkCount uint32) error {
-	buffer := make([]byte, ChunkSize)
-
-	for i := uint32(0); i < chunkCount; i++ {
-		// チャンクデータ読み込み
-		n, err := reader.Read(buffer)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("failed to read chunk %d: %v", i, err)
+		select {
+		case r.packets <- meta:
+		case <-r.done:
+			return
 		}
+	}
+}
 
-		if n == 0 {
-			break // データの終端
-		}
+func (r *controlReader) Stop() {
+	close(r.done)
+	<-r.stopped
+}
 
-		// チャンクデータの実際のサイズに調整
-		chunkData := buffer[:n]
+// chunkSender はディスクから読んだチャンクを輻輳制御に従ってペーシングしながら送る
+// 受信側が指定した帯域制限とセッションの帯域制限も守る
+type chunkSender struct {
+	tr     *transfer
+	source *fileChunkSource
+	cc     *congestionController
+	limit  *RateLimiter
+	fec    *fecEncoder // FEC 無しなら nil
+}
 
-		// チャンク送信
-		err = sendSingleChunk(handle, i, chunkData)
-		if err != nil {
-			return fmt.Errorf("failed to send chunk %d: %v", i, err)
-		}
+func (s *chunkSender) send(index uint32) error {
+	// チャンクデータ読み込み
+	chunkData, flags, err := s.source.ReadChunk(index)
+	if err != nil {
+		return fmt.Errorf("failed to read chunk %d: %v", index, err)
+	}
 
-		// 進捗表示
-		if (i+1)%100 == 0 || (i+1) == chunkCount {
-			logrus.Debugf("Sent chunk %d/%d", i+1, chunkCount)
-		}
+	// チャンク送信
+	err = s.pace(index, flags, chunkData)
+	if err != nil {
+		return fmt.Errorf("failed to send chunk %d: %v", index, err)
 	}
 
 	return nil
 }
 
-// sendMissingChunks resends specific missing chunks from compressed data
-func sendMissingChunks(handle *Handle, compressedData []byte, missingChunks []uint32) error {
-	reader := bytes.NewReader(compressedData)
-	buffer := make([]byte, ChunkSize)
-
-	for _, chunkIndex := range missingChunks {
-		// 圧縮されたデータの該当位置にシーク
-		offset := int64(chunkIndex) * int64(ChunkSize)
-		_, err := reader.Seek(offset, 0)
-		if err != nil {
-			return fmt.Errorf("failed to seek compressed data for missing chunk %d: %v", chunkIndex, err)
-		}
+// sendParity は index でブロックが揃った場合にそのブロックのパリティチャンクを送る
+func (s *chunkSender) sendParity(index uint32) error {
+	if s.fec == nil {
+		return nil
+	}
 
-		// チャンクデータ読み込み
-		n, err := reader.Read(buffer)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("failed to read missing chunk %d: %v", chunkIndex, err)
-		}
+	block, ok := s.fec.BlockDone(index)
+	if !ok {
+		return nil
+	}
 
-		// チャンクデータの実際のサイズに調整
-		chunkData := buffer[:n]
+	parity, err := s.fec.Encode(block)
+	if err != nil {
+		return fmt.Errorf("failed to encode parity for block %d: %v", block, err)
+	}
 
-		// チャンク送信
-		err = sendSingleChunk(handle, chunkIndex, chunkData)
+	for i, data := range parity {
+		parityIndex := block*uint32(len(parity)) + uint32(i)
+		err = s.pace(parityIndex, ChunkParity, data)
 		if err != nil {
-			return fmt.Errorf("failed to resend chunk %d: %v", chunkIndex, err)
+			return fmt.Errorf("failed to send parity %d: %v", parityIndex, err)
 		}
-
-		logrus.Debugf("Resent missing chunk %d", chunkIndex)
 	}
 
 	return nil
 }
 
+// pace は帯域制限と輻輳制御に従って待ってから1チャンク送る
+func (s *chunkSender) pace(index uint32, flags uint8, data []byte) error {
+	size := chunkHeaderSize + len(data)
+	s.limit.Wait(size)
+	s.tr.handle.Limit.Wait(size)
+	s.cc.SetCeiling(minLimit(s.limit.Rate(), s.tr.handle.Limit.Rate()))
+	seq := s.cc.Pace(size)
+
+	return sendSingleChunk(s.tr, index, flags, seq, data)
+}
+
 // sendSingleChunk sends a single file chunk using custom protocol
-func sendSingleChunk(handle *Handle, index uint32, data []byte) error {
+func sendSingleChunk(tr *transfer, index uint32, flags uint8, seq uint32, data []byte) error {
 	// チェックサム計算
 	checksum := crc32.ChecksumIEEE(data)
 	length := uint32(len(data))
 
 	// カスタムプロトコルでパケット構成
-	// [Index:4][Length:4][Checksum:4][Data:Length]
-	packet := make([]byte, 12+length)
-
-	binary.LittleEndian.PutUint32(packet[0:4], index)
-	binary.LittleEndian.PutUint32(packet[4:8], length)
-	binary.LittleEndian.PutUint32(packet[8:12], checksum)
-	copy(packet[12:], data)
+	// [Magic:2][Transfer:4][Index:4][Length:4][Checksum:4][Flags:1][Seq:4][Data:Length]
+	packet := make([]byte, chunkHeaderSize+length)
+
+	copy(packet[0:2], chunkMagic)
+	binary.LittleEndian.PutUint32(packet[2:6], tr.ID)
+	binary.LittleEndian.PutUint32(packet[6:10], index)
+	binary.LittleEndian.PutUint32(packet[10:14], length)
+	binary.LittleEndian.PutUint32(packet[14:18], checksum)
+	packet[18] = flags
+	binary.LittleEndian.PutUint32(packet[19:23], seq)
+	copy(packet[chunkHeaderSize:], data)
 
 	// UDP送信
-	_, err := handle.Self.SubConn.WriteToUDP(packet, &net.UDPAddr{
-		IP:   handle.Peer.SubAddr.Ip,
-		Port: handle.Peer.SubAddr.Port,
-	})
+	return sendRaw(tr.handle.Self, tr.handle.Peer, true, packet)
+}
+
+// keepPreparing は返り値の関数が呼ばれるまで、FileIndex を用意していることを定期的に知らせる
+// 返り値の関数は何度呼んでもよい
+func keepPreparing(tr *transfer) func() {
+	if !tr.handle.Peer.Caps.Has(CapPreparing) {
+		return func() {}
+	}
 
-	return err
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		// 最初の通知はすぐに送り、受信側がリクエストを送り直さずに済むようにする
+		tr.write(&BaseData{Type: Preparing, Data: &PreparingData{}})
+		ticker := time.NewTicker(keepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tr.write(&BaseData{Type: Preparing, Data: &PreparingData{}})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
 }
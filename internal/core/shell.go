@@ -1,5 +1,7 @@
 package core
 
+import "fmt"
+
 func (a *ShellArgs) Next() *ShellArgs {
 	a.Arg = a.Arg[1:]
 	return a
@@ -12,3 +14,34 @@ func (a *ShellArgs) Head() string {
 func (a *ShellArgs) Len() int {
 	return len(a.Arg)
 }
+
+// TakeOption は "--name value" を引数から取り除いて value を返す
+func (a *ShellArgs) TakeOption(name string) (string, bool, error) {
+	for i, arg := range a.Arg {
+		if arg != "--"+name {
+			continue
+		}
+
+		if i+1 >= len(a.Arg) {
+			return "", false, fmt.Errorf("option --%s needs a value", name)
+		}
+
+		value := a.Arg[i+1]
+		a.Arg = append(a.Arg[:i:i], a.Arg[i+2:]...)
+		return value, true, nil
+	}
+
+	return "", false, nil
+}
+
+// TakeFlag は "--name" を引数から取り除き、指定されていたかを返す
+func (a *ShellArgs) TakeFlag(name string) bool {
+	for i, arg := range a.Arg {
+		if arg == "--"+name {
+			a.Arg = append(a.Arg[:i:i], a.Arg[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
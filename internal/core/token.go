@@ -1,41 +1,138 @@
 package core
 
 import (
-	"QuickPort/enc52"
-	"strconv"
+	"QuickPort/enc32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+// トークン (v2) はバイナリを Crockford の base32 で表し、5文字ごとに "-" で区切る
+// [Version:1][IPLen:1][IP][Port:2][Expiry:4][Secret:16][NameLen:1][Name][CRC:2]
+// 末尾の CRC-16 で打ち間違いを検出する
+const (
+	tokenVersion  = 2
+	tokenLifetime = 24 * time.Hour
+	tokenGroup    = 5
+	maxTokenName  = 64
+
+	TokenScheme = "quickport://" // QR コードなどで渡すときの URI の形 (quickport://<token>)
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errTokenTypo    = errors.New("token checksum mismatch, check for typos")
+	errTokenExpired = errors.New("token has expired")
+)
+
+// GenToken は接続先と、接続の認証に使う秘密をトークンにする (有効期限は self.Expiry)
 func GenToken(self *SelfConfig) string {
-	ip := string(self.Addr.Ip)
-	port := strconv.Itoa(self.Addr.Port)
-	name := self.Name
+	ip := self.Addr.Ip.To4()
+	if ip == nil {
+		ip = self.Addr.Ip.To16()
+	}
+
+	name := truncateName(self.Name, maxTokenName)
 
-	raw := strings.Join([]string{ip, port, name}, ":")
-	token := enc52.Encode(raw)
+	raw := []byte{tokenVersion, byte(len(ip))}
+	raw = append(raw, ip...)
+	raw = binary.LittleEndian.AppendUint16(raw, uint16(self.Addr.Port))
+	raw = binary.LittleEndian.AppendUint32(raw, uint32(self.Expiry.Unix()))
+	raw = append(raw, self.Secret...)
+	raw = append(raw, byte(len(name)))
+	raw = append(raw, name...)
+	raw = binary.LittleEndian.AppendUint16(raw, crc16(raw))
 
-	return token
+	return enc32.Group(enc32.Encode(raw), tokenGroup)
 }
 
+// TokenURI はトークンを URI にする
+func TokenURI(token string) string {
+	return TokenScheme + token
+}
+
+// ParseToken はトークン (または TokenURI の形) を読む。壊れたトークンや期限切れのトークンはエラー
 func ParseToken(token string) (*PeerConfig, error) {
-	raw, err := enc52.Decode(token)
+	token = strings.TrimSpace(token)
+	if len(token) >= len(TokenScheme) && strings.EqualFold(token[:len(TokenScheme)], TokenScheme) {
+		token = strings.TrimSuffix(token[len(TokenScheme):], "/")
+	}
+
+	raw, err := enc32.Decode(token)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
 	}
 
-	ip := []byte(strings.Split(raw, ":")[0])
-	port, err := strconv.Atoi(strings.Split(raw, ":")[1])
-	name := strings.Split(raw, ":")[2]
+	if len(raw) < 3 {
+		return nil, errInvalidToken
+	}
+	body, sum := raw[:len(raw)-2], binary.LittleEndian.Uint16(raw[len(raw)-2:])
+	if crc16(body) != sum {
+		return nil, errTokenTypo
+	}
 
-	if err != nil {
-		return nil, err
+	r := &wireReader{buf: body}
+	if r.u8() != tokenVersion {
+		return nil, fmt.Errorf("%w: unsupported token version", errInvalidToken)
+	}
+
+	ipLen := int(r.u8())
+	if ipLen != net.IPv4len && ipLen != net.IPv6len {
+		return nil, fmt.Errorf("%w: bad address", errInvalidToken)
+	}
+	ip := net.IP(append([]byte(nil), r.take(ipLen)...))
+	port := r.take(2)
+	expiry := r.u32()
+	secret := append([]byte(nil), r.take(tokenSecretSize)...)
+	name := string(r.take(int(r.u8())))
+	if r.err != nil || len(r.buf) != 0 {
+		return nil, errInvalidToken
+	}
+
+	if time.Now().After(time.Unix(int64(expiry), 0)) {
+		return nil, errTokenExpired
 	}
 
 	return &PeerConfig{
 		Addr: &Address{
 			Ip:   ip,
-			Port: port,
+			Port: int(binary.LittleEndian.Uint16(port)),
 		},
-		Name: name,
+		Name:   name,
+		Secret: secret,
 	}, nil
 }
+
+// truncateName は名前を n バイト以内に切り詰める (文字の途中では切らない)
+func truncateName(name string, n int) string {
+	if len(name) <= n {
+		return name
+	}
+
+	name = name[:n]
+	for len(name) > 0 && !utf8.ValidString(name) {
+		name = name[:len(name)-1]
+	}
+	return name
+}
+
+// crc16 は CRC-16/CCITT-FALSE
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
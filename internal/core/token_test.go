@@ -0,0 +1,146 @@
+package core
+
+import (
+	"QuickPort/enc32"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTokenSelf(ip string) *SelfConfig {
+	return &SelfConfig{
+		Name:   "laptop",
+		Addr:   &Address{Ip: net.ParseIP(ip), Port: 55189},
+		Secret: bytes.Repeat([]byte{0xa5}, tokenSecretSize),
+		Expiry: time.Now().Add(time.Hour),
+	}
+}
+
+// sealToken は body に CRC を付けてトークンの文字列にする (中身の壊れたトークンを作るため)
+func sealToken(body []byte) string {
+	raw := binary.LittleEndian.AppendUint16(append([]byte(nil), body...), crc16(body))
+	return enc32.Group(enc32.Encode(raw), tokenGroup)
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		wrap func(string) string
+	}{
+		{"ipv4", "192.0.2.10", func(s string) string { return s }},
+		{"ipv6", "2001:db8::1", func(s string) string { return s }},
+		{"ipv4-mapped ipv6", "::ffff:192.0.2.10", func(s string) string { return s }},
+		{"uri", "2001:db8::1", TokenURI},
+		{"uri with spaces and slash", "192.0.2.10", func(s string) string { return "  QUICKPORT://" + s + "/\n" }},
+		{"lower case without dashes", "192.0.2.10", func(s string) string { return strings.ToLower(strings.ReplaceAll(s, "-", "")) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			self := testTokenSelf(tt.ip)
+			peer, err := ParseToken(tt.wrap(GenToken(self)))
+			if err != nil {
+				t.Fatalf("ParseToken: %v", err)
+			}
+			if !peer.Addr.Ip.Equal(self.Addr.Ip) || peer.Addr.Port != self.Addr.Port {
+				t.Errorf("address = %s:%d, want %s:%d", peer.Addr.Ip, peer.Addr.Port, self.Addr.Ip, self.Addr.Port)
+			}
+			if peer.Name != self.Name || !bytes.Equal(peer.Secret, self.Secret) {
+				t.Errorf("peer = %q %x, want %q %x", peer.Name, peer.Secret, self.Name, self.Secret)
+			}
+		})
+	}
+}
+
+func TestParseTokenErrors(t *testing.T) {
+	self := testTokenSelf("192.0.2.10")
+	token := GenToken(self)
+	raw, err := enc32.Decode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := raw[:len(raw)-2]
+
+	expired := testTokenSelf("192.0.2.10")
+	expired.Expiry = time.Now().Add(-time.Minute)
+
+	badCRC := append([]byte(nil), raw...)
+	badCRC[len(badCRC)-1] ^= 0xff
+
+	badVersion := append([]byte(nil), body...)
+	badVersion[0] = tokenVersion + 1
+
+	badIPLen := append([]byte(nil), body...)
+	badIPLen[1] = 5
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"empty", "", errInvalidToken},
+		{"not base32", "!!!!!", errInvalidToken},
+		{"too short", enc32.Encode(raw[:2]), errInvalidToken},
+		{"truncated", enc32.Encode(raw[:len(raw)-3]), errTokenTypo},
+		{"bad crc", enc32.Encode(badCRC), errTokenTypo},
+		{"expired", GenToken(expired), errTokenExpired},
+		{"unsupported version", sealToken(badVersion), errInvalidToken},
+		{"bad address length", sealToken(badIPLen), errInvalidToken},
+		{"short body", sealToken(body[:len(body)-4]), errInvalidToken},
+		{"trailing bytes", sealToken(append(append([]byte(nil), body...), 0)), errInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseToken(tt.token)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("ParseToken() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// 打ち間違いや途中で切れたトークンでも ParseToken は panic しない
+func TestParseTokenNeverPanics(t *testing.T) {
+	token := GenToken(testTokenSelf("2001:db8::1"))
+	raw, err := enc32.Decode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := []string{"quickport://", "-----", "0"}
+	for i := 0; i <= len(token); i++ {
+		inputs = append(inputs, token[:i], TokenURI(token[i:]))
+	}
+	for i := 0; i < len(token); i++ {
+		for _, c := range "0Z-U~é" {
+			inputs = append(inputs, token[:i]+string(c)+token[i+1:])
+		}
+	}
+
+	// CRC を付け直した壊れた中身も読ませる
+	body := raw[:len(raw)-2]
+	for i := range body {
+		for _, v := range []byte{0, 1, 0x7f, 0xff} {
+			mutated := append([]byte(nil), body...)
+			mutated[i] = v
+			inputs = append(inputs, sealToken(mutated), sealToken(mutated[:i]))
+		}
+	}
+
+	for _, input := range inputs {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("ParseToken(%q) panicked: %v", input, r)
+				}
+			}()
+			ParseToken(input)
+		}()
+	}
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 転送ごとの受信キュー。溢れた分は UDP の取りこぼしと同じく捨て、SACK で再送してもらう
+const (
+	transferChunkQueue = 4096
+	transferFrameQueue = 64
+)
+
+var errTransferTimeout = errors.New("transfer timed out")
+
+// transfer は1つの get/送信。mux から自分の ID のパケットだけを受け取る
+type transfer struct {
+	ID     uint32
+	handle *Handle
+	frames chan *BaseData
+	chunks chan *FileChunk
+}
+
+// openTransfer は転送を登録する。id が 0 なら未使用の ID を新しく振る
+func (h *Handle) openTransfer(id uint32) (*transfer, error) {
+	m := h.startMux()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id == 0 {
+		for id == 0 || m.transfers[id] != nil {
+			id = rand.Uint32()
+		}
+	} else if m.transfers[id] != nil {
+		return nil, fmt.Errorf("transfer id %d is already in use", id)
+	}
+
+	t := &transfer{
+		ID:     id,
+		handle: h,
+		frames: make(chan *BaseData, transferFrameQueue),
+		chunks: make(chan *FileChunk, transferChunkQueue),
+	}
+	m.transfers[id] = t
+
+	return t, nil
+}
+
+// claimOutput は path への受信を始める。既に同じ path を受信中なら false
+func (h *Handle) claimOutput(path string) bool {
+	m := h.startMux()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.outputs[path] {
+		return false
+	}
+	m.outputs[path] = true
+
+	return true
+}
+
+func (h *Handle) releaseOutput(path string) {
+	h.mux.mu.Lock()
+	defer h.mux.mu.Unlock()
+
+	delete(h.mux.outputs, path)
+}
+
+// markDownload は転送を受信中として登録する (Close で外れる)
+func (t *transfer) markDownload() {
+	t.handle.mux.mu.Lock()
+	defer t.handle.mux.mu.Unlock()
+
+	t.handle.mux.downloads[t.ID] = true
+}
+
+// downloadIDs は受信中の転送 ID を返す
+func (h *Handle) downloadIDs() []uint32 {
+	m := h.startMux()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]uint32, 0, len(m.downloads))
+	for id := range m.downloads {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// Close は転送の登録を外す。以降この ID のパケットは捨てられる
+func (t *transfer) Close() {
+	t.handle.mux.mu.Lock()
+	defer t.handle.mux.mu.Unlock()
+
+	delete(t.handle.mux.transfers, t.ID)
+	delete(t.handle.mux.downloads, t.ID)
+}
+
+// write は転送 ID を付けて制御パケットを SubConn で送る
+func (t *transfer) write(data *BaseData) error {
+	data.Transfer = t.ID
+	return sendFrame(t.handle.Self, t.handle.Peer, true, data)
+}
+
+func (t *transfer) SendError(packet *ErrorPacketData) error {
+	return t.handle.sendTransferError(t.ID, packet)
+}
+
+// sendTransferError は自分では開いていない転送 ID 宛てにエラーを返す
+func (h *Handle) sendTransferError(id uint32, packet *ErrorPacketData) error {
+	return sendFrame(h.Self, h.Peer, true, &BaseData{Type: Error, Transfer: id, Data: packet})
+}
+
+// receiveFrame は制御パケットを待つ。timeout が 0 なら待ち続ける
+// 相手からの Error パケットは PeerError として返す
+func (t *transfer) receiveFrame(timeout time.Duration) (*BaseData, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case meta := <-t.frames:
+		return peerErrorOf(meta)
+	case <-expired:
+		return nil, errTransferTimeout
+	}
+}
+
+// receiveChunk はチャンクを timeout まで待つ。待っている間に届いた Error パケットは PeerError として返す
+func (t *transfer) receiveChunk(timeout time.Duration) (*FileChunk, error) {
+	// 受信中はキューが空になることが少ないので、タイマーを作らずに済むならそうする
+	select {
+	case chunk := <-t.chunks:
+		return chunk, nil
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case chunk := <-t.chunks:
+			return chunk, nil
+		case meta := <-t.frames:
+			_, err := peerErrorOf(meta)
+			if err != nil {
+				return nil, err
+			}
+			logrus.Debugf("Ignoring packet type %d while receiving chunks", meta.Type)
+		case <-timer.C:
+			return nil, errTransferTimeout
+		}
+	}
+}
+
+func peerErrorOf(meta *BaseData) (*BaseData, error) {
+	if meta.Type == Error {
+		errpacket := meta.Data.(*ErrorPacketData)
+		return nil, &PeerError{Code: errpacket.Code, Message: errpacket.Error}
+	}
+
+	return meta, nil
+}
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"QuickPort/tray"
+	"bytes"
 	"context"
 	"net"
 	"sync"
@@ -17,9 +19,25 @@ const (
 	FileReqest
 	FileIndex
 	File
-	PacketInfo
+	Sack
 	Ping
 	Error
+	Feedback
+	StartTransfer
+	Finish
+	Probe
+	ProbeAck
+	PathMTU
+	PutOffer
+	ManifestRequest
+	Manifest
+	SegmentHashRequest
+	SegmentHashes
+	Resend
+	SignatureRequest
+	Signatures
+	RateUpdate
+	Preparing
 )
 
 const (
@@ -32,6 +50,9 @@ const (
 	NetworkError
 	LimitExceeded
 	MissingChunk
+	ResumeRejected
+	PutDeclined
+	IsDirectory
 )
 
 const (
@@ -40,10 +61,20 @@ const (
 )
 
 const (
-	ChunkSize                  = 1400
-	MaxRetries                 = 10
-	ChunkTimeoutSeconds        = 1
-	MissingChunkTimeoutSeconds = 3
+	ChunkSize          = 1400 // 経路 MTU を探索できなかった場合のチャンクサイズ
+	PeerTimeoutSeconds = 10   // この間相手から何も届かなければ転送を諦める
+)
+
+// [Magic:2][Transfer:4][Index:4][Length:4][Checksum:4][Flags:1][Seq:4]
+// Magic で同じソケットに届く制御フレームと区別する
+const (
+	chunkMagic      = "QD"
+	chunkHeaderSize = 23
+)
+
+const (
+	ChunkCompressed uint8 = 1 << iota // チャンク単位で圧縮されている
+	ChunkParity                       // FEC のパリティチャンク (Index はパリティの通し番号)
 )
 
 type ReceiverController struct {
@@ -53,25 +84,53 @@ type ReceiverController struct {
 }
 
 type FileChunk struct {
+	Transfer uint32 // 転送 ID
 	Index    uint32 // チャンクインデックス
 	Length   uint32 // チャンクの長さ
 	Checksum uint32 // チャンクのチェックサム（CRC32）
+	Flags    uint8  // ChunkCompressed など
+	Seq      uint32 // 送信ごとに振られる通し番号 (再送でも増える)
 	Data     []byte // チャンク
 }
 
 // File index information
 type FileIndexData struct {
 	FilePath   string `json:"filepath"`
-	TotalSize  int64  `json:"total_size"`
+	TotalSize  int64  `json:"total_size"` // 元ファイルのサイズ
 	ChunkCount uint32 `json:"chunk_count"`
 	FileHash   string `json:"file_hash"`
+	HashAlgo   string `json:"hash_algo"` // FileHash のアルゴリズム
 	ChunkSize  int    `json:"chunk_size"`
+	FecBlock   uint32 `json:"fec_block"`  // パリティを付けるブロックのデータチャンク数
+	FecParity  uint32 `json:"fec_parity"` // ブロックあたりのパリティチャンク数 (0 は FEC 無し)
+
+	SegmentChunks uint32 `json:"segment_chunks"` // Merkle 木の葉1つあたりのチャンク数 (0 は検証無し)
+	MerkleRoot    []byte `json:"merkle_root"`    // セグメントのハッシュから作った Merkle 木の根
+
+	Delta      bool  `json:"delta"`       // チャンクは差分 (TotalSize は差分の大きさ)
+	TargetSize int64 `json:"target_size"` // 差分から組み立てたファイルの大きさ
+}
+
+// SameFile は FEC の設定を除いて同じファイルの同じ分割か比べる
+func (d *FileIndexData) SameFile(other *FileIndexData) bool {
+	return d.FilePath == other.FilePath && d.TotalSize == other.TotalSize && d.ChunkCount == other.ChunkCount &&
+		d.FileHash == other.FileHash && d.HashAlgo == other.HashAlgo && d.ChunkSize == other.ChunkSize &&
+		d.SegmentChunks == other.SegmentChunks && bytes.Equal(d.MerkleRoot, other.MerkleRoot)
 }
 
-type MissingPacketData struct {
-	MissingChunks []uint32 `json:"missing_chunks"`
-	PacketIndex   uint32   `json:"packet_index"`  // 現在のパケットインデックス
-	TotalPackets  uint32   `json:"total_packets"` // 総パケット数
+// 受信側から送信側への選択的確認応答 (SACK)
+// CumAck 未満のチャンクは全て受信済み。Bitmap は Offset からの受信状況 (1ビット1チャンク)
+type SackData struct {
+	CumAck uint32
+	Offset uint32
+	Bitmap []byte
+}
+
+// 受信側から送信側への定期フィードバック (輻輳制御用)
+type FeedbackData struct {
+	HighestSeq uint32 `json:"highest_seq"` // 受信した最大のシーケンス番号
+	Received   uint32 `json:"received"`    // 受信したパケットの累計
+	Window     uint32 `json:"window"`      // 受け入れ可能な未確認パケット数
 }
 
 // Finish packet
@@ -85,15 +144,119 @@ type ShellArgs struct {
 	Handle *Handle
 }
 
+// BaseData は制御パケット。Data は Type に対応する型 (newPayload 参照)
 type BaseData struct {
-	Type dataType
-	Data interface{}
+	Type     dataType
+	Transfer uint32 // 転送 ID (転送に属さないパケットは 0)
+	Data     Payload
+}
+
+// Tray listing
+type TrayData []tray.FileMeta
+
+// Auth handshake
+type AuthData tray.AuthMeta
+
+// Text message
+type MessageData struct {
+	Text string
+}
+
+type PingData struct{}
+
+// 受信準備ができたことを送信側へ知らせる
+type StartTransferData struct {
+	Resume bool // true の場合、受信側の SACK で受信済みチャンクを知ってから送信を始める
+}
+
+// 経路 MTU 探索のプローブ (Padding でフレームの大きさを調整する)
+type ProbeData struct {
+	Padding []byte
+}
+
+// プローブが届いたことを知らせる (Size は受信したフレームの大きさ)
+type ProbeAckData struct {
+	Size uint32
+}
+
+// 探索で決めたセッションのデータグラムサイズ
+type PathMTUData struct {
+	Size uint32
 }
 
 type fileRequestData struct {
-	FilePath string
-	CompMode string
+	FilePath   string
+	CompMode   string
+	ResumeHash string // 途中から再開する場合、手元の部分ファイルの FileHash
+	RateLimit  int64  // 受信側が希望する帯域上限 (bytes/s, 0 は無制限)
+	Redundancy int    // FEC パリティの割合 (%, 0 は無し)
+	ChunkSize  int    // 再開時に前回と同じチャンクサイズを求める (0 は送信側に任せる)
+	Offer      bool   // put の申し出を受け入れるリクエスト (トレイのファイルは送らない)
+
+	DeltaBlockSize uint32 // 手元の古いファイルの署名のブロックサイズ
+	DeltaBlocks    uint32 // 署名のブロック数 (0 は差分転送しない)
+}
+
+// put でファイルを送りたいことを知らせる。受信側が受け入れると同じ転送 ID で FileReqest が返る
+type PutOfferData struct {
+	FileName string
+	Size     int64
+}
+
+// ディレクトリのファイル一覧を Offset 番目から求める
+type ManifestRequestData struct {
+	Path   string
+	Offset uint32
+}
+
+// ディレクトリのファイル一覧の一部 (データグラムに収まる分ずつ送る)
+type ManifestData struct {
+	Offset uint32
+	Total  uint32 // ディレクトリ全体のファイル数
+	Files  []ManifestEntry
+}
+
+type ManifestEntry struct {
+	Path string // ディレクトリからの相対パス (区切りは "/")
+	Size int64
+}
+
+// セグメントのハッシュを Offset 番目から求める (転送開始前)
+type SegmentHashRequestData struct {
+	Offset uint32
+}
+
+// セグメントのハッシュ一覧の一部 (32 バイトずつ連結)
+type SegmentHashData struct {
+	Offset uint32
+	Hashes []byte
+}
+
+// 検証に失敗したセグメントのチャンクを送り直してもらう
+type ResendData struct {
+	Start uint32
+	Count uint32
+}
+
+// 受信側の古いファイルの署名を Offset 番目のブロックから求める
+type SignatureRequestData struct {
+	Offset uint32
+}
+
+// 古いファイルの署名の一部 (ブロックごとに弱いチェックサム 4 バイトと強いハッシュ 16 バイト)
+type SignatureData struct {
+	Offset uint32
+	Blocks []byte
+}
+
+// 受信中の転送の帯域上限を変える (bytes/s, 0 は無制限)
+type RateUpdateData struct {
+	Rate int64
 }
+
+// 送信側が FileIndex を用意している間 (ハッシュの計算など) の生存通知
+type PreparingData struct{}
+
 type ErrorPacketData struct {
 	Error string
 	Code  ErrorCode
@@ -104,7 +267,11 @@ type Address struct {
 	Port int
 }
 type Handle struct {
-	Self  *SelfConfig
-	Peer  *PeerConfig
-	Pause chan bool
+	Self     *SelfConfig
+	Peer     *PeerConfig
+	Limit    *RateLimiter    // セッション全体の帯域制限 (送信に適用、get の既定値)
+	PeerTray []tray.FileMeta // 接続時に受け取った相手のトレイ一覧 (get のパターンの照合に使う)
+
+	mux    packetMux // 受信パケットの振り分け
+	offers putOffers // 相手からの put の申し出
 }
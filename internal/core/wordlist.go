@@ -0,0 +1,32 @@
+package core
+
+// pairingWords はペアリングコードに使う単語 (256語、1語 8 ビット)
+// 電話で読み上げても聞き間違えにくい、短くてよく知られた英単語
+var pairingWords = [256]string{
+	"acid", "acorn", "actor", "agent", "alarm", "album", "alert", "alpha", "amber", "angle", "apple",
+	"apron", "arena", "armor", "arrow", "atlas", "attic", "audio", "autumn", "bacon", "badge",
+	"bagel", "baker", "bamboo", "banana", "banjo", "barrel", "basil", "basket", "beacon", "beaver",
+	"bench", "berry", "bingo", "bison", "blanket", "bonus", "border", "bottle", "bounce", "bravo",
+	"breeze", "brick", "bridge", "bronze", "bubble", "bucket", "butter", "cabin", "cactus", "camel",
+	"camera", "candle", "canoe", "canyon", "captain", "carbon", "carpet", "carrot", "castle", "cedar",
+	"cello", "cement", "cherry", "chess", "circus", "citrus", "clover", "cobalt", "comet", "copper",
+	"coral", "cotton", "cougar", "cowboy", "coyote", "crayon", "crystal", "dahlia", "daisy", "dancer",
+	"delta", "denim", "desert", "diesel", "dinner", "doctor", "dollar", "dolphin", "domino", "donkey",
+	"dragon", "drum", "eagle", "echo", "elbow", "ember", "engine", "falcon", "feather", "fennel",
+	"ferry", "fiddle", "finch", "flute", "forest", "fossil", "fox", "galaxy", "garden", "garlic",
+	"gecko", "ginger", "glacier", "globe", "gopher", "granite", "grape", "guitar", "hammer", "harbor",
+	"harvest", "hazel", "helmet", "hero", "honey", "horizon", "hornet", "iceberg", "igloo", "indigo",
+	"island", "ivory", "jacket", "jaguar", "jelly", "jigsaw", "jungle", "kayak", "kettle", "kiwi",
+	"koala", "ladder", "lagoon", "lantern", "laptop", "lava", "lemon", "lilac", "lime", "linen",
+	"lizard", "llama", "lotus", "magnet", "mango", "maple", "marble", "meadow", "melon", "meteor",
+	"mint", "mirror", "mocha", "monkey", "moose", "mosaic", "muffin", "nectar", "needle", "noodle",
+	"nutmeg", "oasis", "ocean", "olive", "onion", "opal", "orange", "orbit", "orchid", "otter",
+	"oyster", "paddle", "panda", "papaya", "parrot", "pasta", "peach", "peanut", "pearl", "pebble",
+	"pepper", "piano", "pickle", "pilot", "pine", "pirate", "pizza", "planet", "plum", "polar",
+	"pony", "poppy", "prism", "puzzle", "quartz", "quiver", "rabbit", "radar", "radish", "raven",
+	"rhino", "ribbon", "river", "robot", "rocket", "saddle", "salmon", "sandal", "scarf", "sesame",
+	"shadow", "shark", "silver", "sketch", "sloth", "snail", "sonnet", "spider", "sponge", "sprout",
+	"squash", "stable", "summit", "sunset", "tango", "teapot", "temple", "thunder", "tiger", "tomato",
+	"topaz", "tractor", "tulip", "tundra", "turtle", "valley", "velvet", "violin", "waffle", "walnut",
+	"walrus", "wizard", "yogurt", "zebra", "zigzag",
+}
@@ -0,0 +1,83 @@
+package enc32
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Crockford の base32 (紛らわしい I, L, O, U を使わない)
+// 読むときは大文字小文字を区別せず、I と L は 1、O は 0 として読み、区切りの "-" と空白は無視する
+const alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func Encode(data []byte) string {
+	var sb strings.Builder
+	var acc uint32
+	bits := 0
+	for _, b := range data {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			sb.WriteByte(alphabet[acc>>bits&31])
+		}
+	}
+	if bits > 0 {
+		sb.WriteByte(alphabet[acc<<(5-bits)&31])
+	}
+
+	return sb.String()
+}
+
+func Decode(encoded string) ([]byte, error) {
+	decoded := make([]byte, 0, len(encoded)*5/8)
+	var acc uint32
+	bits := 0
+	for _, c := range strings.ToUpper(encoded) {
+		if c == '-' || c == ' ' {
+			continue
+		}
+
+		v := symbol(c)
+		if v < 0 {
+			return nil, fmt.Errorf("invalid character: %q", c)
+		}
+
+		acc = acc<<5 | uint32(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			decoded = append(decoded, byte(acc>>bits))
+		}
+	}
+
+	// 余りのビットは 0 のはず
+	if bits >= 5 || acc&(1<<bits-1) != 0 {
+		return nil, fmt.Errorf("invalid encoded length")
+	}
+
+	return decoded, nil
+}
+
+// Group は読みやすいように n 文字ごとに "-" で区切る
+func Group(encoded string, n int) string {
+	var sb strings.Builder
+	for i := 0; i < len(encoded); i += n {
+		if i > 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteString(encoded[i:min(i+n, len(encoded))])
+	}
+
+	return sb.String()
+}
+
+func symbol(c rune) int {
+	switch c {
+	case 'O':
+		return 0
+	case 'I', 'L':
+		return 1
+	}
+
+	return strings.IndexRune(alphabet, c)
+}
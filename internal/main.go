@@ -1,9 +1,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 
 	"QuickPort/core"
+	"QuickPort/rendezvous"
 	"QuickPort/shell"
 	"QuickPort/tray"
 	"QuickPort/utils"
@@ -13,7 +15,7 @@ import (
 
 func SelectMode() (utils.StartUpMode, error) {
 	//select mode
-	fmt.Println("Use token - 1\nGen token - 2")
+	fmt.Println("Use token - 1\nGen token - 2\nUse code - 3\nGen code - 4")
 
 	for {
 		tty, err := utils.UseTty()
@@ -31,6 +33,10 @@ func SelectMode() (utils.StartUpMode, error) {
 			return utils.UseToken, nil
 		case "2":
 			return utils.GenToken, nil
+		case "3":
+			return utils.UseCode, nil
+		case "4":
+			return utils.GenCode, nil
 		case "dev":
 			return utils.DebugLevel, nil
 		default:
@@ -41,14 +47,37 @@ func SelectMode() (utils.StartUpMode, error) {
 
 func main() {
 	utils.SetUpLogrus()
-	utils.OpenTty()
 
-	mode, err := SelectMode()
-	if err != nil {
-		logrus.Fatal(err)
+	tokenImage := flag.String("token-from-image", "", "read the token from a QR code in a PNG or JPEG file")
+	flag.Parse()
+
+	// quickport rendezvous [addr] で待ち合わせサーバーとして動く
+	if flag.Arg(0) == "rendezvous" {
+		addr := fmt.Sprintf(":%d", rendezvous.DefaultPort)
+		if flag.NArg() > 1 {
+			addr = flag.Arg(1)
+		}
+
+		err := rendezvous.NewServer().ListenAndServe(addr)
+		if err != nil {
+			logrus.Fatal(err)
+		}
 		return
 	}
 
+	utils.OpenTty()
+
+	// 画像からトークンを読むときはモードを選ばない
+	mode := utils.UseToken
+	var err error
+	if *tokenImage == "" {
+		mode, err = SelectMode()
+		if err != nil {
+			logrus.Fatal(err)
+			return
+		}
+	}
+
 	var handle *core.Handle
 	switch mode {
 	case utils.GenToken:
@@ -71,7 +100,43 @@ func main() {
 		}
 
 		for {
-			handle, err = core.Client()
+			if *tokenImage != "" {
+				handle, err = core.ClientFromImage(*tokenImage)
+				// 読めなければトークンの入力に戻る
+				*tokenImage = ""
+			} else {
+				handle, err = core.Client()
+			}
+			if err != nil {
+				logrus.Error(err)
+				logrus.Info("Restart Setup")
+				continue
+			}
+
+			break
+		}
+
+	case utils.GenCode:
+		err := tray.SetTray(utils.Tray1)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		handle, err = core.HostCode()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+
+	case utils.UseCode:
+		err := tray.SetTray(utils.Tray2)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+
+		for {
+			handle, err = core.ClientCode()
 			if err != nil {
 				logrus.Error(err)
 				logrus.Info("Restart Setup")
@@ -88,8 +153,7 @@ func main() {
 
 	fmt.Printf("%s:%d <==> %s:%d\n", handle.Self.Addr.Ip.String(), handle.Self.Addr.Port, handle.Peer.Addr.Ip.String(), handle.Peer.Addr.Port)
 
-	handle.Pause = make(chan bool)
-	go handle.Receiver()
+	handle.Receiver()
 
 	//ping
 	core.RecordPingTime()
@@ -0,0 +1,559 @@
+package qrcode
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"rsc.io/qr/coding"
+)
+
+// 画像から QR コードを読む
+// 端末のスクリーンショットを読むためのものなので、傾きや歪みの無い (軸に沿った) コードだけを扱う
+// 3つの位置検出パターンから格子を決め、形式情報は全ての誤り訂正レベルとマスクの候補と見比べて選ぶ
+// モジュールの配置は rsc.io/qr/coding の Plan をそのまま使う
+const (
+	maxFinderCandidates = 32
+	maxFunctionMismatch = 0.15 // 位置検出などの固定パターンの読み違いがこれを超える格子は捨てる
+	maxFormatMismatch   = 6    // 形式情報 (30 モジュール) の読み違いの上限
+)
+
+var ErrNotFound = errors.New("no qr code found in image")
+
+// DecodeFile は PNG か JPEG の画像ファイルから QR コードの文字列を読む
+func DecodeFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image %s: %v", path, err)
+	}
+
+	return Decode(img)
+}
+
+// Decode は画像から QR コードの文字列を読む。明暗が反転したコードも読む
+func Decode(img image.Image) (string, error) {
+	gray := newBitmap(img)
+	for _, inverted := range []bool{false, true} {
+		gray.inverted = inverted
+		text, err := gray.decode()
+		if err == nil {
+			return text, nil
+		}
+	}
+
+	return "", ErrNotFound
+}
+
+// bitmap は二値化した画像
+type bitmap struct {
+	width, height int
+	dark          []bool
+	inverted      bool
+}
+
+func newBitmap(img image.Image) *bitmap {
+	bounds := img.Bounds()
+	b := &bitmap{width: bounds.Dx(), height: bounds.Dy()}
+
+	luma := make([]uint8, b.width*b.height)
+	var histogram [256]int
+	for y := 0; y < b.height; y++ {
+		for x := 0; x < b.width; x++ {
+			r, g, bl, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			l := uint8((299*r + 587*g + 114*bl) / 1000 >> 8)
+			luma[y*b.width+x] = l
+			histogram[l]++
+		}
+	}
+
+	threshold := otsu(histogram, len(luma))
+	b.dark = make([]bool, len(luma))
+	for i, l := range luma {
+		b.dark[i] = int(l) <= threshold
+	}
+
+	return b
+}
+
+// otsu は明暗を最もよく分けるしきい値
+func otsu(histogram [256]int, total int) int {
+	var sum float64
+	for i, n := range histogram {
+		sum += float64(i * n)
+	}
+
+	var sumDark, best float64
+	weightDark, threshold := 0, 127
+	for i, n := range histogram {
+		weightDark += n
+		weightLight := total - weightDark
+		if weightDark == 0 {
+			continue
+		}
+		if weightLight == 0 {
+			break
+		}
+
+		sumDark += float64(i * n)
+		meanDark := sumDark / float64(weightDark)
+		meanLight := (sum - sumDark) / float64(weightLight)
+		between := float64(weightDark) * float64(weightLight) * (meanDark - meanLight) * (meanDark - meanLight)
+		if between > best {
+			best, threshold = between, i
+		}
+	}
+
+	return threshold
+}
+
+// at は (x, y) が暗い (QR の黒) モジュールか。画像の外は明るい
+func (b *bitmap) at(x, y int) bool {
+	if x < 0 || y < 0 || x >= b.width || y >= b.height {
+		return false
+	}
+
+	return b.dark[y*b.width+x] != b.inverted
+}
+
+// run は同じ色が続く区間
+type run struct {
+	dark  bool
+	start int
+	len   int
+}
+
+func (b *bitmap) runs(n int, at func(i int) bool) []run {
+	runs := []run{}
+	for i := 0; i < n; i++ {
+		d := at(i)
+		if len(runs) > 0 && runs[len(runs)-1].dark == d {
+			runs[len(runs)-1].len++
+			continue
+		}
+		runs = append(runs, run{dark: d, start: i, len: 1})
+	}
+
+	return runs
+}
+
+// finder は位置検出パターン (黒白黒白黒 = 1:1:3:1:1) の中心
+type finder struct {
+	x, y   float64
+	module struct{ w, h float64 }
+	count  int
+}
+
+// isFinderRatio は5つの区間が 1:1:3:1:1 に近いか。近ければ1モジュールの大きさを返す
+func isFinderRatio(r []run) (float64, bool) {
+	total := 0
+	for _, x := range r {
+		total += x.len
+	}
+	if total < 7 {
+		return 0, false
+	}
+
+	unit := float64(total) / 7
+	for i, x := range r {
+		expected, tolerance := unit, unit/2
+		if i == 2 {
+			expected, tolerance = 3*unit, 3*unit/2
+		}
+		if math.Abs(float64(x.len)-expected) >= tolerance {
+			return 0, false
+		}
+	}
+
+	return unit, true
+}
+
+func (b *bitmap) findFinders() []*finder {
+	finders := []*finder{}
+	columns := map[int][]run{}
+
+	for y := 0; y < b.height; y++ {
+		row := b.runs(b.width, func(x int) bool { return b.at(x, y) })
+		for i := 0; i+5 <= len(row); i++ {
+			if !row[i].dark {
+				continue
+			}
+			w, ok := isFinderRatio(row[i : i+5])
+			if !ok {
+				continue
+			}
+
+			// 中央の区間のどれかの列で、縦にも同じ比で並んでいるか確かめる
+			center := row[i+2]
+			h, cy, ok := 0.0, 0.0, false
+			for k := 0; k < center.len && !ok; k++ {
+				// 中心の列から外側へ順に試す
+				cx := center.start + center.len/2 + (k+1)/2*(1-2*(k%2))
+				if cx < center.start || cx >= center.start+center.len {
+					continue
+				}
+
+				column, cached := columns[cx]
+				if !cached {
+					column = b.runs(b.height, func(y int) bool { return b.at(cx, y) })
+					columns[cx] = column
+				}
+
+				j := sort.Search(len(column), func(j int) bool { return column[j].start+column[j].len > y })
+				if j < 2 || j+3 > len(column) {
+					continue
+				}
+				h, ok = isFinderRatio(column[j-2 : j+3])
+				if ok {
+					cy = float64(column[j].start) + float64(column[j].len)/2
+				}
+			}
+			if !ok {
+				continue
+			}
+
+			f := &finder{x: float64(center.start) + float64(center.len)/2, y: cy}
+			f.module.w, f.module.h = w, h
+			finders = mergeFinder(finders, f)
+		}
+	}
+
+	sort.Slice(finders, func(i, j int) bool { return finders[i].count > finders[j].count })
+	if len(finders) > maxFinderCandidates {
+		finders = finders[:maxFinderCandidates]
+	}
+
+	return finders
+}
+
+// mergeFinder は同じパターンを別の行で見つけたものをまとめる
+func mergeFinder(finders []*finder, f *finder) []*finder {
+	for _, o := range finders {
+		if math.Abs(o.x-f.x) <= o.module.w && math.Abs(o.y-f.y) <= o.module.h {
+			n := float64(o.count)
+			o.x = (o.x*n + f.x) / (n + 1)
+			o.y = (o.y*n + f.y) / (n + 1)
+			o.module.w = (o.module.w*n + f.module.w) / (n + 1)
+			o.module.h = (o.module.h*n + f.module.h) / (n + 1)
+			o.count++
+			return finders
+		}
+	}
+
+	f.count = 1
+	return append(finders, f)
+}
+
+// corners は左上・右上・左下の位置検出パターンの組
+type corners struct {
+	topLeft, topRight, bottomLeft *finder
+	score                         int
+}
+
+// modules は左上から右上・左下までのモジュール数 (モジュールの大きさは3つの平均)
+func (c corners) modules() (float64, float64) {
+	w := (c.topLeft.module.w + c.topRight.module.w + c.bottomLeft.module.w) / 3
+	h := (c.topLeft.module.h + c.topRight.module.h + c.bottomLeft.module.h) / 3
+	return (c.topRight.x - c.topLeft.x) / w, (c.bottomLeft.y - c.topLeft.y) / h
+}
+
+// findCorners は右と下に同じ距離で並ぶ3つの組を、見つかった回数の多い順に返す
+func findCorners(finders []*finder) []corners {
+	found := []corners{}
+	for _, tl := range finders {
+		for _, tr := range finders {
+			if tr == tl || tr.x <= tl.x || math.Abs(tr.y-tl.y) > 2*tl.module.h {
+				continue
+			}
+			for _, bl := range finders {
+				if bl == tl || bl == tr || bl.y <= tl.y || math.Abs(bl.x-tl.x) > 2*tl.module.w {
+					continue
+				}
+
+				c := corners{tl, tr, bl, tl.count + tr.count + bl.count}
+				across, down := c.modules()
+				if math.Abs(across-down) > 2+0.15*across {
+					continue
+				}
+
+				found = append(found, c)
+			}
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].score > found[j].score })
+	return found
+}
+
+func (b *bitmap) decode() (string, error) {
+	for _, c := range findCorners(b.findFinders()) {
+		across, down := c.modules()
+		estimate := int(math.Round(((across+down)/2 + 7 - 17) / 4))
+
+		for _, v := range []int{estimate, estimate - 1, estimate + 1} {
+			if v < coding.MinVersion || v > coding.MaxVersion {
+				continue
+			}
+
+			text, err := b.decodeGrid(c, coding.Version(v))
+			if err == nil {
+				return text, nil
+			}
+		}
+	}
+
+	return "", ErrNotFound
+}
+
+// decodeGrid はバージョン v の格子としてモジュールを読み、復号する
+func (b *bitmap) decodeGrid(c corners, v coding.Version) (string, error) {
+	size := 17 + 4*int(v)
+	stepX := (c.topRight.x - c.topLeft.x) / float64(size-7)
+	stepY := (c.bottomLeft.y - c.topLeft.y) / float64(size-7)
+
+	modules := make([][]bool, size)
+	for y := range modules {
+		modules[y] = make([]bool, size)
+		for x := range modules[y] {
+			modules[y][x] = b.sample(c.topLeft.x+float64(x-3)*stepX, c.topLeft.y+float64(y-3)*stepY, stepX, stepY)
+		}
+	}
+
+	base, err := coding.NewPlan(v, coding.L, 0)
+	if err != nil {
+		return "", err
+	}
+	if mismatch(base, modules, coding.Position, coding.Timing, coding.Alignment, coding.PVersion) > maxFunctionMismatch {
+		return "", ErrNotFound
+	}
+
+	// 形式情報が最も近い誤り訂正レベルとマスクを選ぶ
+	var plan *coding.Plan
+	best := maxFormatMismatch + 1
+	for l := coding.L; l <= coding.H; l++ {
+		for m := coding.Mask(0); m < 8; m++ {
+			p, err := coding.NewPlan(v, l, m)
+			if err != nil {
+				return "", err
+			}
+
+			n := countMismatch(p, modules, coding.Format)
+			if n < best {
+				plan, best = p, n
+			}
+		}
+	}
+	if plan == nil {
+		return "", ErrNotFound
+	}
+
+	data, err := readCodewords(plan, modules)
+	if err != nil {
+		return "", err
+	}
+
+	return parseSegments(data, v)
+}
+
+// sample はモジュールの中心付近の5点の多数決で色を決める
+func (b *bitmap) sample(x, y, w, h float64) bool {
+	points := [][2]float64{{0, 0}, {-w / 4, 0}, {w / 4, 0}, {0, -h / 4}, {0, h / 4}}
+	dark := 0
+	for _, p := range points {
+		if b.at(int(x+p[0]), int(y+p[1])) {
+			dark++
+		}
+	}
+
+	return dark >= 3
+}
+
+func countMismatch(plan *coding.Plan, modules [][]bool, roles ...coding.PixelRole) int {
+	n := 0
+	for y, row := range plan.Pixel {
+		for x, pix := range row {
+			for _, r := range roles {
+				if pix.Role() == r && (pix&coding.Black != 0) != modules[y][x] {
+					n++
+				}
+			}
+		}
+	}
+
+	return n
+}
+
+// mismatch は roles のモジュールのうち、期待と違う色だった割合
+func mismatch(plan *coding.Plan, modules [][]bool, roles ...coding.PixelRole) float64 {
+	total := 0
+	for _, row := range plan.Pixel {
+		for _, pix := range row {
+			for _, r := range roles {
+				if pix.Role() == r {
+					total++
+				}
+			}
+		}
+	}
+	if total == 0 {
+		return 1
+	}
+
+	return float64(countMismatch(plan, modules, roles...)) / float64(total)
+}
+
+// readCodewords はマスクを外してデータと誤り訂正のバイトを読み、誤りを直したデータを返す
+func readCodewords(plan *coding.Plan, modules [][]bool) ([]byte, error) {
+	raw := make([]byte, plan.DataBytes+plan.CheckBytes)
+	for y, row := range plan.Pixel {
+		for x, pix := range row {
+			role := pix.Role()
+			if role != coding.Data && role != coding.Check {
+				continue
+			}
+
+			// Plan の Black はマスクで反転するモジュール
+			if modules[y][x] != (pix&coding.Black != 0) {
+				o := pix.Offset()
+				raw[o/8] |= 1 << (7 - o&7)
+			}
+		}
+	}
+
+	// データは各ブロックの順に並び、その後に各ブロックの誤り訂正が続く (後ろのブロックほどデータが1バイト多い)
+	blocks := plan.Blocks
+	check := plan.CheckBytes / blocks
+	short := plan.DataBytes / blocks
+	extra := plan.DataBytes % blocks
+
+	data := make([]byte, 0, plan.DataBytes)
+	offset := 0
+	for i := 0; i < blocks; i++ {
+		n := short
+		if i >= blocks-extra {
+			n++
+		}
+
+		block := append([]byte(nil), raw[offset:offset+n]...)
+		block = append(block, raw[plan.DataBytes+i*check:plan.DataBytes+(i+1)*check]...)
+		err := correct(block, check)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, block[:n]...)
+		offset += n
+	}
+
+	return data, nil
+}
+
+const alphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// parseSegments はデータのビット列を文字列にする (数字・英数字・バイトのモード)
+func parseSegments(data []byte, v coding.Version) (string, error) {
+	r := &bitReader{data: data}
+	class := 0
+	switch {
+	case v > 26:
+		class = 2
+	case v > 9:
+		class = 1
+	}
+
+	var sb strings.Builder
+	for r.remaining() >= 4 {
+		mode := r.read(4)
+		switch mode {
+		case 0: // 終端
+			return sb.String(), nil
+
+		case 1: // 数字
+			n := r.read([3]int{10, 12, 14}[class])
+			for ; n >= 3; n -= 3 {
+				fmt.Fprintf(&sb, "%03d", r.read(10))
+			}
+			switch n {
+			case 2:
+				fmt.Fprintf(&sb, "%02d", r.read(7))
+			case 1:
+				fmt.Fprintf(&sb, "%d", r.read(4))
+			}
+
+		case 2: // 英数字
+			n := r.read([3]int{9, 11, 13}[class])
+			for ; n >= 2; n -= 2 {
+				pair := r.read(11)
+				if pair >= 45*45 {
+					return "", errors.New("invalid alphanumeric segment")
+				}
+				sb.WriteByte(alphanumeric[pair/45])
+				sb.WriteByte(alphanumeric[pair%45])
+			}
+			if n == 1 {
+				c := r.read(6)
+				if c >= 45 {
+					return "", errors.New("invalid alphanumeric segment")
+				}
+				sb.WriteByte(alphanumeric[c])
+			}
+
+		case 4: // バイト
+			n := r.read([3]int{8, 16, 16}[class])
+			for ; n > 0; n-- {
+				sb.WriteByte(byte(r.read(8)))
+			}
+
+		case 7: // ECI (文字コードの指定は無視する)
+			r.read(8)
+
+		default:
+			return "", fmt.Errorf("unsupported qr mode %d", mode)
+		}
+
+		if r.overrun {
+			return "", errors.New("truncated qr data")
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// bitReader はバイト列を上位ビットから読む
+type bitReader struct {
+	data    []byte
+	pos     int
+	overrun bool
+}
+
+func (r *bitReader) remaining() int {
+	return len(r.data)*8 - r.pos
+}
+
+func (r *bitReader) read(n int) int {
+	if n > r.remaining() {
+		r.overrun = true
+		r.pos = len(r.data) * 8
+		return 0
+	}
+
+	v := 0
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | int(bit)
+		r.pos++
+	}
+
+	return v
+}
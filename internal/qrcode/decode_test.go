@@ -0,0 +1,217 @@
+package qrcode
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"rsc.io/qr"
+	"rsc.io/qr/coding"
+	"rsc.io/qr/gf256"
+)
+
+const testToken = "quickport://0RTBM-4G9AE-S2M1Q-3Z7XW-PQ8K5-G4R7H-2N5DA-9FJ2C-8VVTQ-MN5A0-3E7"
+
+// drawCode は code を1モジュール scale ピクセルで、周りに quietZone の余白を付けて描く
+func drawCode(code *qr.Code, scale int, dark, light color.Gray) *image.Gray {
+	size := (code.Size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := light
+			if code.Black(x/scale-quietZone, y/scale-quietZone) {
+				c = dark
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func encode(t *testing.T, text string, level qr.Level) *qr.Code {
+	t.Helper()
+
+	code, err := qr.Encode(text, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		level qr.Level
+	}{
+		{"token", testToken, qr.M},
+		{"numeric", "0123456789012345678901234567890", qr.L},
+		{"alphanumeric", "QUICKPORT 0RTBM-4G9AE $%*+-./:", qr.Q},
+		{"bytes", "ホスト: quickport://0RTBM-4G9AE", qr.H},
+		{"long", strings.Repeat("QuickPort-", 40), qr.L},
+	}
+
+	for _, tt := range tests {
+		for _, scale := range []int{2, 3, 5, 8} {
+			code := encode(t, tt.text, tt.level)
+			got, err := Decode(drawCode(code, scale, color.Gray{0}, color.Gray{0xff}))
+			if err != nil || got != tt.text {
+				t.Errorf("%s at scale %d: Decode() = %q, %v", tt.name, scale, got, err)
+			}
+		}
+	}
+}
+
+func TestDecodeInverted(t *testing.T) {
+	code := encode(t, testToken, qr.M)
+	for _, scale := range []int{2, 4, 7} {
+		got, err := Decode(drawCode(code, scale, color.Gray{0xdd}, color.Gray{0x1e}))
+		if err != nil || got != testToken {
+			t.Errorf("scale %d: Decode() = %q, %v", scale, got, err)
+		}
+	}
+}
+
+func TestDecodeNoisyJPEG(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	code := encode(t, testToken, qr.M)
+
+	for _, scale := range []int{3, 5, 8} {
+		img := drawCode(code, scale, color.Gray{0x20}, color.Gray{0xe0})
+		for i := range img.Pix {
+			if rng.Intn(200) == 0 {
+				img.Pix[i] ^= 0xff
+			}
+		}
+
+		var buf bytes.Buffer
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		noisy, err := jpeg.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := Decode(noisy)
+		if err != nil || got != testToken {
+			t.Errorf("scale %d: Decode() = %q, %v", scale, got, err)
+		}
+	}
+}
+
+// 端末に表示した Render の出力を、文字のセルごとに塗った画像 (スクリーンショット) として読む
+func TestDecodeRender(t *testing.T) {
+	text, err := Render(testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const cellWidth, cellHeight = 8, 16
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	width := len([]rune(lines[0]))
+	img := image.NewGray(image.Rect(0, 0, width*cellWidth, len(lines)*cellHeight))
+	for i := range img.Pix {
+		img.Pix[i] = 0x1e
+	}
+	for row, line := range lines {
+		for col, r := range []rune(line) {
+			for y := 0; y < cellHeight; y++ {
+				top := y < cellHeight/2
+				if r == '█' || (r == '▀' && top) || (r == '▄' && !top) {
+					for x := 0; x < cellWidth; x++ {
+						img.SetGray(col*cellWidth+x, row*cellHeight+y, color.Gray{0xdd})
+					}
+				}
+			}
+		}
+	}
+
+	got, err := Decode(img)
+	if err != nil || got != testToken {
+		t.Errorf("Decode() = %q, %v", got, err)
+	}
+}
+
+func TestDecodeNotFound(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 200, 200))
+	if _, err := Decode(img); err != ErrNotFound {
+		t.Errorf("Decode() = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestCorrect(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	tests := []struct {
+		name       string
+		data, nsym int
+	}{
+		{"version 1-L", 19, 7},
+		{"version 2-M", 28, 16},
+		{"version 5-Q", 15, 18},
+		{"version 10-H", 15, 28},
+		{"version 40-L", 118, 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := gf256.NewRSEncoder(coding.Field, tt.nsym)
+			for errs := 0; errs <= tt.nsym/2; errs++ {
+				data := make([]byte, tt.data)
+				rng.Read(data)
+				check := make([]byte, tt.nsym)
+				enc.ECC(data, check)
+				want := append(data, check...)
+
+				block := append([]byte(nil), want...)
+				for _, p := range rng.Perm(len(block))[:errs] {
+					block[p] ^= byte(1 + rng.Intn(255))
+				}
+
+				err := correct(block, tt.nsym)
+				if err != nil || !bytes.Equal(block, want) {
+					t.Errorf("%d errors: correct() = %v", errs, err)
+				}
+			}
+		})
+	}
+}
+
+// 訂正できる数を超えた誤りは、直したふりをせずにエラーにする (別の符号語に化ける場合は除く)
+func TestCorrectTooManyErrors(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	enc := gf256.NewRSEncoder(coding.Field, 16)
+
+	failed := 0
+	for i := 0; i < 100; i++ {
+		data := make([]byte, 28)
+		rng.Read(data)
+		check := make([]byte, 16)
+		enc.ECC(data, check)
+		want := append(data, check...)
+
+		block := append([]byte(nil), want...)
+		for _, p := range rng.Perm(len(block))[:12] {
+			block[p] ^= byte(1 + rng.Intn(255))
+		}
+
+		err := correct(block, 16)
+		if err == nil && bytes.Equal(block, want) {
+			t.Fatal("correct() recovered more errors than the code can correct")
+		}
+		if err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Error("correct() never reported an uncorrectable block")
+	}
+}
@@ -0,0 +1,45 @@
+package qrcode
+
+import (
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// QR コードを端末に表示する
+// 上下2つのモジュールを1文字 (▀ ▄ █ 空白) にまとめるので、縦横の比がほぼ正方形になる
+// 端末は暗い背景が多いので、明るいモジュールを文字で塗る (明るい背景では色が反転して見えるが、多くの読み取りアプリは読める)
+const quietZone = 4 // 周りの余白 (モジュール数、規格の最小)
+
+// Render は text の QR コードを端末用の文字列にする
+func Render(text string) (string, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+
+	// 余白とコードの外は明るいモジュール
+	light := func(x, y int) bool {
+		return !code.Black(x, y)
+	}
+
+	var sb strings.Builder
+	for y := -quietZone; y < code.Size+quietZone; y += 2 {
+		for x := -quietZone; x < code.Size+quietZone; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+
+	return sb.String(), nil
+}
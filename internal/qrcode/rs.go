@@ -0,0 +1,124 @@
+package qrcode
+
+import (
+	"errors"
+
+	"rsc.io/qr/coding"
+)
+
+var errUncorrectable = errors.New("too many errors in qr block")
+
+// correct は1ブロック (データ + 誤り訂正) の誤りを Reed-Solomon で直す (block をその場で書き換える)
+// QR の生成多項式の根は α^0 .. α^(nsym-1)
+func correct(block []byte, nsym int) error {
+	f := coding.Field
+
+	syndromes := make([]byte, nsym)
+	clean := true
+	for i := range syndromes {
+		syndromes[i] = evalBlock(block, f.Exp(i))
+		if syndromes[i] != 0 {
+			clean = false
+		}
+	}
+	if clean {
+		return nil
+	}
+
+	// Berlekamp-Massey で誤り位置多項式 (係数は次数の低い順) を求める
+	locator := []byte{1}
+	prev := []byte{1}
+	errs, shift := 0, 1
+	var last byte = 1
+	for n := 0; n < nsym; n++ {
+		d := syndromes[n]
+		for i := 1; i <= errs && i < len(locator); i++ {
+			d ^= f.Mul(locator[i], syndromes[n-i])
+		}
+		if d == 0 {
+			shift++
+			continue
+		}
+
+		scale := f.Mul(d, f.Inv(last))
+		next := append([]byte(nil), locator...)
+		for len(next) < len(prev)+shift {
+			next = append(next, 0)
+		}
+		for i, c := range prev {
+			next[i+shift] ^= f.Mul(scale, c)
+		}
+
+		if 2*errs <= n {
+			prev, errs, last, shift = locator, n+1-errs, d, 1
+		} else {
+			shift++
+		}
+		locator = next
+	}
+	if 2*errs > nsym {
+		return errUncorrectable
+	}
+
+	// 誤り評価多項式 Ω(x) = S(x)Λ(x) mod x^nsym
+	omega := make([]byte, nsym)
+	for i := range omega {
+		for j := 0; j <= i && j < len(locator); j++ {
+			omega[i] ^= f.Mul(locator[j], syndromes[i-j])
+		}
+	}
+
+	// Chien 探索で誤りの位置を探し、Forney の式で値を求める
+	found := 0
+	n := len(block)
+	for p := 0; p < n; p++ {
+		xinv := f.Exp(255 - p)
+		if evalPoly(locator, xinv) != 0 {
+			continue
+		}
+
+		// 標数 2 なので形式的な微分は奇数次の項だけ残る
+		var deriv byte
+		for i := 1; i < len(locator); i += 2 {
+			deriv ^= f.Mul(locator[i], f.Exp((255-p)*(i-1)))
+		}
+		if deriv == 0 {
+			return errUncorrectable
+		}
+
+		magnitude := f.Mul(f.Exp(p), f.Mul(evalPoly(omega, xinv), f.Inv(deriv)))
+		block[n-1-p] ^= magnitude
+		found++
+	}
+	if found != errs {
+		return errUncorrectable
+	}
+
+	for i := 0; i < nsym; i++ {
+		if evalBlock(block, f.Exp(i)) != 0 {
+			return errUncorrectable
+		}
+	}
+
+	return nil
+}
+
+// evalBlock は block (先頭が最高次) を x で評価する
+func evalBlock(block []byte, x byte) byte {
+	var v byte
+	for _, c := range block {
+		v = coding.Field.Mul(v, x) ^ c
+	}
+
+	return v
+}
+
+// evalPoly は poly (次数の低い順) を x で評価する
+func evalPoly(poly []byte, x byte) byte {
+	var v byte
+	for i := len(poly) - 1; i >= 0; i-- {
+		v = coding.Field.Mul(v, x) ^ poly[i]
+	}
+
+	return v
+}
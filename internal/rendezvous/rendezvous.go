@@ -0,0 +1,328 @@
+package rendezvous
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ペアリングコードで接続するための待ち合わせサーバー
+// host は番号 (nameplate) を受け取ってコードの先頭にし、client は同じ番号を指定して合流する
+// 番号は空いているものからランダムに選ぶので、次に発行される番号を狙って待ち構えることはできない
+// 合流した2本の TCP 接続の間でバイト列を中継するだけなので、サーバーはコードも鍵も知らない
+//
+// プロトコル (1行ずつ):
+//
+//	host   -> "ALLOCATE"        server -> "NAMEPLATE <n>" ... 合流したら "PAIRED"
+//	client -> "JOIN <n>"        server -> "PAIRED" または "ERROR <理由>"
+//
+// PAIRED 以降は中継
+const (
+	DefaultPort = 55189
+	EnvAddr     = "QUICKPORT_RENDEZVOUS" // 待ち合わせサーバーのアドレスを指定する環境変数
+
+	maxNameplate = 999
+	hostTimeout  = 10 * time.Minute
+	lineTimeout  = 10 * time.Second
+	relayLimit   = 64 << 10 // ペアリングの後はこれ以上中継しない
+)
+
+// Addr は環境変数で指定された待ち合わせサーバーのアドレス (指定が無ければ空)
+func Addr() string {
+	return WithPort(os.Getenv(EnvAddr))
+}
+
+// WithPort はポートの無いアドレスに DefaultPort を付ける
+func WithPort(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return ""
+	}
+
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(DefaultPort))
+	}
+
+	return addr
+}
+
+// Server は待ち合わせサーバー
+type Server struct {
+	mu      sync.Mutex
+	waiting map[int]*waitingHost
+}
+
+type waitingHost struct {
+	conn   net.Conn
+	paired chan net.Conn
+}
+
+func NewServer() *Server {
+	return &Server{waiting: make(map[int]*waitingHost)}
+}
+
+// ListenAndServe は addr で待ち合わせを受け付ける
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	logrus.Infof("Rendezvous server listening on %s", listener.Addr())
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(lineTimeout))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 1 && fields[0] == "ALLOCATE":
+		s.host(conn)
+	case len(fields) == 2 && fields[0] == "JOIN":
+		s.join(conn, fields[1])
+	default:
+		fmt.Fprintf(conn, "ERROR bad request\n")
+		conn.Close()
+	}
+}
+
+// host は空いている番号を割り当て、client が来るまで待つ
+// 待っている間も host の接続を読み、切断されたらすぐに番号を返す
+func (s *Server) host(conn net.Conn) {
+	nameplate, w := s.allocate(conn)
+	if w == nil {
+		fmt.Fprintf(conn, "ERROR no free nameplate\n")
+		conn.Close()
+		return
+	}
+
+	_, err := fmt.Fprintf(conn, "NAMEPLATE %d\n", nameplate)
+	if err != nil {
+		s.release(nameplate, w)
+		conn.Close()
+		return
+	}
+	logrus.Debugf("Allocated nameplate %d for %s", nameplate, conn.RemoteAddr())
+
+	// host は PAIRED を受け取るまで何も送らないので、読めたら切断されたということ
+	// 合流と同時に host が送り始めていたら、見張りが読んだ分も中継する
+	var first [1]byte
+	watch := make(chan int, 1)
+	go func() {
+		n, _ := conn.Read(first[:])
+		watch <- n
+	}()
+	pair := func(peer net.Conn) {
+		conn.SetReadDeadline(time.Now())
+		n := <-watch
+		conn.SetReadDeadline(time.Time{})
+		relay(conn, io.MultiReader(bytes.NewReader(first[:n]), conn), peer)
+	}
+
+	select {
+	case peer := <-w.paired:
+		pair(peer)
+	case n := <-watch:
+		watch <- n
+		// 同時に client が合流していたらそちらを優先する
+		if !s.release(nameplate, w) {
+			pair(<-w.paired)
+			return
+		}
+
+		logrus.Debugf("Host for nameplate %d left", nameplate)
+		conn.Close()
+	case <-time.After(hostTimeout):
+		if !s.release(nameplate, w) {
+			pair(<-w.paired)
+			return
+		}
+
+		fmt.Fprintf(conn, "ERROR timed out\n")
+		conn.Close()
+	}
+}
+
+// join は番号で待っている host と合流させる (番号は一度しか使えない)
+func (s *Server) join(conn net.Conn, text string) {
+	nameplate, err := strconv.Atoi(text)
+	s.mu.Lock()
+	w := s.waiting[nameplate]
+	if err == nil && w != nil {
+		delete(s.waiting, nameplate)
+	}
+	s.mu.Unlock()
+
+	if err != nil || w == nil {
+		fmt.Fprintf(conn, "ERROR unknown code\n")
+		conn.Close()
+		return
+	}
+
+	fmt.Fprintf(w.conn, "PAIRED\n")
+	fmt.Fprintf(conn, "PAIRED\n")
+	w.paired <- conn
+}
+
+// allocate は空いている番号からランダムに1つ選ぶ
+func (s *Server) allocate(conn net.Conn) (int, *waitingHost) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	free := make([]int, 0, maxNameplate)
+	for n := 1; n <= maxNameplate; n++ {
+		if s.waiting[n] == nil {
+			free = append(free, n)
+		}
+	}
+	if len(free) == 0 {
+		return 0, nil
+	}
+
+	n := free[rand.IntN(len(free))]
+	w := &waitingHost{conn: conn, paired: make(chan net.Conn, 1)}
+	s.waiting[n] = w
+	return n, w
+}
+
+// release は番号を返す。既に client が合流していたら false
+func (s *Server) release(nameplate int, w *waitingHost) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.waiting[nameplate] != w {
+		return false
+	}
+
+	delete(s.waiting, nameplate)
+	return true
+}
+
+// relay は2本の接続の間でペアリングのメッセージを中継する (a からは aReader で読む)
+func relay(a net.Conn, aReader io.Reader, b net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, io.LimitReader(src, relayLimit))
+		done <- struct{}{}
+	}
+
+	go pipe(a, b)
+	go pipe(b, aReader)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// Allocate はサーバーから番号を受け取る。client が合流するのは Wait で待つ
+func Allocate(addr string) (net.Conn, *bufio.Reader, int, error) {
+	conn, err := net.DialTimeout("tcp", addr, lineTimeout)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to reach rendezvous server %s: %v", addr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	fields, err := request(conn, reader, "ALLOCATE")
+	if err != nil {
+		conn.Close()
+		return nil, nil, 0, err
+	}
+
+	nameplate, err := strconv.Atoi(fields[len(fields)-1])
+	if fields[0] != "NAMEPLATE" || err != nil {
+		conn.Close()
+		return nil, nil, 0, fmt.Errorf("unexpected reply from rendezvous server: %s", strings.Join(fields, " "))
+	}
+
+	return conn, reader, nameplate, nil
+}
+
+// Wait は client が合流するまで待つ
+func Wait(reader *bufio.Reader) error {
+	fields, err := readLine(reader)
+	if err != nil {
+		return err
+	}
+	if fields[0] != "PAIRED" {
+		return fmt.Errorf("rendezvous failed: %s", strings.Join(fields, " "))
+	}
+
+	return nil
+}
+
+// Join は番号で待っている host と合流する
+func Join(addr string, nameplate int) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", addr, lineTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reach rendezvous server %s: %v", addr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	fields, err := request(conn, reader, fmt.Sprintf("JOIN %d", nameplate))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if fields[0] != "PAIRED" {
+		conn.Close()
+		return nil, nil, fmt.Errorf("rendezvous failed: %s", strings.Join(fields, " "))
+	}
+
+	return conn, reader, nil
+}
+
+func request(conn net.Conn, reader *bufio.Reader, line string) ([]string, error) {
+	_, err := fmt.Fprintf(conn, "%s\n", line)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(lineTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	return readLine(reader)
+}
+
+func readLine(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("rendezvous server closed the connection: %v", err)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty reply from rendezvous server")
+	}
+
+	return fields, nil
+}
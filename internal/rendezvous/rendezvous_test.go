@@ -0,0 +1,126 @@
+package rendezvous
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go NewServer().Serve(listener)
+	return listener.Addr().String()
+}
+
+func TestWithPort(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"", ""},
+		{"  ", ""},
+		{"example.com", "example.com:55189"},
+		{"example.com:4000", "example.com:4000"},
+		{" 192.0.2.1\n", "192.0.2.1:55189"},
+		{"::1", "[::1]:55189"},
+		{"[::1]", "[::1]:55189"},
+		{"[::1]:4000", "[::1]:4000"},
+	}
+
+	for _, tt := range tests {
+		if got := WithPort(tt.addr); got != tt.want {
+			t.Errorf("WithPort(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestPairAndRelay(t *testing.T) {
+	addr := startServer(t)
+
+	host, hostReader, nameplate, err := Allocate(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	client, clientReader, err := Join(addr, nameplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := Wait(hostReader); err != nil {
+		t.Fatal(err)
+	}
+
+	// 合流した後は両方向に中継する
+	host.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(clientReader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("client read %q, %v", buf, err)
+	}
+	client.Write([]byte("pong"))
+	if _, err := io.ReadFull(hostReader, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("host read %q, %v", buf, err)
+	}
+
+	// 番号は一度しか使えない
+	if _, _, err := Join(addr, nameplate); err == nil {
+		t.Error("joined a nameplate twice")
+	}
+}
+
+// 切断した host の番号はすぐに空き、合流できなくなる
+func TestHostLeaves(t *testing.T) {
+	addr := startServer(t)
+
+	host, _, nameplate, err := Allocate(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		client, _, err := Join(addr, nameplate)
+		if err != nil {
+			break
+		}
+		client.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("nameplate of a closed host is still joinable")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAllocateRandom(t *testing.T) {
+	addr := startServer(t)
+
+	seen := map[int]bool{}
+	for i := 0; i < 8; i++ {
+		host, _, nameplate, err := Allocate(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer host.Close()
+
+		if nameplate < 1 || nameplate > maxNameplate || seen[nameplate] {
+			t.Fatalf("nameplate %d (already allocated: %v)", nameplate, seen)
+		}
+		seen[nameplate] = true
+	}
+
+	// 空いている番号を小さい順に配っていない
+	if seen[1] && seen[2] && seen[3] && seen[4] && seen[5] && seen[6] && seen[7] && seen[8] {
+		t.Error("nameplates are handed out lowest-free first")
+	}
+}
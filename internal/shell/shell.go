@@ -5,6 +5,8 @@ import (
 	"QuickPort/utils"
 	"fmt"
 	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
 func Run(handle *core.Handle) (*core.Handle, error) {
@@ -26,19 +28,33 @@ func Run(handle *core.Handle) (*core.Handle, error) {
 		}
 
 		args := core.ShellArgs{
-			Arg:    strings.Split(cmd, " "),
+			Arg:    splitArgs(cmd),
 			Handle: handle,
 		}
 
 		switch args.Head() {
 		case "get":
-			handle.Pause <- true
-			err := core.GetFile(handle, args.Next())
+			// 転送は並行して進められるので、終わるのを待たずに次のコマンドを受け付ける
+			go background(core.GetFile, handle, args.Next())
+		case "put":
+			go background(core.PutFile, handle, args.Next())
+		case "accept":
+			go background(core.AcceptPut, handle, args.Next())
+		case "decline":
+			err := core.DeclinePut(handle, args.Next())
+			if err != nil {
+				logrus.Error(err)
+			}
+		case "maxput":
+			err := core.SetMaxPut(handle, args.Next())
+			if err != nil {
+				return handle, err
+			}
+		case "limit":
+			err := core.SetLimit(handle, args.Next())
 			if err != nil {
 				return handle, err
 			}
-			handle.ResetConn()
-			handle.Pause <- false
 		case "exit":
 			return handle, nil
 			//exit process
@@ -47,3 +63,45 @@ func Run(handle *core.Handle) (*core.Handle, error) {
 		}
 	}
 }
+
+// background は転送系のコマンドを実行し、終わったらプロンプトを出し直す
+func background(cmd func(*core.Handle, *core.ShellArgs) error, handle *core.Handle, args *core.ShellArgs) {
+	err := cmd(handle, args)
+	if err != nil {
+		logrus.Error(err)
+	}
+
+	//rewrite Prefix
+	fmt.Printf("> ")
+}
+
+// splitArgs はコマンドを空白で区切る。'...' や "..." で囲んだ部分は1つの引数として扱う (パターンや空白を含むパス用)
+func splitArgs(cmd string) []string {
+	args := []string{}
+	var current strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range cmd {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '\'' || r == '"'):
+			quote = r
+			inArg = true
+		case quote == 0 && r == ' ':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args
+}
@@ -0,0 +1,65 @@
+package tray
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"strconv"
+)
+
+// ファイルの整合性確認に使うハッシュ
+const (
+	HashSHA256 = "sha256"
+	HashFNV32  = "fnv32" // 古いピア向け (衝突しやすく、改ざんの検出には使えない)
+)
+
+// NewHash は algorithm のハッシュを返す
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashFNV32:
+		return fnv.New32a(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm: %q", algorithm)
+	}
+}
+
+// FormatHash はハッシュ値を文字列にする (FNV は従来どおり10進数)
+func FormatHash(algorithm string, h hash.Hash) string {
+	if h32, ok := h.(hash.Hash32); ok && algorithm == HashFNV32 {
+		return strconv.FormatUint(uint64(h32.Sum32()), 10)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashReader は r を最後まで読みながら algorithm のハッシュを計算する
+func HashReader(r io.Reader, algorithm string) (string, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+
+	return FormatHash(algorithm, h), nil
+}
+
+// HashFile はファイル全体を読み込まずに algorithm のハッシュを計算する
+func HashFile(path string, algorithm string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return HashReader(file, algorithm)
+}
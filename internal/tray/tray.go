@@ -1,15 +1,34 @@
 package tray
 
 import (
-	"hash/fnv"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
-	"strconv"
+	"strings"
 )
 
 var trayPath string
 
+// 受信途中の作業用ファイルの拡張子 (一覧に載せず、相手からも取得させない)
+const (
+	PartialSuffix  = ".qppart"  // 途中までの受信状況のサイドカー
+	DeltaSuffix    = ".qpdelta" // 受信中の差分
+	DeltaNewSuffix = ".qpnew"   // 差分から組み立て中のファイル
+	TempSuffix     = ".tmp"     // サイドカーを置き換える前の一時ファイル (PartialSuffix に付ける)
+)
+
+// IsWorkFile は受信途中の作業用ファイルか
+func IsWorkFile(name string) bool {
+	for _, suffix := range []string{PartialSuffix, PartialSuffix + TempSuffix, DeltaSuffix, DeltaNewSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func UseTray() string {
 	return trayPath
 }
@@ -20,18 +39,32 @@ func SetTray(path string) error {
 		return err
 	}
 
-	trayPath = traypath + "\\"
+	trayPath = traypath
 	return nil
 }
 
-func GetTrayItems(dir string) ([]FileMeta, error) {
+// Resolve はトレイからの相対パス (区切りは "/") をトレイ内のパスにする。トレイの外を指すパスと受信途中の作業用ファイルはエラー
+func Resolve(rel string) (string, error) {
+	local := filepath.FromSlash(rel)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("path is outside the tray: %s", rel)
+	}
+	if IsWorkFile(local) {
+		return "", fmt.Errorf("path is a file still being received: %s", rel)
+	}
+
+	return filepath.Join(trayPath, local), nil
+}
+
+// GetTrayItems は dir 以下のファイルを algorithm のハッシュ付きで一覧にする
+func GetTrayItems(dir string, algorithm string) ([]FileMeta, error) {
 	files := []FileMeta{}
 	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return nil
 		}
-		if !d.IsDir() {
-			file, err := NewFileMeta(path, dir)
+		if !d.IsDir() && !IsWorkFile(path) {
+			file, err := NewFileMeta(path, dir, algorithm)
 			if err != nil {
 				return nil
 			}
@@ -47,13 +80,13 @@ func GetTrayItems(dir string) ([]FileMeta, error) {
 	return files, nil
 }
 
-func NewFileMeta(path string, baseDir string) (*FileMeta, error) {
+func NewFileMeta(path string, baseDir string, algorithm string) (*FileMeta, error) {
 	info, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
 
-	hash, err := HashFile(path)
+	hash, err := HashFile(path, algorithm)
 	if err != nil {
 		return nil, err
 	}
@@ -64,19 +97,9 @@ func NewFileMeta(path string, baseDir string) (*FileMeta, error) {
 	}
 
 	return &FileMeta{
-		Filename: relPath,
+		Filename: filepath.ToSlash(relPath),
 		Size:     info.Size(),
 		Hash:     hash,
+		HashAlgo: algorithm,
 	}, nil
 }
-
-func HashFile(path string) (string, error) {
-	raw, err := os.ReadFile(path)
-	if err != nil {
-		return "", err
-	}
-
-	h := fnv.New32a()
-	h.Write([]byte(raw))
-	return strconv.FormatUint(uint64(h.Sum32()), 10), nil
-}
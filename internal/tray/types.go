@@ -6,16 +6,25 @@ const (
 	Deny AuthFlag = iota
 	Allow
 	AccessReq
+	Challenge // 接続要求への応答として、トークンの秘密の証明を求める
 )
 
 type FileMeta struct {
-	Filename string `json:"filename"` // ファイル名
-	Size     int64  `json:"size"`     // バイト数
-	Hash     string `json:"hash"`     // 簡易整合性確認用（例: SHA256）
+	Filename string `json:"filename"`  // ファイル名
+	Size     int64  `json:"size"`      // バイト数
+	Hash     string `json:"hash"`      // 整合性確認用
+	HashAlgo string `json:"hash_algo"` // Hash のアルゴリズム (HashSHA256 など)
 }
 
 type AuthMeta struct {
-	Name    string
-	SubPort int
-	Flag    AuthFlag
+	Version    int    // 対応する最新のプロトコルバージョン (応答では合意したバージョン)
+	MinVersion int    // 対応する最古のプロトコルバージョン
+	Caps       uint64 // 対応機能 (応答では合意した機能)
+	Name       string
+	SubPort    int
+	Flag       AuthFlag
+	Reason     string // 拒否の理由
+	PublicKey  []byte // セッションの鍵交換に使う X25519 の公開鍵
+	Nonce      []byte // host が送ったチャレンジ
+	Proof      []byte // トークンの秘密を知っていることを示す HMAC
 }
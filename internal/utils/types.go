@@ -7,6 +7,8 @@ var ttyHandler tty.TTY
 const (
 	GenToken StartUpMode = iota
 	UseToken
+	UseCode
+	GenCode
 	DebugLevel
 )
 
@@ -1,7 +1,11 @@
 package utils
 
 import (
+	"fmt"
+	"math"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/mattn/go-tty"
 	"github.com/sirupsen/logrus"
@@ -52,3 +56,75 @@ func OpenTty() (*tty.TTY, error) {
 func UseTty() (*tty.TTY, error) {
 	return &ttyHandler, nil
 }
+
+var sizeUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9},
+	{"k", 1e3}, {"m", 1e6}, {"g", 1e9},
+	{"b", 1},
+}
+
+// ParseRate は "5MB/s" や "500k" のような帯域指定を bytes/s に変換する
+func ParseRate(s string) (int64, error) {
+	rate, err := ParseSize(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate: %s", s)
+	}
+
+	return rate, nil
+}
+
+// ParseSize は "100MB" や "1.5GiB" のような大きさを bytes に変換する
+func ParseSize(s string) (int64, error) {
+	text := strings.ToLower(strings.TrimSpace(s))
+
+	scale := 1.0
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSuffix(text, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+
+	// inf や nan、1 byte 未満、int64 に収まらない大きさは変換前に弾く
+	value, err := strconv.ParseFloat(text, 64)
+	size := value * scale
+	if err != nil || math.IsNaN(size) || size < 1 || size >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+
+	return int64(size), nil
+}
+
+// ParsePercent は "10%" や "10" のような割合を 1-100 の整数にする
+func ParsePercent(s string) (int, error) {
+	value, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if err != nil || value <= 0 || value > 100 {
+		return 0, fmt.Errorf("invalid percentage: %s", s)
+	}
+
+	return value, nil
+}
+
+// FormatRate は bytes/s を読みやすい表記にする
+func FormatRate(rate int64) string {
+	return FormatSize(rate) + "/s"
+}
+
+// FormatSize は bytes を読みやすい表記にする
+func FormatSize(size int64) string {
+	switch {
+	case size >= 1e9:
+		return fmt.Sprintf("%.1fGB", float64(size)/1e9)
+	case size >= 1e6:
+		return fmt.Sprintf("%.1fMB", float64(size)/1e6)
+	case size >= 1e3:
+		return fmt.Sprintf("%.1fKB", float64(size)/1e3)
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
@@ -0,0 +1,46 @@
+package utils
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"100", 100, true},
+		{"1b", 1, true},
+		{"100MB", 100e6, true},
+		{" 1.5GiB ", 3 << 29, true},
+		{"500k", 500e3, true},
+		{"2kib", 2048, true},
+		{"9223372036854775807", 0, false}, // float64 では 2^63 に丸められ int64 を超える
+		{"8589934591gib", 8589934591 << 30, true},
+		{"8589934592gib", 0, false},
+		{"1e30gb", 0, false},
+		{"inf", 0, false},
+		{"+Inf", 0, false},
+		{"infgb", 0, false},
+		{"nan", 0, false},
+		{"NaNMB", 0, false},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"0.5", 0, false},
+		{"0.0001kb", 0, false},
+		{"", 0, false},
+		{"mb", 0, false},
+		{"abc", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSize(tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("ParseSize(%q) error = %v, want ok = %v", tt.in, err, tt.ok)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}